@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Users can delete their own account, which happens after a grace period so they can change their mind.
+// Admins with CanDeleteUsers can delete accounts straight away.
+//
+// Either way, the account's messages are deleted or given to the "Deleted User" tombstone account,
+// so conversations still make sense without saying who was in them.
+
+var account_deletion_grace_days string = os.Getenv("SCRATCHCORD_ACCOUNT_DELETION_GRACE_DAYS")
+
+const (
+	default_account_deletion_grace_days = 14
+	account_deletion_sweep_interval     = time.Hour
+
+	tombstone_username = "Deleted User"
+
+	deleted_messages_delete    = "delete"
+	deleted_messages_anonymize = "anonymize"
+)
+
+var (
+	ErrDeletedMessagesInvalid = errors.New("messages must be \"delete\" or \"anonymize\"")
+	ErrTombstoneAccount       = errors.New("can't delete the deleted user")
+)
+
+type DeleteAccountRequest struct {
+	Password string
+	Code     string // Only if two factor is on
+	Messages string // "delete" or "anonymize"
+}
+
+type DeleteUserRequest struct {
+	UserId   uint
+	Messages string // "delete" or "anonymize"
+}
+
+func AccountDeletionGracePeriod() time.Duration {
+	days := default_account_deletion_grace_days
+	if account_deletion_grace_days != "" {
+		parsed, err := strconv.Atoi(account_deletion_grace_days)
+		if err != nil || parsed < 0 {
+			log.Printf("SCRATCHCORD_ACCOUNT_DELETION_GRACE_DAYS is invalid, using %d", default_account_deletion_grace_days)
+		} else {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// The account deleted users' messages get moved to. It can't be logged into, since it has no password or ranks.
+func TombstoneAccount() (Accounts, error) {
+	account := Accounts{}
+	err := db.Where(Accounts{Username: tombstone_username}).Attrs(Accounts{
+		Ranks:       "[]",
+		DateCreated: uint64(time.Now().Unix()),
+	}).FirstOrCreate(&account).Error
+	return account, err
+}
+
+// Whether messages should be deleted, from what the request asked for. Anonymizing is the default.
+func parse_deleted_messages(messages string) (bool, error) {
+	switch messages {
+	case "", deleted_messages_anonymize:
+		return false, nil
+	case deleted_messages_delete:
+		return true, nil
+	}
+	return false, ErrDeletedMessagesInvalid
+}
+
+// Deletes an account & everything that belongs to it, for good
+func DeleteAccount(account Accounts, deleteMessages bool) error {
+	tombstone, err := TombstoneAccount()
+	if err != nil {
+		return err
+	}
+	if account.ID == tombstone.ID {
+		return ErrTombstoneAccount
+	}
+
+	var channels []string
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Hooks would broadcast every message one by one, instead there's one event per channel once it's committed
+		if err := tx.Unscoped().Model(&Messages{}).Where("user_id = ?", account.ID).Distinct().Pluck("channel", &channels).Error; err != nil {
+			return err
+		}
+		messages := tx.Session(&gorm.Session{SkipHooks: true}).Unscoped().Model(&Messages{}).Where("user_id = ?", account.ID)
+		if deleteMessages {
+			if err := messages.Delete(&Messages{}).Error; err != nil {
+				return err
+			}
+		} else if err := messages.UpdateColumn("user_id", tombstone.ID).Error; err != nil {
+			return err
+		}
+
+		owned := []interface{}{
+			&Sessions{}, &RefreshTokens{}, &BotTokens{}, &OidcIdentities{}, &TwoFactorSecrets{},
+			&EmailTokens{}, &PreviousUsernames{}, &MatrixPuppets{}, &RankChanges{},
+		}
+		for _, model := range owned {
+			if err := tx.Unscoped().Where("account_id = ?", account.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("kind = ? AND value = ?", "username", UsernameKey(account.Username)).Delete(&LoginLockouts{}).Error; err != nil {
+			return err
+		}
+		return tx.Unscoped().Delete(&account).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	newUserId := tombstone.ID
+	if deleteMessages {
+		newUserId = 0
+	}
+	for _, channel := range channels {
+		BroadcastPublisher.Publish(BroadcastDBMessage{
+			event:     "account_deleted",
+			data:      Messages{Channel: channel, UserId: account.ID},
+			newUserId: newUserId,
+		})
+	}
+
+	// Anything still connected would keep going as an account that doesn't exist
+	LiveConnections.CloseAll(account.ID)
+	DeleteProfilePicture(account)
+	delete_data_exports(account.ID)
+	log.Printf("deleted account %d (%s)", account.ID, account.Username)
+	return nil
+}
+
+func start_account_deletion_sweeper() {
+	if _, err := TombstoneAccount(); err != nil {
+		log.Printf("failed to create the deleted user account: %v", err)
+	}
+	go func() {
+		for {
+			accounts := []Accounts{}
+			if err := db.Find(&accounts, "delete_at != 0 AND delete_at <= ?", time.Now().Unix()).Error; err != nil {
+				log.Printf("failed to find accounts to delete: %v", err)
+			}
+			for _, account := range accounts {
+				if err := DeleteAccount(account, account.DeleteMessages); err != nil {
+					log.Printf("failed to delete account %d: %v", account.ID, err)
+				}
+			}
+			time.Sleep(account_deletion_sweep_interval)
+		}
+	}()
+}
+
+func delete_account(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	r := new(DeleteAccountRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if err := CheckPassword(account.PasswordHash, r.Password); err != nil {
+		return c.SendString("wrong password!")
+	}
+	if twoFactor, ok := GetTwoFactor(account.ID); ok && twoFactor.Enabled && !twoFactor.Verify(r.Code) {
+		return c.SendString("wrong code!")
+	}
+	deleteMessages, err := parse_deleted_messages(r.Messages)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+
+	grace := AccountDeletionGracePeriod()
+	if grace == 0 {
+		if err := DeleteAccount(account, deleteMessages); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendString("sucess!")
+	}
+
+	account.DeleteAt = uint64(time.Now().Add(grace).Unix())
+	account.DeleteMessages = deleteMessages
+	if err := db.Model(&account).UpdateColumns(map[string]interface{}{"delete_at": account.DeleteAt, "delete_messages": deleteMessages}).Error; err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{"delete_at": account.DeleteAt})
+}
+
+func cancel_account_deletion(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	if account.DeleteAt == 0 {
+		return c.SendString("account is not being deleted!")
+	}
+	account.DeleteAt = 0
+	account.DeleteMessages = false
+	if err := db.Model(&account).UpdateColumns(map[string]interface{}{"delete_at": 0, "delete_messages": false}).Error; err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendString("sucess!")
+}
+
+func DeleteUserAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanDeleteUsers"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(DeleteUserRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	deleteMessages, err := parse_deleted_messages(r.Messages)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", r.UserId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	if err := DeleteAccount(account, deleteMessages); errors.Is(err, ErrTombstoneAccount) {
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendString("sucess!")
+}
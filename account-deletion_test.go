@@ -0,0 +1,55 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestDeleteAccountPublishesOneEventPerChannel(t *testing.T) {
+	for _, deleteMessages := range []bool{false, true} {
+		setup_test_db(t, &Accounts{}, &Messages{}, &RankChanges{}, &Sessions{}, &RefreshTokens{}, &BotTokens{},
+			&OidcIdentities{}, &TwoFactorSecrets{}, &EmailTokens{}, &PreviousUsernames{}, &MatrixPuppets{},
+			&LoginLockouts{}, &DataExports{})
+		setup_test_avatars(t)
+
+		account := create_test_account(t, "someone", `[]`)
+		for _, channel := range []string{"general", "general", "general", "random"} {
+			if err := db.Create(&Messages{Type: 1, Channel: channel, UserId: account.ID, Message: "hi"}).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		events := BroadcastPublisher.Subscribe()
+		if err := DeleteAccount(account, deleteMessages); err != nil {
+			t.Fatal(err)
+		}
+		tombstone, _ := TombstoneAccount()
+
+		channels := []string{}
+	collect:
+		for {
+			select {
+			case msg := <-events:
+				if msg.event != "account_deleted" {
+					t.Fatalf("got a %s event", msg.event)
+				}
+				if msg.data.UserId != account.ID {
+					t.Errorf("event is for user %d", msg.data.UserId)
+				}
+				if deleteMessages && msg.newUserId != 0 || !deleteMessages && msg.newUserId != tombstone.ID {
+					t.Errorf("messages moved to user %d", msg.newUserId)
+				}
+				channels = append(channels, msg.data.Channel)
+			case <-time.After(200 * time.Millisecond):
+				break collect
+			}
+		}
+		BroadcastPublisher.Unsubscribe(events)
+
+		slices.Sort(channels)
+		if !slices.Equal(channels, []string{"general", "random"}) {
+			t.Fatalf("got events for %v", channels)
+		}
+	}
+}
@@ -2,19 +2,15 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
-	"os"
 	"slices"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
-	"github.com/google/uuid"
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type LoginRequest struct {
@@ -31,6 +27,7 @@ type RegisterRequest struct { // This is the same for now, but maybe later more
 	Username      string
 	Password      string
 	ClientVersion string
+	InviteCode    string // Needed when registration is invite only
 }
 
 type ResetPassword struct {
@@ -39,13 +36,17 @@ type ResetPassword struct {
 }
 
 func reauth(c *fiber.Ctx) error {
-	// Verify Client is compatible
 	r := new(ReauthRequest)
 
 	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
+	// Verify Client is compatible, the renewed session is saved with this version
+	if !ClientVersionSupported(r.ClientVersion) {
+		return c.SendString("client version not supported!")
+	}
+
 	// Check to see if the current token is valid.
 	user := c.Locals("user").(*jwt.Token)
 	claims := user.Claims.(jwt.MapClaims)
@@ -70,6 +71,18 @@ func reauth(c *fiber.Ctx) error {
 		return c.SendString("account does not exist!")
 	}
 
+	// Don't let revoked tokens get swapped for new ones
+	if err := CheckTokenIsCurrent(user); err != nil {
+		return c.SendString("token revoked!")
+	}
+
+	// Newer clients use refresh tokens, reauth is only for the old long lived tokens
+	session := Sessions{}
+	db.First(&session, "session_id = ?", TokenSessionId(user))
+	if !allow_legacy_tokens || (session.ID != 0 && !ClientUsesLegacyTokens(session.ClientVersion)) {
+		return c.SendString("use refresh tokens!")
+	}
+
 	ranks, err := GetEffectivePermissions(account.Ranks)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -79,24 +92,18 @@ func reauth(c *fiber.Ctx) error {
 		return c.SendString("account login is restricted!")
 	}
 
-	// Create the Claims (info encoded inside the token)
-	newClaims := jwt.MapClaims{
-		"id":  account.ID,
-		"exp": time.Now().Add(time.Hour * 72).Unix(),
+	session, err = RenewSession(c, user, account.ID, r.ClientVersion)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-	// Create new token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, newClaims)
-
 	// Generate encoded token and send it as response.
-	t, err := token.SignedString(privateKey)
+	t, err := CreateAccountToken(account, session, legacy_token_lifetime)
 	if err != nil {
 		log.Printf("token.SignedString: %v", err)
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// update last login
-	account.LastLogin = uint64(time.Now().Unix())
-	db.Save(&account)
+	RecordLogin(&account)
 	return c.JSON(fiber.Map{"token": t, "avatar": account.Avatar, "ranks": ranks, "motd": motd})
 }
 
@@ -108,51 +115,97 @@ func login(c *fiber.Ctx) error {
 	}
 
 	// Check if the client is supported
-	if !slices.Contains(permitted_protocol_versions, r.ClientVersion) {
+	if !ClientVersionSupported(r.ClientVersion) {
 		return c.SendString("client version not supported!")
 	}
 
-	// Get account from db
-	account := Accounts{}
-	result := db.First(&account, "username = ?", r.Username)
-	if result.Error != nil {
-		return c.SendString("account does not exist!")
-	}
-	if result.RowsAffected == 0 {
-		return c.SendString("account does not exist!")
+	// Check the username & password
+	account, ranks, err := AuthenticateAccount(r.Username, r.Password, c.IP())
+	if errors.Is(err, ErrTwoFactorRequired) {
+		return start_two_factor_login(c, account, r.ClientVersion)
+	} else if errors.Is(err, ErrTooManyAttempts) {
+		return send_too_many_attempts(c, r.Username)
+	} else if errors.Is(err, ErrLoginRestricted) || errors.Is(err, ErrWrongCredentials) || errors.Is(err, ErrPendingApproval) {
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// Check if the account is allowed to sign in
-	ranks, err := GetEffectivePermissions(account.Ranks)
+	session, err := StartSession(c, account.ID, r.ClientVersion)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-	if !slices.Contains(ranks, "CanBeLoggedInto") {
-		return c.SendString("account login is restricted!")
-	}
-	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(r.Password)); err != nil {
-		return c.SendString("wrong password!")
+	// Generate encoded token(s) and send them as response.
+	response, err := IssueTokens(account, session, r.ClientVersion)
+	if err != nil {
+		log.Printf("token.SignedString: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
 	}
 
-	// Create the Claims (info encoded inside the token)
-	claims := jwt.MapClaims{
-		"id":  account.ID,
-		"exp": time.Now().Add(time.Hour * 72).Unix(),
+	RecordLogin(&account)
+	response["avatar"] = account.Avatar
+	response["ranks"] = ranks
+	response["motd"] = motd
+	return c.JSON(response)
+}
+
+// Only the last login is written, saving the whole account could put back a password hash or token
+// generation that changed while the login was being checked (like the rehash after it)
+func RecordLogin(account *Accounts) {
+	account.LastLogin = uint64(time.Now().Unix())
+	db.Model(account).UpdateColumn("last_login", account.LastLogin)
+}
+
+var (
+	ErrAccountDoesNotExist = errors.New("account does not exist")
+	ErrLoginRestricted     = errors.New("account login is restricted")
+)
+
+// Checks a username & password, and that the account is allowed to sign in.
+// This is shared by everything that logs in with a password (the API, IRC, etc.)
+// Wrong usernames & wrong passwords get the same error, and both count towards a lockout.
+func AuthenticateAccount(username string, password string, ip string) (Accounts, []string, error) {
+	if LockoutRemaining(username, ip) > 0 {
+		return Accounts{}, nil, ErrTooManyAttempts
 	}
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString(privateKey)
+	// Get account from db
+	account, err := FindAccountByUsername(username)
 	if err != nil {
-		log.Printf("token.SignedString: %v", err)
-		return c.SendStatus(fiber.StatusInternalServerError)
+		CheckDummyPassword(password)
+		RecordLoginFailure(username, ip)
+		return account, nil, ErrWrongCredentials
+	}
+	if err := CheckPassword(account.PasswordHash, password); err != nil {
+		RecordLoginFailure(username, ip)
+		return account, nil, ErrWrongCredentials
 	}
+	ClearLoginFailures(username)
+	go RehashPasswordIfNeeded(account, password)
 
-	// update last login
-	account.LastLogin = uint64(time.Now().Unix())
-	db.Save(&account)
-	return c.JSON(fiber.Map{"token": t, "avatar": account.Avatar, "ranks": ranks, "motd": motd})
+	// Check if the account is allowed to sign in, only once we know it's really them
+	ranks, err := CheckLoginAllowed(account)
+	return account, ranks, err
+}
+
+// What every login checks once it knows who the user is, whether that was a password or OIDC.
+// Returns ErrTwoFactorRequired if they still need a second step.
+func CheckLoginAllowed(account Accounts) ([]string, error) {
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(ranks, pending_rank) {
+		return nil, ErrPendingApproval
+	}
+	if !slices.Contains(ranks, "CanBeLoggedInto") {
+		return nil, ErrLoginRestricted
+	}
+	// They are who they say, but there's a second step
+	if TwoFactorEnabled(account.ID) || slices.Contains(ranks, "RequiresTwoFactor") {
+		return ranks, ErrTwoFactorRequired
+	}
+	return ranks, nil
 }
 
 func register(c *fiber.Ctx) error {
@@ -163,67 +216,77 @@ func register(c *fiber.Ctx) error {
 	}
 
 	// Check if client is supported
-	if !slices.Contains(permitted_protocol_versions, r.ClientVersion) {
+	if !ClientVersionSupported(r.ClientVersion) {
 		return c.SendString("client version not supported!")
 	}
 
-	// Check if username is already claimed.
-	var count int64 = 0
-	db.Model(&Accounts{}).Where("Username = ?", r.Username).Count(&count)
-	if count > 0 {
-		return c.SendString("username taken!")
+	// Check if they're allowed to register, and what rank they get
+	rank, invite, err := CheckRegistrationAllowed(r.InviteCode)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
 	}
 
-	// Generate Password
-	hash, err := bcrypt.GenerateFromPassword([]byte(r.Password), hash_default_cost)
+	// Check the username is allowed & not already claimed.
+	r.Username, err = CheckNewUsername(r.Username, 0)
 	if err != nil {
-		return c.SendString("password invalid!")
+		return c.SendString(err.Error() + "!")
 	}
 
-	// Generate the default avatar
-	fileName := uuid.NewString() + ".webp"
-	destination := fmt.Sprintf(upload_directory+"/profile-pictures/%s", fileName)
-	out, err := os.Create(destination)
+	// Check the password is good enough
+	if violations := CheckPasswordPolicy(r.Password, r.Username); len(violations) > 0 {
+		return send_password_violations(c, violations)
+	}
+
+	// Generate Password
+	hash, err := HashPassword(r.Password)
 	if err != nil {
-		panic(err) // This should NEVER fail unless we run out of disk space.
+		return c.SendString("password invalid!")
 	}
 
-	// We use an API to create this
-	// Example of a request we make to generate avatars: https://api.dicebear.com/9.x/initials/webp?chars=1&seed=Preloading
-	requestURL := fmt.Sprintf("https://api.dicebear.com/9.x/initials/webp?chars=1&seed=%s", url.QueryEscape(r.Username))
-	res, err := http.Get(requestURL)
+	// Generate the default avatar
+	avatar, err := GenerateDefaultAvatar(r.Username)
 	if err != nil {
 		fmt.Printf("error making http request to dicebear: %s\n", err)
 		// Since I do not have any fallback avatar, I essentially need to error it.
 		c.SendString("An internal error occured while generating your avatar! Try reregistering. If that does not work it, please email webmaster@loganserver.net")
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-	// Now that we have the image, we should store it
-	// Save the WebP image data to a file
-	defer out.Close()
-	io.Copy(out, res.Body)
 
+	ranksJSON, _ := json.Marshal([]string{rank})
 	account := Accounts{
 		Username:     r.Username,
-		PasswordHash: string(hash),
-		Avatar:       server_url + "/uploads/profile-pictures/" + fileName,
+		PasswordHash: hash,
+		Avatar:       avatar,
 		DateCreated:  uint64(time.Now().Unix()),
 		LastLogin:    uint64(time.Now().Unix()),
-		Ranks:        `["Member"]`,
+		Ranks:        string(ranksJSON),
 	}
 
-	db.Create(&account)
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if invite != nil {
+			if err := RedeemInvite(tx, *invite); err != nil {
+				return err
+			}
+		}
+		return tx.Create(&account).Error
+	})
+	if errors.Is(err, ErrInviteInvalid) {
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
 
-	// Create the Claims (info encoded inside the token)
-	claims := jwt.MapClaims{
-		"id":  account.ID,
-		"exp": time.Now().Add(time.Hour * 72).Unix(),
+	// They can't log in until a moderator approves them
+	if rank == pending_rank {
+		return c.JSON(fiber.Map{"step": "approval_required"})
 	}
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 
-	// Generate encoded token and send it as response.
-	t, err := token.SignedString(privateKey)
+	session, err := StartSession(c, account.ID, r.ClientVersion)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	// Generate encoded token(s) and send them as response.
+	response, err := IssueTokens(account, session, r.ClientVersion)
 	if err != nil {
 		log.Printf("token.SignedString: %v", err)
 		return c.SendStatus(fiber.StatusInternalServerError)
@@ -232,7 +295,10 @@ func register(c *fiber.Ctx) error {
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
-	return c.JSON(fiber.Map{"token": t, "avatar": account.Avatar, "ranks": ranks, "motd": motd})
+	response["avatar"] = account.Avatar
+	response["ranks"] = ranks
+	response["motd"] = motd
+	return c.JSON(response)
 }
 
 func change_password(c *fiber.Ctx) error {
@@ -261,7 +327,7 @@ func change_password(c *fiber.Ctx) error {
 	}
 
 	// Check if they can change their password
-	ranks, err := GetEffectivePermissions(account.Ranks)
+	ranks, err := GetTokenPermissions(user, account)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
@@ -277,21 +343,28 @@ func change_password(c *fiber.Ctx) error {
 	}
 
 	// Check if the old password matches the current password
-	if err := bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(r.OldPassword)); err != nil {
+	if err := CheckPassword(account.PasswordHash, r.OldPassword); err != nil {
 		return c.SendString("wrong password!")
 	}
 
+	if violations := CheckPasswordPolicy(r.NewPassword, account.Username); len(violations) > 0 {
+		return send_password_violations(c, violations)
+	}
+
 	// Generate New Password
-	hash, err := bcrypt.GenerateFromPassword([]byte(r.NewPassword), hash_default_cost)
+	hash, err := HashPassword(r.NewPassword)
 	if err != nil {
 		return c.SendString("password invalid!")
 	}
 
 	// Save the new password in the DB
-	account.PasswordHash = string(hash)
-	db.Save(&account)
+	account.PasswordHash = hash
+	db.Model(&account).UpdateColumn("password_hash", hash)
 
-	// TODO: Make it invalidate all past tokens
+	// Log out everywhere else, including this token
+	if err := RevokeAccountTokens(&account); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
 	return c.SendString("sucess!")
 }
 
@@ -302,7 +375,11 @@ func get_user_info(c *fiber.Ctx) error {
 	if userid != "" {
 		db.First(&user, "id = ?", userid)
 	} else if username != "" {
-		db.First(&user, "username = ?", username)
+		user, _ = FindAccountByUsername(username)
+		// They might have renamed, send them to whoever had the name
+		if previous, ok := FindPreviousUsername(username); user.ID == 0 && ok {
+			return c.Redirect(fmt.Sprintf("get_user_info?userid=%d", previous.AccountId), fiber.StatusFound)
+		}
 	} else {
 		return c.SendString("malformed input!")
 	}
@@ -319,6 +396,7 @@ func get_user_info(c *fiber.Ctx) error {
 		Avatar:         user.Avatar,
 		Ranks:          user.Ranks,
 		EffectiveRanks: effectiveRanks,
+		Bot:            slices.Contains(effectiveRanks, "UsesBotAuth"),
 		DateCreated:    user.DateCreated,
 		LastLogin:      user.LastLogin,
 	}
@@ -341,33 +419,3 @@ func check_if_token_expired(token *jwt.Token) bool {
 		return false
 	}
 }
-
-func register_default_admin_account() {
-
-	// Generate Password in BCrypt form
-	hash, err := bcrypt.GenerateFromPassword([]byte(admin_password), hash_default_cost)
-	if err != nil {
-		panic("Admin password is invalid!")
-	}
-
-	// Check if username is already claimed.
-	var count int64 = 0
-	result := db.Model(&Accounts{}).Where("username = ?", "Administrator")
-	if result.Count(&count); count > 0 {
-		result.Update("PasswordHash", string(hash))
-		result.Update("Ranks", `["Administrator"]`)
-	} else {
-		account := Accounts{
-			Username:     "Administrator",
-			PasswordHash: string(hash),
-			// Temp avatar till i get proper storage running
-			Avatar:      `data:image/svg+xml;utf8,%3Csvg xmlns%3D"http%3A%2F%2Fwww.w3.org%2F2000%2Fsvg" viewBox%3D"0 0 100 100"%3E%3Cmetadata xmlns%3Ardf%3D"http%3A%2F%2Fwww.w3.org%2F1999%2F02%2F22-rdf-syntax-ns%23" xmlns%3Axsi%3D"http%3A%2F%2Fwww.w3.org%2F2001%2FXMLSchema-instance" xmlns%3Adc%3D"http%3A%2F%2Fpurl.org%2Fdc%2Felements%2F1.1%2F" xmlns%3Adcterms%3D"http%3A%2F%2Fpurl.org%2Fdc%2Fterms%2F"%3E%3Crdf%3ARDF%3E%3Crdf%3ADescription%3E%3Cdc%3Atitle%3EInitials%3C%2Fdc%3Atitle%3E%3Cdc%3Acreator%3EDiceBear%3C%2Fdc%3Acreator%3E%3Cdc%3Asource xsi%3Atype%3D"dcterms%3AURI"%3Ehttps%3A%2F%2Fgithub.com%2Fdicebear%2Fdicebear%3C%2Fdc%3Asource%3E%3Cdcterms%3Alicense xsi%3Atype%3D"dcterms%3AURI"%3Ehttps%3A%2F%2Fcreativecommons.org%2Fpublicdomain%2Fzero%2F1.0%2F%3C%2Fdcterms%3Alicense%3E%3Cdc%3Arights%3E%E2%80%9EInitials%E2%80%9D (https%3A%2F%2Fgithub.com%2Fdicebear%2Fdicebear) by %E2%80%9EDiceBear%E2%80%9D%2C licensed under %E2%80%9ECC0 1.0%E2%80%9D (https%3A%2F%2Fcreativecommons.org%2Fpublicdomain%2Fzero%2F1.0%2F)%3C%2Fdc%3Arights%3E%3C%2Frdf%3ADescription%3E%3C%2Frdf%3ARDF%3E%3C%2Fmetadata%3E%3Cmask id%3D"b0esx9i5"%3E%3Crect width%3D"100" height%3D"100" rx%3D"0" ry%3D"0" x%3D"0" y%3D"0" fill%3D"%23fff" %2F%3E%3C%2Fmask%3E%3Cg mask%3D"url(%23b0esx9i5)"%3E%3Crect fill%3D"%2300acc1" width%3D"100" height%3D"100" x%3D"0" y%3D"0" %2F%3E%3Ctext x%3D"50%25" y%3D"50%25" font-family%3D"Arial%2C sans-serif" font-size%3D"50" font-weight%3D"400" fill%3D"%23ffffff" text-anchor%3D"middle" dy%3D"17.800"%3EP%3C%2Ftext%3E%3C%2Fg%3E%3C%2Fsvg%3E`,
-			DateCreated: uint64(time.Now().Unix()),
-			LastLogin:   uint64(time.Now().Unix()),
-			Ranks:       `["Administrator"]`,
-		}
-
-		db.Create(&account)
-	}
-
-}
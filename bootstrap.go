@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The first time the server starts there's nobody to administer it, so it prints a one time setup
+// token to the log. Whoever has it can make the owner account with /bootstrap. After that, nothing
+// on start touches accounts.
+//
+// If the admin's login is lost, "scratchcord-server recover-admin <username>" gives the account a new
+// password from the command line.
+
+const (
+	owner_rank = "Owner"
+
+	// What the Dockerfile used to set SCRATCHCORD_ADMIN_PASSWORD to
+	old_default_admin_password = "scratchcord"
+)
+
+var ErrBootstrapTokenInvalid = errors.New("setup token invalid")
+
+var (
+	bootstrapMutex sync.Mutex
+	bootstrapToken string // Empty once there's an owner
+)
+
+type BootstrapRequest struct {
+	Token    string
+	Username string
+	Password string
+}
+
+// Accounts with the Owner or Administrator rank
+func admin_accounts() []Accounts {
+	accounts := []Accounts{}
+	db.Where("ranks LIKE ? OR ranks LIKE ?", rank_list_like(owner_rank), rank_list_like("Administrator")).Find(&accounts)
+	return accounts
+}
+
+// Whether someone's already running the server. Servers from before bootstrapping only have an Administrator.
+func OwnerExists() bool {
+	return len(admin_accounts()) > 0
+}
+
+// Servers from before bootstrapping reset the Administrator's password from SCRATCHCORD_ADMIN_PASSWORD
+// on every start, which was "scratchcord" unless changed. Nothing resets it now, so it'd stay that forever.
+func warn_old_admin_passwords() {
+	passwords := []string{old_default_admin_password}
+	if admin_password != "" && admin_password != old_default_admin_password {
+		passwords = append(passwords, admin_password)
+	}
+	for _, account := range admin_accounts() {
+		if account.PasswordHash == "" {
+			continue
+		}
+		for _, password := range passwords {
+			if CheckPassword(account.PasswordHash, password) == nil {
+				log.Printf("==================================================================")
+				log.Printf("WARNING: %s still has the password from SCRATCHCORD_ADMIN_PASSWORD!", account.Username)
+				log.Printf("Change it, or run \"scratchcord-server recover-admin %s\" for a random one.", account.Username)
+				log.Printf("==================================================================")
+				break
+			}
+		}
+	}
+}
+
+func start_bootstrap() {
+	if admin_password != "" {
+		log.Printf("SCRATCHCORD_ADMIN_PASSWORD isn't used anymore, use \"recover-admin\" to reset an admin's password")
+	}
+	if OwnerExists() {
+		warn_old_admin_passwords()
+		return
+	}
+
+	token, err := RandomURLString(24)
+	if err != nil {
+		log.Fatalf("failed to make setup token: %v", err)
+	}
+	bootstrapMutex.Lock()
+	bootstrapToken = token
+	bootstrapMutex.Unlock()
+
+	log.Printf("==================================================================")
+	log.Printf("There's no owner account yet. To make one, POST to /bootstrap with")
+	log.Printf(`{"Token": "%s", "Username": "...", "Password": "..."}`, token)
+	log.Printf("This token only works once, and a new one is made on every start until there's an owner.")
+	log.Printf("==================================================================")
+}
+
+func bootstrap(c *fiber.Ctx) error {
+	r := new(BootstrapRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// Held the whole time, so two requests can't both make an owner
+	bootstrapMutex.Lock()
+	defer bootstrapMutex.Unlock()
+	if bootstrapToken == "" || subtle.ConstantTimeCompare([]byte(r.Token), []byte(bootstrapToken)) != 1 {
+		return c.Status(fiber.StatusUnauthorized).SendString(ErrBootstrapTokenInvalid.Error() + "!")
+	}
+
+	username, err := CheckNewUsername(r.Username, 0)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	if violations := CheckPasswordPolicy(r.Password, username); len(violations) > 0 {
+		return send_password_violations(c, violations)
+	}
+	hash, err := HashPassword(r.Password)
+	if err != nil {
+		return c.SendString("password invalid!")
+	}
+	avatar, err := GenerateDefaultAvatar(username)
+	if err != nil {
+		log.Printf("failed to make the owner's avatar, they can upload one later: %v", err)
+	}
+
+	ranksJSON, _ := json.Marshal([]string{owner_rank})
+	account := Accounts{
+		Username:     username,
+		PasswordHash: hash,
+		Avatar:       avatar,
+		DateCreated:  uint64(time.Now().Unix()),
+		Ranks:        string(ranksJSON),
+	}
+	if err := db.Create(&account).Error; err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	bootstrapToken = ""
+	log.Printf("owner account %s made, the setup token doesn't work anymore", username)
+	return c.SendString("sucess!")
+}
+
+// Runs a command given on the command line instead of the server, returning whether there was one
+func run_command(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	switch args[0] {
+	case "recover-admin":
+		recover_admin_command(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, the only command is recover-admin\n", args[0])
+		os.Exit(2)
+	}
+	return true
+}
+
+func recover_admin_command(args []string) {
+	flags := flag.NewFlagSet("recover-admin", flag.ExitOnError)
+	makeOwner := flags.Bool("owner", false, "also give the account the Owner rank")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: scratchcord-server recover-admin [-owner] <username>")
+		fmt.Fprintln(os.Stderr, "Gives the account a new random password, turns off two factor, clears lockouts and logs it out everywhere.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	account, err := FindAccountByUsername(flags.Arg(0))
+	if err != nil {
+		log.Fatalf("%s: %v", flags.Arg(0), err)
+	}
+	password, err := RandomURLString(18)
+	if err != nil {
+		log.Fatalf("failed to make a password: %v", err)
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		log.Fatalf("failed to hash the password: %v", err)
+	}
+	account.PasswordHash = hash
+	if err := db.Model(&account).UpdateColumn("password_hash", hash).Error; err != nil {
+		log.Fatalf("failed to save the password: %v", err)
+	}
+	if err := RevokeAccountTokens(&account); err != nil {
+		log.Fatalf("failed to log the account out: %v", err)
+	}
+	db.Unscoped().Where("account_id = ?", account.ID).Delete(&TwoFactorSecrets{})
+	ClearLoginFailures(account.Username)
+
+	if *makeOwner {
+		var ranks []string
+		json.Unmarshal([]byte(account.Ranks), &ranks)
+		if !slices.Contains(ranks, owner_rank) {
+			if err := AddRankToUser(int64(account.ID), owner_rank); err != nil {
+				log.Fatalf("failed to give the Owner rank: %v", err)
+			}
+		}
+	}
+
+	fmt.Printf("%s's new password is: %s\n", account.Username, password)
+	fmt.Println("Log in and change it right away.")
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Bots can't log in with a password (UsesBotAuth takes away CanBeLoggedInto), instead admins give them API tokens.
+// Each token only gets the permissions & channels it was made with, on top of what the bot's ranks allow.
+// Send them as "Authorization: Bot <token>", or as the token for the websocket.
+
+const (
+	bot_token_prefix          = "scb_"
+	bot_token_last_used_delay = 60 // Seconds between last used updates
+)
+
+var ErrBotTokenInvalid = errors.New("invalid bot token")
+
+type BotTokens struct {
+	gorm.Model
+	AccountId   uint `gorm:"index"`
+	Name        string
+	TokenHash   string `gorm:"uniqueIndex"`
+	Permissions string `gorm:"type:text"` // Stored as JSON array
+	Channels    string `gorm:"type:text"` // Stored as JSON array, empty means every channel
+	DateCreated uint64
+	LastUsed    uint64
+}
+
+type CreateBotRequest struct {
+	Username string
+}
+
+type CreateBotTokenRequest struct {
+	BotId       uint
+	Name        string
+	Permissions []string
+	Channels    []string
+}
+
+type RevokeBotTokenRequest struct {
+	TokenId uint
+}
+
+type BotTokenInfoResponse struct {
+	ID          uint
+	BotId       uint
+	Name        string
+	Permissions []string
+	Channels    []string
+	DateCreated uint64
+	LastUsed    uint64
+}
+
+func (t *BotTokens) GetPermissions() ([]string, error) {
+	var permissions []string
+	err := json.Unmarshal([]byte(t.Permissions), &permissions)
+	return permissions, err
+}
+
+func (t *BotTokens) GetChannels() ([]string, error) {
+	var channels []string
+	err := json.Unmarshal([]byte(t.Channels), &channels)
+	return channels, err
+}
+
+func (t *BotTokens) CanUseChannel(channel string) bool {
+	channels, err := t.GetChannels()
+	if err != nil {
+		return false
+	}
+	return len(channels) == 0 || slices.Contains(channels, channel)
+}
+
+// The bot's permissions, limited to what the token allows
+func (t *BotTokens) ScopePermissions(ranks []string) []string {
+	allowed, err := t.GetPermissions()
+	if err != nil {
+		return []string{}
+	}
+	scoped := []string{}
+	for _, rank := range ranks {
+		if slices.Contains(allowed, rank) {
+			scoped = append(scoped, rank)
+		}
+	}
+	return scoped
+}
+
+func IsBotToken(token string) bool {
+	return strings.HasPrefix(token, bot_token_prefix)
+}
+
+func AuthenticateBotToken(token string) (BotTokens, Accounts, error) {
+	botToken := BotTokens{}
+	if err := db.First(&botToken, "token_hash = ?", HashOpaqueToken(token)).Error; err != nil {
+		return botToken, Accounts{}, ErrBotTokenInvalid
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", botToken.AccountId).Error; err != nil {
+		return botToken, account, ErrAccountDoesNotExist
+	}
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return botToken, account, err
+	}
+	// Banning a bot takes away UsesBotAuth, which stops its tokens working
+	if !slices.Contains(ranks, "UsesBotAuth") {
+		return botToken, account, ErrLoginRestricted
+	}
+
+	now := uint64(time.Now().Unix())
+	if now-botToken.LastUsed >= bot_token_last_used_delay {
+		botToken.LastUsed = now
+		db.Model(&botToken).Update("last_used", now)
+	}
+	return botToken, account, nil
+}
+
+// Wraps a bot token up like a JWT, so handlers can use c.Locals("user") like normal
+func BotTokenAsJWT(botToken BotTokens, account Accounts) *jwt.Token {
+	return &jwt.Token{
+		Valid: true,
+		Claims: jwt.MapClaims{
+			"id":  float64(account.ID),
+			"bot": float64(botToken.ID),
+			"exp": float64(time.Now().Add(time.Hour).Unix()),
+		},
+	}
+}
+
+// Gets the bot token a request was made with, ok is false for normal tokens
+func GetBotToken(token *jwt.Token) (BotTokens, bool, error) {
+	claims := token.Claims.(jwt.MapClaims)
+	botTokenId, ok := claims["bot"].(float64)
+	if !ok {
+		return BotTokens{}, false, nil
+	}
+	botToken := BotTokens{}
+	if err := db.First(&botToken, "id = ?", botTokenId).Error; err != nil {
+		return botToken, true, ErrBotTokenInvalid
+	}
+	return botToken, true, nil
+}
+
+// What a token is allowed to do. For normal tokens this is the account's permissions, bot tokens are scoped.
+func GetTokenPermissions(token *jwt.Token, account Accounts) ([]string, error) {
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return nil, err
+	}
+	botToken, isBot, err := GetBotToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if !isBot {
+		return ranks, nil
+	}
+	return botToken.ScopePermissions(ranks), nil
+}
+
+// The account a request is for, for things only the person themselves can do (like managing
+// sessions & exports). Bot tokens are scoped to permissions, which don't cover these, so they can't.
+func user_account_id(c *fiber.Ctx) (uint, error) {
+	user := c.Locals("user").(*jwt.Token)
+	if _, isBot, _ := GetBotToken(user); isBot {
+		return 0, ErrLoginRestricted
+	}
+	claims := user.Claims.(jwt.MapClaims)
+	return uint(claims["id"].(float64)), nil
+}
+
+func TokenCanUseChannel(token *jwt.Token, channel string) bool {
+	botToken, isBot, err := GetBotToken(token)
+	if err != nil {
+		return false
+	}
+	return !isBot || botToken.CanUseChannel(channel)
+}
+
+// Runs before the JWT middleware, which skips requests this already authenticated
+func bot_auth_middleware(c *fiber.Ctx) error {
+	auth := c.Get(fiber.HeaderAuthorization)
+	if !strings.HasPrefix(auth, "Bot ") {
+		return c.Next()
+	}
+	botToken, account, err := AuthenticateBotToken(strings.TrimPrefix(auth, "Bot "))
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).SendString(err.Error() + "!")
+	}
+	c.Locals("user", BotTokenAsJWT(botToken, account))
+	return c.Next()
+}
+
+func CreateBotAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageBots"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(CreateBotRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	username, err := CheckNewUsername(r.Username, 0)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+
+	avatar, err := GenerateDefaultAvatar(username)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	account := Accounts{
+		Username:    username,
+		Avatar:      avatar,
+		DateCreated: uint64(time.Now().Unix()),
+		Ranks:       `["Bot"]`,
+	}
+	if err := db.Create(&account).Error; err != nil {
+		return c.SendString("failed to create bot" + err.Error())
+	}
+	return c.JSON(fiber.Map{"id": account.ID})
+}
+
+func CreateBotTokenAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageBots"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(CreateBotTokenRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if len(r.Permissions) == 0 {
+		return c.SendString("no permissions chosen!")
+	}
+
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", r.BotId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !slices.Contains(ranks, "UsesBotAuth") {
+		return c.SendString("account is not a bot!")
+	}
+	// Tokens can't do more than the bot itself
+	for _, permission := range r.Permissions {
+		if !slices.Contains(ranks, permission) {
+			return c.SendString(fmt.Sprintf("bot does not have %s!", permission))
+		}
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	token := bot_token_prefix + base64.RawURLEncoding.EncodeToString(raw)
+
+	if r.Channels == nil {
+		r.Channels = []string{}
+	}
+	permissionsJSON, _ := json.Marshal(r.Permissions)
+	channelsJSON, _ := json.Marshal(r.Channels)
+	botToken := BotTokens{
+		AccountId:   account.ID,
+		Name:        r.Name,
+		TokenHash:   HashOpaqueToken(token),
+		Permissions: string(permissionsJSON),
+		Channels:    string(channelsJSON),
+		DateCreated: uint64(time.Now().Unix()),
+	}
+	if err := db.Create(&botToken).Error; err != nil {
+		return c.SendString("failed to create token" + err.Error())
+	}
+
+	// This is the only time the token is shown
+	return c.JSON(fiber.Map{"id": botToken.ID, "token": token})
+}
+
+func RevokeBotTokenAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageBots"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(RevokeBotTokenRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	botToken := BotTokens{}
+	if err := db.First(&botToken, "id = ?", r.TokenId).Error; err != nil {
+		return c.SendString("token doesn't exist!")
+	}
+	db.Delete(&botToken)
+	LiveConnections.CloseSession(botToken.AccountId, BotConnectionId(botToken.ID))
+	return c.SendString("sucess!")
+}
+
+func ListBotTokensAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageBots"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	botTokens := []BotTokens{}
+	if userId := c.QueryInt("userid", 0); userId != 0 {
+		db.Find(&botTokens, "account_id = ?", userId)
+	} else {
+		db.Find(&botTokens)
+	}
+
+	response := make([]BotTokenInfoResponse, 0, len(botTokens))
+	for _, botToken := range botTokens {
+		permissions, _ := botToken.GetPermissions()
+		channels, _ := botToken.GetChannels()
+		response = append(response, BotTokenInfoResponse{
+			ID:          botToken.ID,
+			BotId:       botToken.AccountId,
+			Name:        botToken.Name,
+			Permissions: permissions,
+			Channels:    channels,
+			DateCreated: botToken.DateCreated,
+			LastUsed:    botToken.LastUsed,
+		})
+	}
+	return c.JSON(response)
+}
+
+// Bot websockets are tracked like sessions, so revoking a token closes them
+func BotConnectionId(botTokenId uint) string {
+	return fmt.Sprintf("bot:%d", botTokenId)
+}
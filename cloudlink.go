@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gofiber/contrib/websocket"
+	"github.com/google/uuid"
+)
+
+// A CloudLink 4 packet, not every field is used by every command
+type CloudlinkPacket struct {
+	Cmd      string          `json:"cmd"`
+	Val      json.RawMessage `json:"val,omitempty"`
+	Name     string          `json:"name,omitempty"`
+	Id       json.RawMessage `json:"id,omitempty"`
+	Rooms    json.RawMessage `json:"rooms,omitempty"`
+	Listener json.RawMessage `json:"listener,omitempty"`
+}
+
+type CloudlinkUserObject struct {
+	Id       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// The custom commands old clients send through "direct"
+type CloudlinkDirectCommand struct {
+	Cmd string `json:"cmd"`
+	Val string `json:"val"`
+}
+
+// One CloudLink connection
+type CloudlinkClient struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+
+	sessionId string
+
+	// Only the client's own goroutine changes these, but other clients look them up, so changes hold mutex
+	username      string
+	authenticated bool
+	account       Accounts
+	ranks         []string
+
+	mutex sync.Mutex
+	rooms map[string]bool
+}
+
+// CloudLink status codes, as the original server sent them
+const (
+	cloudlink_ok            = "I:100 | OK"
+	cloudlink_syntax        = "E:101 | Syntax"
+	cloudlink_datatype      = "E:102 | Datatype"
+	cloudlink_id_not_found  = "E:103 | ID not found"
+	cloudlink_internal      = "E:105 | Internal server error"
+	cloudlink_id_set        = "E:107 | ID already set"
+	cloudlink_refused       = "E:108 | Refused"
+	cloudlink_invalid       = "E:109 | Invalid command"
+	cloudlink_id_required   = "E:111 | ID required"
+	cloudlink_default_room  = "default"
+	cloudlink_version       = "0.1.9.2"
+	cloudlink_general_room  = "general" // CloudLink's "default" room is our general channel
+	cloudlink_max_ulist_len = 500
+)
+
+var (
+	// Other CloudLink clients, for pmsg/pvar (these never go through the database)
+	cloudlinkClients      = make(map[*CloudlinkClient]bool)
+	cloudlinkClientsMutex sync.Mutex
+)
+
+// CloudLink rooms map onto channels
+func CloudlinkRoomToChannel(room string) string {
+	if room == cloudlink_default_room {
+		return cloudlink_general_room
+	}
+	return room
+}
+
+func ChannelToCloudlinkRoom(channel string) string {
+	if channel == cloudlink_general_room {
+		return cloudlink_default_room
+	}
+	return channel
+}
+
+// Rooms can be a single string or a list of them
+func ParseCloudlinkRooms(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	var room string
+	if err := json.Unmarshal(raw, &room); err == nil {
+		return []string{room}, nil
+	}
+	var rooms []string
+	if err := json.Unmarshal(raw, &rooms); err != nil {
+		return nil, err
+	}
+	return rooms, nil
+}
+
+func cloudlink_websocket_handler(c *websocket.Conn) {
+	client := &CloudlinkClient{
+		conn:      c,
+		sessionId: uuid.NewString(),
+		rooms:     make(map[string]bool),
+	}
+	defer c.Close()
+
+	cloudlinkClientsMutex.Lock()
+	cloudlinkClients[client] = true
+	cloudlinkClientsMutex.Unlock()
+
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		cloudlinkClientsMutex.Lock()
+		delete(cloudlinkClients, client)
+		cloudlinkClientsMutex.Unlock()
+
+		client.mutex.Lock()
+		if client.authenticated {
+			for room := range client.rooms {
+				ChannelPresence.Leave(room, client.account.ID)
+			}
+		}
+		client.mutex.Unlock()
+	}()
+
+	for {
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			break
+		}
+		packet := CloudlinkPacket{}
+		if err := json.Unmarshal(msg, &packet); err != nil {
+			client.Status(cloudlink_syntax, nil)
+			continue
+		}
+
+		wasAuthenticated := client.authenticated
+		client.HandlePacket(packet)
+		if !wasAuthenticated && client.authenticated {
+			// Subscribe before reading anything else, so the client sees its own first message
+			eventChannel := BroadcastPublisher.Subscribe()
+			go client.ForwardMessages(eventChannel, stop)
+			// Password changes log CloudLink clients out too
+			removeConnection := LiveConnections.Add(client.account.ID, "", func() { disconnect_websocket(c, "token revoked") })
+			defer removeConnection()
+		}
+	}
+}
+
+func (cl *CloudlinkClient) Send(packet interface{}) error {
+	data, err := json.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	cl.writeMutex.Lock()
+	defer cl.writeMutex.Unlock()
+	return cl.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// Sends a packet, tagging it with the listener the client asked for (if any)
+func (cl *CloudlinkClient) Reply(packet map[string]interface{}, listener json.RawMessage) error {
+	if len(listener) != 0 {
+		packet["listener"] = listener
+	}
+	return cl.Send(packet)
+}
+
+func (cl *CloudlinkClient) Status(code string, listener json.RawMessage) {
+	cl.Reply(map[string]interface{}{"cmd": "statuscode", "code": code}, listener)
+}
+
+func (cl *CloudlinkClient) UserObject() CloudlinkUserObject {
+	return CloudlinkUserObject{
+		Id:       cl.sessionId,
+		Username: cl.username,
+	}
+}
+
+func (cl *CloudlinkClient) HandlePacket(packet CloudlinkPacket) {
+	switch packet.Cmd {
+	case "handshake":
+		cl.Send(map[string]interface{}{"cmd": "client_ip", "val": cl.conn.RemoteAddr().String()})
+		cl.Send(map[string]interface{}{"cmd": "server_version", "val": cloudlink_version})
+		if motd != "" {
+			cl.Send(map[string]interface{}{"cmd": "motd", "val": motd})
+		}
+		cl.Send(map[string]interface{}{"cmd": "client_obj", "val": cl.UserObject()})
+		cl.Status(cloudlink_ok, packet.Listener)
+		return
+	case "echo":
+		cl.Reply(map[string]interface{}{"cmd": "echo", "val": packet.Val}, packet.Listener)
+		return
+	case "setid":
+		if cl.username != "" {
+			cl.Status(cloudlink_id_set, packet.Listener)
+			return
+		}
+		var username string
+		if err := json.Unmarshal(packet.Val, &username); err != nil || username == "" {
+			cl.Status(cloudlink_datatype, packet.Listener)
+			return
+		}
+		cl.mutex.Lock()
+		cl.username = username
+		cl.mutex.Unlock()
+		cl.Send(map[string]interface{}{"cmd": "client_obj", "val": cl.UserObject()})
+		cl.Status(cloudlink_ok, packet.Listener)
+		return
+	case "direct":
+		cl.HandleDirect(packet)
+		return
+	}
+
+	// Everything else needs a logged in account
+	if cl.username == "" {
+		cl.Status(cloudlink_id_required, packet.Listener)
+		return
+	}
+	if !cl.authenticated {
+		cl.Status(cloudlink_refused, packet.Listener)
+		return
+	}
+
+	switch packet.Cmd {
+	case "link":
+		rooms, err := ParseCloudlinkRooms(packet.Val)
+		if err != nil || len(rooms) == 0 {
+			cl.Status(cloudlink_datatype, packet.Listener)
+			return
+		}
+		cl.Unlink()
+		for _, room := range rooms {
+			cl.Link(CloudlinkRoomToChannel(room))
+		}
+		cl.Status(cloudlink_ok, packet.Listener)
+	case "unlink":
+		cl.Unlink()
+		cl.Link(cloudlink_general_room)
+		cl.Status(cloudlink_ok, packet.Listener)
+	case "ulist":
+		cl.SendUserLists()
+	case "gmsg":
+		if !slices.Contains(cl.ranks, "CanSendMessage") {
+			cl.Status(cloudlink_refused, packet.Listener)
+			return
+		}
+		var message string
+		if err := json.Unmarshal(packet.Val, &message); err != nil {
+			// Old clients sometimes send objects, which we store as is
+			message = string(packet.Val)
+		}
+		channels, err := cl.TargetChannels(packet.Rooms)
+		if err != nil {
+			cl.Status(cloudlink_datatype, packet.Listener)
+			return
+		}
+		for _, channel := range channels {
+			db_msg := Messages{
+				Message:   message,
+				UserId:    cl.account.ID,
+				Type:      1,
+				Channel:   channel,
+				Timestamp: uint64(time.Now().Unix()),
+			}
+			db.Create(&db_msg)
+		}
+		cl.Status(cloudlink_ok, packet.Listener)
+	case "gvar":
+		// Variables aren't stored, they just go to the other CloudLink clients in the room
+		if !slices.Contains(cl.ranks, "CanSendMessage") {
+			cl.Status(cloudlink_refused, packet.Listener)
+			return
+		}
+		channels, err := cl.TargetChannels(packet.Rooms)
+		if err != nil {
+			cl.Status(cloudlink_datatype, packet.Listener)
+			return
+		}
+		for _, other := range CloudlinkClientsInChannels(channels) {
+			other.Send(map[string]interface{}{"cmd": "gvar", "name": packet.Name, "val": packet.Val, "origin": cl.UserObject()})
+		}
+		cl.Status(cloudlink_ok, packet.Listener)
+	case "pmsg", "pvar":
+		if !slices.Contains(cl.ranks, "CanSendMessage") {
+			cl.Status(cloudlink_refused, packet.Listener)
+			return
+		}
+		targets := cl.FindCloudlinkClients(packet.Id)
+		if len(targets) == 0 {
+			cl.Status(cloudlink_id_not_found, packet.Listener)
+			return
+		}
+		for _, target := range targets {
+			response := map[string]interface{}{"cmd": packet.Cmd, "val": packet.Val, "origin": cl.UserObject()}
+			if packet.Cmd == "pvar" {
+				response["name"] = packet.Name
+			}
+			target.Send(response)
+		}
+		cl.Status(cloudlink_ok, packet.Listener)
+	default:
+		cl.Status(cloudlink_invalid, packet.Listener)
+	}
+}
+
+// CloudLink has no passwords, so logging in goes through "direct" like old servers did it:
+// {"cmd": "direct", "val": {"cmd": "login", "val": "password"}}
+func (cl *CloudlinkClient) HandleDirect(packet CloudlinkPacket) {
+	direct := CloudlinkDirectCommand{}
+	if err := json.Unmarshal(packet.Val, &direct); err != nil {
+		cl.Status(cloudlink_datatype, packet.Listener)
+		return
+	}
+
+	switch direct.Cmd {
+	case "login":
+		if cl.username == "" {
+			cl.Status(cloudlink_id_required, packet.Listener)
+			return
+		}
+		if cl.authenticated {
+			cl.Status(cloudlink_id_set, packet.Listener)
+			return
+		}
+		account, ranks, err := AuthenticateAccount(cl.username, direct.Val, cl.conn.IP())
+		if errors.Is(err, ErrLoginRestricted) || errors.Is(err, ErrWrongCredentials) || errors.Is(err, ErrTooManyAttempts) || errors.Is(err, ErrPendingApproval) || errors.Is(err, ErrTwoFactorRequired) {
+			cl.Reply(map[string]interface{}{"cmd": "direct", "val": map[string]string{"cmd": "login", "val": err.Error() + "!"}}, packet.Listener)
+			cl.Status(cloudlink_refused, packet.Listener)
+			return
+		} else if err != nil {
+			cl.Status(cloudlink_internal, packet.Listener)
+			return
+		}
+		cl.mutex.Lock()
+		cl.account = account
+		cl.ranks = ranks
+		cl.authenticated = true
+		cl.mutex.Unlock()
+
+		RecordLogin(&account)
+
+		// CloudLink clients start in the default room
+		cl.Link(cloudlink_general_room)
+		cl.Reply(map[string]interface{}{"cmd": "direct", "val": map[string]string{"cmd": "login", "val": "sucess!"}}, packet.Listener)
+		cl.Status(cloudlink_ok, packet.Listener)
+	default:
+		cl.Status(cloudlink_invalid, packet.Listener)
+	}
+}
+
+func (cl *CloudlinkClient) Link(channel string) {
+	cl.mutex.Lock()
+	alreadyLinked := cl.rooms[channel]
+	cl.rooms[channel] = true
+	cl.mutex.Unlock()
+	if !alreadyLinked {
+		ChannelPresence.Join(channel, cl.account.ID)
+	}
+}
+
+func (cl *CloudlinkClient) Unlink() {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	for channel := range cl.rooms {
+		ChannelPresence.Leave(channel, cl.account.ID)
+	}
+	cl.rooms = make(map[string]bool)
+}
+
+func (cl *CloudlinkClient) LinkedChannels() []string {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	channels := make([]string, 0, len(cl.rooms))
+	for channel := range cl.rooms {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Gets the channels a packet is for, which have to be ones the client is linked to
+func (cl *CloudlinkClient) TargetChannels(rawRooms json.RawMessage) ([]string, error) {
+	rooms, err := ParseCloudlinkRooms(rawRooms)
+	if err != nil {
+		return nil, err
+	}
+	if len(rooms) == 0 {
+		return cl.LinkedChannels(), nil
+	}
+
+	channels := []string{}
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	for _, room := range rooms {
+		channel := CloudlinkRoomToChannel(room)
+		if cl.rooms[channel] {
+			channels = append(channels, channel)
+		}
+	}
+	return channels, nil
+}
+
+// Finds clients by username or session id, ids can be a string or an object
+func (cl *CloudlinkClient) FindCloudlinkClients(rawId json.RawMessage) []*CloudlinkClient {
+	var id string
+	if err := json.Unmarshal(rawId, &id); err != nil {
+		object := CloudlinkUserObject{}
+		if err := json.Unmarshal(rawId, &object); err != nil {
+			return nil
+		}
+		id = object.Id
+		if id == "" {
+			id = object.Username
+		}
+	}
+
+	cloudlinkClientsMutex.Lock()
+	defer cloudlinkClientsMutex.Unlock()
+	found := []*CloudlinkClient{}
+	for other := range cloudlinkClients {
+		other.mutex.Lock()
+		if other.authenticated && (other.sessionId == id || other.username == id) {
+			found = append(found, other)
+		}
+		other.mutex.Unlock()
+	}
+	return found
+}
+
+func CloudlinkClientsInChannels(channels []string) []*CloudlinkClient {
+	cloudlinkClientsMutex.Lock()
+	defer cloudlinkClientsMutex.Unlock()
+	found := []*CloudlinkClient{}
+	for other := range cloudlinkClients {
+		other.mutex.Lock()
+		for _, channel := range channels {
+			if other.rooms[channel] {
+				found = append(found, other)
+				break
+			}
+		}
+		other.mutex.Unlock()
+	}
+	return found
+}
+
+// Sends who's in each linked room, this includes people on the normal client & other gateways
+func (cl *CloudlinkClient) SendUserLists() {
+	for _, channel := range cl.LinkedChannels() {
+		userIds := ChannelPresence.Users(channel)
+		if len(userIds) > cloudlink_max_ulist_len {
+			userIds = userIds[:cloudlink_max_ulist_len]
+		}
+		accounts := []Accounts{}
+		if len(userIds) > 0 {
+			db.Find(&accounts, "id IN ?", userIds)
+		}
+		users := make([]CloudlinkUserObject, 0, len(accounts))
+		for _, account := range accounts {
+			users = append(users, CloudlinkUserObject{Id: account.Username, Username: account.Username})
+		}
+		cl.Send(map[string]interface{}{"cmd": "ulist", "mode": "set", "val": users, "rooms": ChannelToCloudlinkRoom(channel)})
+	}
+}
+
+func (cl *CloudlinkClient) ForwardMessages(eventChannel <-chan BroadcastDBMessage, stop <-chan struct{}) {
+	defer BroadcastPublisher.Unsubscribe(eventChannel)
+	usernames := make(map[uint]string)
+
+	for {
+		var recv_msg BroadcastDBMessage
+		select {
+		case <-stop:
+			return
+		case recv_msg = <-eventChannel:
+		}
+		if recv_msg.event != "new_message" {
+			continue
+		}
+
+		// Handle kicking
+		if recv_msg.data.Type == 105 || (recv_msg.data.Type == 104 && recv_msg.data.UserId == cl.account.ID) {
+			cl.Send(map[string]interface{}{"cmd": "direct", "val": map[string]string{"cmd": "kicked", "val": recv_msg.data.Message}})
+			disconnect_websocket(cl.conn, "kicked")
+			return
+		}
+
+		isGlobal := recv_msg.data.Type == 100 || recv_msg.data.Type == 101
+		cl.mutex.Lock()
+		linked := cl.rooms[recv_msg.data.Channel]
+		cl.mutex.Unlock()
+		if !linked && !isGlobal {
+			continue
+		}
+
+		var permission string
+		switch recv_msg.data.Type {
+		case 1, 7:
+			permission = "CanReadMessages"
+		case 5:
+			permission = "CanReadTTS"
+		case 100, 101, 102, 103:
+			permission = "CanReadSpecialMessages"
+		default:
+			continue
+		}
+		if !slices.Contains(cl.ranks, permission) {
+			continue
+		}
+
+		origin := CloudlinkUserObject{}
+		if recv_msg.data.Type == 7 {
+			origin.Username = recv_msg.data.BridgedUsername
+		} else {
+			username, ok := usernames[recv_msg.data.UserId]
+			if !ok {
+				user := Accounts{}
+				db.First(&user, "id = ?", recv_msg.data.UserId)
+				username = user.Username
+				usernames[recv_msg.data.UserId] = username
+			}
+			origin.Username = username
+		}
+		origin.Id = origin.Username
+
+		packet := map[string]interface{}{
+			"cmd":    "gmsg",
+			"val":    recv_msg.data.Message,
+			"origin": origin,
+		}
+		if !isGlobal {
+			packet["rooms"] = ChannelToCloudlinkRoom(recv_msg.data.Channel)
+		}
+		if err := cl.Send(packet); err != nil {
+			log.Println("cloudlink write error:", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Lookalike usernames (Cyrillic "а" for "a", "1" for "l", zero width spaces...) are caught with
+// "skeletons", from Unicode TR39 (https://www.unicode.org/reports/tr39/#Confusable_Detection).
+// Two names with the same skeleton look the same, so only one of them can be used.
+//
+// Names of accounts with a rank at least SCRATCHCORD_PROTECTED_RANK_STRENGTH strong are protected
+// even more, nobody else can have a name with theirs anywhere in it ("real_admin", "admin.official").
+
+var (
+	confusables_path        string = os.Getenv("SCRATCHCORD_CONFUSABLES_PATH") // Unicode's confusables.txt, instead of the built in subset
+	protected_rank_strength string = os.Getenv("SCRATCHCORD_PROTECTED_RANK_STRENGTH")
+)
+
+const default_protected_rank_strength = 5002 // Administrator & Owner
+
+var (
+	ErrUsernameConfusable = errors.New("username looks too much like someone else's")
+	ErrUsernameProtected  = errors.New("username looks too much like a staff member's")
+)
+
+//go:embed config/confusables.txt
+var confusablesTxt string
+
+var confusables = make(map[rune]string)
+
+func init() {
+	load_confusables(confusablesTxt)
+}
+
+// Parses confusables.txt, lines look like "0430 ;	0061 ;	MA	# ( а → a ) ..."
+func load_confusables(txt string) int {
+	loaded := 0
+	for _, line := range strings.Split(txt, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Split(line, ";")
+		if len(fields) < 2 {
+			continue
+		}
+		source, err := parse_code_points(fields[0])
+		if err != nil || utf8.RuneCountInString(source) != 1 {
+			continue
+		}
+		target, err := parse_code_points(fields[1])
+		if err != nil {
+			continue
+		}
+		confusables[[]rune(source)[0]] = target
+		loaded++
+	}
+	return loaded
+}
+
+func parse_code_points(field string) (string, error) {
+	var builder strings.Builder
+	for _, hex := range strings.Fields(field) {
+		codePoint, err := strconv.ParseUint(hex, 16, 32)
+		if err != nil {
+			return "", err
+		}
+		builder.WriteRune(rune(codePoint))
+	}
+	return builder.String(), nil
+}
+
+func setup_confusables() {
+	if confusables_path == "" {
+		return
+	}
+	txt, err := os.ReadFile(confusables_path)
+	if err != nil {
+		log.Printf("failed to read SCRATCHCORD_CONFUSABLES_PATH, only the built in confusables will be used: %v", err)
+		return
+	}
+	log.Printf("loaded %d confusables from %s", load_confusables(string(txt)), confusables_path)
+}
+
+func ProtectedRankStrength() uint {
+	if protected_rank_strength == "" {
+		return default_protected_rank_strength
+	}
+	strength, err := strconv.ParseUint(protected_rank_strength, 10, 32)
+	if err != nil {
+		log.Printf("SCRATCHCORD_PROTECTED_RANK_STRENGTH is invalid, using %d", default_protected_rank_strength)
+		return default_protected_rank_strength
+	}
+	return uint(strength)
+}
+
+// Invisible characters that don't change how a name looks, TR39 drops these before comparing
+func IsDefaultIgnorable(r rune) bool {
+	return unicode.Is(unicode.Other_Default_Ignorable_Code_Point, r) ||
+		unicode.Is(unicode.Variation_Selector, r) ||
+		unicode.Is(unicode.Cf, r)
+}
+
+// What a username looks like, so names that look the same have the same skeleton. This is TR39's
+// skeleton done twice with case folding in between, so lookalikes that fold into other lookalikes
+// get caught. It's folded first too, otherwise Unicode's "I" → "l" would make "ADMIN" and "admin"
+// look different.
+func UsernameSkeleton(username string) string {
+	skeleton := cases.Fold().String(norm.NFKC.String(NormalizeUsername(username)))
+	for range 2 {
+		skeleton = cases.Fold().String(confusable_skeleton(skeleton))
+	}
+	return skeleton
+}
+
+func confusable_skeleton(text string) string {
+	var builder strings.Builder
+	for _, r := range norm.NFD.String(text) {
+		if IsDefaultIgnorable(r) {
+			continue
+		}
+		if prototype, ok := confusables[r]; ok {
+			builder.WriteString(prototype)
+		} else {
+			builder.WriteRune(r)
+		}
+	}
+	return norm.NFD.String(builder.String())
+}
+
+// Skeleton with separators taken out, for finding protected names inside others
+func protected_skeleton(username string) string {
+	return strings.NewReplacer("_", "", "-", "", ".", "").Replace(UsernameSkeleton(username))
+}
+
+// Whether someone other than accountId has a name that looks like this one, or had it recently
+func IsUsernameConfusable(username string, accountId uint) bool {
+	skeleton := UsernameSkeleton(username)
+	var count int64 = 0
+	db.Model(&Accounts{}).Where("username_skeleton = ? AND id != ?", skeleton, accountId).Count(&count)
+	if count > 0 {
+		return true
+	}
+	db.Model(&PreviousUsernames{}).Where("username_skeleton = ? AND account_id != ? AND date_changed > ?", skeleton, accountId, username_held_since()).Count(&count)
+	return count > 0
+}
+
+// Ranks that make an account's name protected, either by being strong enough or having a parent that is
+func ProtectedRankNames() []string {
+	ranks := []Ranks{}
+	db.Find(&ranks)
+	protected := make(map[string]bool)
+	for _, rank := range ranks {
+		if rank.RankStrength >= ProtectedRankStrength() {
+			protected[rank.RankName] = true
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, rank := range ranks {
+			if protected[rank.RankName] {
+				continue
+			}
+			parentRanks, _ := rank.GetParentRanks()
+			for _, parentRank := range parentRanks {
+				if protected[parentRank] {
+					protected[rank.RankName] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	names := make([]string, 0, len(protected))
+	for name := range protected {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Whether the name has a protected account's name in it, other than accountId's own
+func IsUsernameProtected(username string, accountId uint) bool {
+	names := ProtectedRankNames()
+	if len(names) == 0 {
+		return false
+	}
+	query := db.Model(&Accounts{}).Where("id != ?", accountId)
+	conditions := db.Where("ranks LIKE ?", rank_list_like(names[0]))
+	for _, name := range names[1:] {
+		conditions = conditions.Or("ranks LIKE ?", rank_list_like(name))
+	}
+	var protectedUsernames []string
+	query.Where(conditions).Pluck("username", &protectedUsernames)
+
+	skeleton := protected_skeleton(username)
+	for _, protectedUsername := range protectedUsernames {
+		if protectedSkeleton := protected_skeleton(protectedUsername); protectedSkeleton != "" && strings.Contains(skeleton, protectedSkeleton) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestUsernameSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b string
+		same bool
+	}{
+		{"admin", "аdmin", true}, // Cyrillic а
+		{"admin", "ADMIN", true},
+		{"paul", "pau1", true},
+		{"Ian", "lan", false},
+		{"bill", "blll", false},
+		{"mike", "rnike", false},
+	}
+	for _, test := range tests {
+		if same := UsernameSkeleton(test.a) == UsernameSkeleton(test.b); same != test.same {
+			t.Errorf("%s and %s: expected same skeleton to be %v", test.a, test.b, test.same)
+		}
+	}
+}
+
+// Unicode's full list maps "I" to "l", which shouldn't make uppercase names look different
+func TestUsernameSkeletonWithFullConfusables(t *testing.T) {
+	load_confusables("0049 ;\t006C ;\tMA\t# ( I → l ) LATIN CAPITAL LETTER I → LATIN SMALL LETTER L")
+	defer delete(confusables, 'I')
+
+	if UsernameSkeleton("ADMIN") != UsernameSkeleton("admin") {
+		t.Fatal("ADMIN and admin have different skeletons")
+	}
+	if !strings.Contains(protected_skeleton("ADMIN_real"), protected_skeleton("admin")) {
+		t.Fatal("ADMIN_real doesn't contain admin")
+	}
+}
@@ -1,34 +1,47 @@
 package main
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 )
 
-// Thanks https://stackoverflow.com/a/44688503
-func ExportRsaPrivateKeyAsPemStr(privkey *rsa.PrivateKey) string {
-	privkey_bytes := x509.MarshalPKCS1PrivateKey(privkey)
+// PKCS8 works for every key type we sign with (RSA, ECDSA & Ed25519)
+func ExportPrivateKeyAsPemStr(privkey crypto.Signer, headers map[string]string) (string, error) {
+	privkey_bytes, err := x509.MarshalPKCS8PrivateKey(privkey)
+	if err != nil {
+		return "", err
+	}
 	privkey_pem := pem.EncodeToMemory(
 		&pem.Block{
-			Type:  "RSA PRIVATE KEY",
-			Bytes: privkey_bytes,
+			Type:    "PRIVATE KEY",
+			Headers: headers,
+			Bytes:   privkey_bytes,
 		},
 	)
-	return string(privkey_pem)
+	return string(privkey_pem), nil
 }
 
-func ParseRsaPrivateKeyFromPemStr(privPEM string) (*rsa.PrivateKey, error) {
+func ParsePrivateKeyFromPemStr(privPEM string) (crypto.Signer, map[string]string, error) {
 	block, _ := pem.Decode([]byte(privPEM))
 	if block == nil {
-		return nil, errors.New("failed to parse PEM block containing the key")
+		return nil, nil, errors.New("failed to parse PEM block containing the key")
 	}
 
-	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, err
+	// Older keys are PKCS1 RSA keys
+	if block.Type == "RSA PRIVATE KEY" {
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		return priv, block.Headers, err
 	}
 
-	return priv, nil
+	priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := priv.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key type")
+	}
+	return signer, block.Headers, nil
 }
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Users can download everything the server keeps about them as a zip: their account, rank history,
+// sessions, every message they've sent & their avatar. Exports are built in the background one at
+// a time, can be asked for once a day, and get deleted after a week.
+
+var data_export_path string = os.Getenv("SCRATCHCORD_EXPORT_PATH")
+
+const (
+	data_export_cooldown   = 24 * time.Hour
+	data_export_lifetime   = 7 * 24 * time.Hour
+	data_export_queue_size = 100
+
+	data_export_pending = "pending"
+	data_export_ready   = "ready"
+	data_export_failed  = "failed"
+)
+
+var dataExportQueue = make(chan uint, data_export_queue_size)
+
+type DataExports struct {
+	gorm.Model
+	AccountId     uint `gorm:"index"`
+	Status        string
+	FileName      string
+	DateRequested uint64
+	DateReady     uint64
+}
+
+type DataExportStatusResponse struct {
+	Status        string
+	DateRequested uint64
+	DateReady     uint64
+	ExpiresAt     uint64
+}
+
+// What's in account.json, everything on the account but its password
+type ExportedAccount struct {
+	ID                 uint
+	Username           string
+	Avatar             string
+	DateCreated        uint64
+	LastLogin          uint64
+	Ranks              []string
+	Email              string
+	EmailVerified      bool
+	TwoFactorEnabled   bool
+	LastUsernameChange uint64
+	PreviousUsernames  []ExportedPreviousUsername
+	LinkedLogins       []ExportedLinkedLogin
+	DeleteAt           uint64
+}
+
+type ExportedPreviousUsername struct {
+	Username    string
+	DateChanged uint64
+}
+
+type ExportedLinkedLogin struct {
+	Issuer  string
+	Subject string
+}
+
+type ExportedRankChange struct {
+	Rank   string
+	Action string
+	Date   uint64
+}
+
+type ExportedSession struct {
+	ClientVersion string
+	IP            string
+	UserAgent     string
+	DateCreated   uint64
+	LastSeen      uint64
+}
+
+type ExportedMessage struct {
+	ID        uint
+	Channel   string
+	Message   string
+	Type      uint8
+	Timestamp uint64
+	Deleted   bool
+}
+
+func DataExportDirectory() string {
+	if data_export_path == "" {
+		return filepath.Join(os.TempDir(), "scratchcord-exports")
+	}
+	return data_export_path
+}
+
+func (e *DataExports) ExpiresAt() uint64 {
+	if e.DateReady == 0 {
+		return 0
+	}
+	return e.DateReady + uint64(data_export_lifetime.Seconds())
+}
+
+func (e *DataExports) FilePath() string {
+	return filepath.Join(DataExportDirectory(), e.FileName)
+}
+
+func start_data_exporter() {
+	if err := os.MkdirAll(DataExportDirectory(), 0700); err != nil {
+		log.Printf("failed to create data export directory: %v", err)
+	}
+
+	// Anything that was still being built when the server stopped
+	pending := []DataExports{}
+	db.Find(&pending, "status = ?", data_export_pending)
+	go func() {
+		for _, export := range pending {
+			dataExportQueue <- export.ID
+		}
+	}()
+
+	go func() {
+		for exportId := range dataExportQueue {
+			export := DataExports{}
+			if err := db.First(&export, "id = ?", exportId).Error; err != nil {
+				continue
+			}
+			if err := BuildDataExport(&export); err != nil {
+				log.Printf("failed to build data export %d: %v", export.ID, err)
+				export.Status = data_export_failed
+				os.Remove(export.FilePath())
+			} else {
+				export.Status = data_export_ready
+				export.DateReady = uint64(time.Now().Unix())
+			}
+			db.Save(&export)
+			delete_expired_data_exports()
+		}
+	}()
+}
+
+func delete_expired_data_exports() {
+	expired := []DataExports{}
+	db.Find(&expired, "status = ? AND date_ready < ?", data_export_ready, time.Now().Add(-data_export_lifetime).Unix())
+	for _, export := range expired {
+		os.Remove(export.FilePath())
+		db.Unscoped().Delete(&export)
+	}
+}
+
+// Deletes an account's exports, when there's a new one or the account gets deleted
+func delete_data_exports(accountId uint) {
+	exports := []DataExports{}
+	db.Find(&exports, "account_id = ?", accountId)
+	for _, export := range exports {
+		os.Remove(export.FilePath())
+		db.Unscoped().Delete(&export)
+	}
+}
+
+func write_export_json(archive *zip.Writer, name string, data interface{}) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(data)
+}
+
+func BuildDataExport(export *DataExports) error {
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", export.AccountId).Error; err != nil {
+		return ErrAccountDoesNotExist
+	}
+
+	// Written somewhere else first, so a half built zip is never downloaded
+	temp, err := os.CreateTemp(DataExportDirectory(), "building-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	archive := zip.NewWriter(temp)
+	if err := write_account_export(archive, account); err != nil {
+		return err
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), export.FilePath())
+}
+
+func write_account_export(archive *zip.Writer, account Accounts) error {
+	var ranks []string
+	json.Unmarshal([]byte(account.Ranks), &ranks)
+	exported := ExportedAccount{
+		ID:                 account.ID,
+		Username:           account.Username,
+		Avatar:             account.Avatar,
+		DateCreated:        account.DateCreated,
+		LastLogin:          account.LastLogin,
+		Ranks:              ranks,
+		Email:              account.Email,
+		EmailVerified:      account.EmailVerified,
+		TwoFactorEnabled:   TwoFactorEnabled(account.ID),
+		LastUsernameChange: account.LastUsernameChange,
+		PreviousUsernames:  []ExportedPreviousUsername{},
+		LinkedLogins:       []ExportedLinkedLogin{},
+		DeleteAt:           account.DeleteAt,
+	}
+	previousUsernames := []PreviousUsernames{}
+	db.Order("date_changed").Find(&previousUsernames, "account_id = ?", account.ID)
+	for _, previous := range previousUsernames {
+		exported.PreviousUsernames = append(exported.PreviousUsernames, ExportedPreviousUsername{previous.Username, previous.DateChanged})
+	}
+	identities := []OidcIdentities{}
+	db.Find(&identities, "account_id = ?", account.ID)
+	for _, identity := range identities {
+		exported.LinkedLogins = append(exported.LinkedLogins, ExportedLinkedLogin{identity.Issuer, identity.Subject})
+	}
+	if err := write_export_json(archive, "account.json", exported); err != nil {
+		return err
+	}
+
+	rankChanges := []RankChanges{}
+	db.Order("date").Find(&rankChanges, "account_id = ?", account.ID)
+	exportedRankChanges := make([]ExportedRankChange, 0, len(rankChanges))
+	for _, change := range rankChanges {
+		exportedRankChanges = append(exportedRankChanges, ExportedRankChange{change.Rank, change.Action, change.Date})
+	}
+	if err := write_export_json(archive, "rank_history.json", exportedRankChanges); err != nil {
+		return err
+	}
+
+	sessions := []Sessions{}
+	db.Order("date_created").Find(&sessions, "account_id = ?", account.ID)
+	exportedSessions := make([]ExportedSession, 0, len(sessions))
+	for _, session := range sessions {
+		exportedSessions = append(exportedSessions, ExportedSession{session.ClientVersion, session.IP, session.UserAgent, session.DateCreated, session.LastSeen})
+	}
+	if err := write_export_json(archive, "sessions.json", exportedSessions); err != nil {
+		return err
+	}
+
+	// Deleted messages too, since they're still kept
+	messages := []Messages{}
+	db.Unscoped().Order("id").Find(&messages, "user_id = ?", account.ID)
+	exportedMessages := make([]ExportedMessage, 0, len(messages))
+	for _, message := range messages {
+		exportedMessages = append(exportedMessages, ExportedMessage{
+			ID:        message.ID,
+			Channel:   message.Channel,
+			Message:   message.Message,
+			Type:      message.Type,
+			Timestamp: message.Timestamp,
+			Deleted:   message.DeletedAt.Valid,
+		})
+	}
+	if err := write_export_json(archive, "messages.json", exportedMessages); err != nil {
+		return err
+	}
+
+	return write_avatar_export(archive, account)
+}
+
+// Copies in the avatar, if it's one we have the file for
+func write_avatar_export(archive *zip.Writer, account Accounts) error {
+	prefix := server_url + "/uploads/profile-pictures/"
+	if !strings.HasPrefix(account.Avatar, prefix) {
+		return nil
+	}
+	fileName := filepath.Base(strings.TrimPrefix(account.Avatar, prefix))
+	avatar, err := os.Open(filepath.Join(upload_directory, "profile-pictures", fileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer avatar.Close()
+
+	file, err := archive.Create("avatars/" + fileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, avatar)
+	return err
+}
+
+func request_data_export(c *fiber.Ctx) error {
+	accountId, err := user_account_id(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+
+	latest := DataExports{}
+	if err := db.Order("date_requested desc").First(&latest, "account_id = ?", accountId).Error; err == nil {
+		if latest.Status == data_export_pending {
+			return c.SendString("data export already being built!")
+		}
+		retryAt := time.Unix(int64(latest.DateRequested), 0).Add(data_export_cooldown)
+		if latest.Status != data_export_failed && time.Now().Before(retryAt) {
+			c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(time.Until(retryAt).Seconds())))
+			return c.Status(fiber.StatusTooManyRequests).SendString("data export requested too recently!")
+		}
+	}
+
+	fileName, err := RandomURLString(16)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	// Only the newest export is kept
+	delete_data_exports(accountId)
+	export := DataExports{
+		AccountId:     accountId,
+		Status:        data_export_pending,
+		FileName:      fileName + ".zip",
+		DateRequested: uint64(time.Now().Unix()),
+	}
+	if err := db.Create(&export).Error; err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	select {
+	case dataExportQueue <- export.ID:
+	default:
+		db.Unscoped().Delete(&export)
+		return c.Status(fiber.StatusServiceUnavailable).SendString("too many data exports being built, try again later!")
+	}
+	return c.JSON(fiber.Map{"status": export.Status})
+}
+
+func data_export_status(c *fiber.Ctx) error {
+	accountId, err := user_account_id(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	export := DataExports{}
+	if err := db.Order("date_requested desc").First(&export, "account_id = ?", accountId).Error; err != nil {
+		return c.SendString("no data export requested!")
+	}
+	return c.JSON(DataExportStatusResponse{
+		Status:        export.Status,
+		DateRequested: export.DateRequested,
+		DateReady:     export.DateReady,
+		ExpiresAt:     export.ExpiresAt(),
+	})
+}
+
+func download_data_export(c *fiber.Ctx) error {
+	accountId, err := user_account_id(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	export := DataExports{}
+	err = db.Order("date_requested desc").First(&export, "account_id = ? AND status = ?", accountId, data_export_ready).Error
+	if err != nil || export.ExpiresAt() < uint64(time.Now().Unix()) {
+		return c.SendString("no data export ready!")
+	}
+	if _, err := os.Stat(export.FilePath()); err != nil {
+		return c.SendString("no data export ready!")
+	}
+	return c.Download(export.FilePath(), fmt.Sprintf("scratchcord-export-%d.zip", export.AccountId))
+}
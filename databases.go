@@ -16,6 +16,7 @@ type Messages struct {
 	// 4 - Game Start Request
 	// 5 - Message with TTS
 	// 6 - Game Join
+	// 7 - Bridged Message (from another chat service, like discord)
 
 	// 100 - Global Message (admin only)
 	// 101 - Global TTS Message (admin only)
@@ -27,14 +28,28 @@ type Messages struct {
 
 	UserId    uint
 	Timestamp uint64
+
+	// Only set on bridged messages, since those users don't have an account here
+	BridgedUsername string
+	BridgedAvatar   string
+	BridgedFrom     string // "discord", "matrix", etc.
 }
 
 type Accounts struct {
 	gorm.Model
-	Username     string `gorm:"uniqueIndex"`
-	PasswordHash string
-	Avatar       string
-	DateCreated  uint64
-	LastLogin    uint64
-	Ranks        string `gorm:"type:text"` // Stored as JSON array
+	Username         string `gorm:"uniqueIndex"`
+	UsernameKey      string // Username with case folded, unique. See usernames.go
+	UsernameSkeleton string `gorm:"index"` // What the username looks like, see confusables.go
+	PasswordHash     string
+	Avatar           string
+	DateCreated      uint64
+	LastLogin        uint64
+	Ranks            string `gorm:"type:text"` // Stored as JSON array
+	Email            string // Only used for anything once verified, see email.go
+	EmailVerified    bool
+
+	TokenGeneration    uint // Bumped to invalidate every token made before it
+	LastUsernameChange uint64
+	DeleteAt           uint64 // When the account gets deleted, 0 if it isn't. See account-deletion.go
+	DeleteMessages     bool   // Whether its messages go too, instead of moving to the deleted user
 }
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	fastws "github.com/fasthttp/websocket"
+)
+
+type DiscordBridgedMessages struct {
+	ID               uint   `gorm:"primaryKey"`
+	MessageId        uint   `gorm:"uniqueIndex"` // The scratchcord side
+	DiscordMessageId string `gorm:"index"`
+	DiscordChannelId string
+}
+
+type DiscordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Avatar     string `json:"avatar"`
+	Bot        bool   `json:"bot"`
+}
+
+type DiscordAttachment struct {
+	URL string `json:"url"`
+}
+
+type DiscordMessage struct {
+	ID          string              `json:"id"`
+	ChannelID   string              `json:"channel_id"`
+	Content     string              `json:"content"`
+	WebhookID   string              `json:"webhook_id"`
+	Author      *DiscordUser        `json:"author"`
+	Attachments []DiscordAttachment `json:"attachments"`
+	Member      *struct {
+		Nick string `json:"nick"`
+	} `json:"member"`
+}
+
+// Something that happened to a message on discord
+type DiscordEvent struct {
+	// Type... types
+	// "create"
+	// "update"
+	// "delete", only ID and ChannelID are set
+	Type    string
+	Message DiscordMessage
+}
+
+// Everything the bridge needs from discord. The real one talks to the discord gateway,
+// but anything that speaks the same thing (like a local fake gateway) works.
+type DiscordClient interface {
+	// Messages from other users, closed when the client is done
+	Events() <-chan DiscordEvent
+	SendMessage(channelId string, content string) (string, error)
+	EditMessage(channelId string, messageId string, content string) error
+	DeleteMessage(channelId string, messageId string) error
+}
+
+type DiscordBridge struct {
+	client DiscordClient
+	// Discord channel id -> scratchcord channel, and the other way around
+	toScratchcord map[string]string
+	toDiscord     map[string]string
+}
+
+const (
+	discord_max_message_length = 2000
+	discord_gateway_intents    = 1<<0 | 1<<9 | 1<<15 // GUILDS, GUILD_MESSAGES, MESSAGE_CONTENT
+	discord_cdn_url            = "https://cdn.discordapp.com"
+)
+
+var (
+	discord_bot_token       string = os.Getenv("SCRATCHCORD_DISCORD_BOT_TOKEN")
+	discord_bridge_channels string = os.Getenv("SCRATCHCORD_DISCORD_BRIDGE_CHANNELS") // Example: 123456789012345678=general,876543210987654321=random
+	discord_api_url         string = os.Getenv("SCRATCHCORD_DISCORD_API_URL")
+	discord_gateway_url     string = os.Getenv("SCRATCHCORD_DISCORD_GATEWAY_URL")
+)
+
+// No pinging @everyone, roles or users from scratchcord
+var discord_no_mentions = map[string][]string{"parse": {}}
+
+// Parses "discordid=channel,discordid=channel"
+func ParseDiscordBridgeChannels(mapping string) (map[string]string, error) {
+	channels := make(map[string]string)
+	for _, pair := range strings.Split(mapping, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		discordChannel, channel, found := strings.Cut(pair, "=")
+		if !found || discordChannel == "" || channel == "" {
+			return nil, fmt.Errorf("invalid discord bridge channel mapping: %q", pair)
+		}
+		channels[discordChannel] = channel
+	}
+	return channels, nil
+}
+
+func NewDiscordBridge(client DiscordClient, channels map[string]string) *DiscordBridge {
+	bridge := &DiscordBridge{
+		client:        client,
+		toScratchcord: channels,
+		toDiscord:     make(map[string]string),
+	}
+	for discordChannel, channel := range channels {
+		bridge.toDiscord[channel] = discordChannel
+	}
+	return bridge
+}
+
+func start_discord_bridge() {
+	if discord_bot_token == "" {
+		return
+	}
+	channels, err := ParseDiscordBridgeChannels(discord_bridge_channels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(channels) == 0 {
+		log.Println("SCRATCHCORD_DISCORD_BOT_TOKEN is set but no channels are bridged, not starting the discord bridge")
+		return
+	}
+	if discord_api_url == "" {
+		discord_api_url = "https://discord.com/api/v10"
+	}
+	if discord_gateway_url == "" {
+		discord_gateway_url = "wss://gateway.discord.gg/?v=10&encoding=json"
+	}
+
+	client := NewDiscordGatewayClient(discord_bot_token, discord_api_url, discord_gateway_url)
+	client.Start()
+	NewDiscordBridge(client, channels).Start()
+}
+
+func (b *DiscordBridge) Start() {
+	// Discord -> Scratchcord
+	go func() {
+		for event := range b.client.Events() {
+			b.HandleDiscordEvent(event)
+		}
+	}()
+
+	// Scratchcord -> Discord
+	go func() {
+		eventChannel := BroadcastPublisher.Subscribe()
+		for msg := range eventChannel {
+			b.HandleScratchcordEvent(msg)
+		}
+	}()
+}
+
+func DiscordDisplayName(message DiscordMessage) string {
+	if message.Member != nil && message.Member.Nick != "" {
+		return message.Member.Nick
+	}
+	if message.Author.GlobalName != "" {
+		return message.Author.GlobalName
+	}
+	return message.Author.Username
+}
+
+func DiscordAvatarURL(user DiscordUser) string {
+	if user.Avatar == "" {
+		return discord_cdn_url + "/embed/avatars/0.png"
+	}
+	return fmt.Sprintf("%s/avatars/%s/%s.png", discord_cdn_url, user.ID, user.Avatar)
+}
+
+// Discord messages can be just attachments, so those get tacked on as links
+func DiscordMessageContent(message DiscordMessage) string {
+	content := message.Content
+	for _, attachment := range message.Attachments {
+		if content != "" {
+			content += " "
+		}
+		content += attachment.URL
+	}
+	return content
+}
+
+func (b *DiscordBridge) HandleDiscordEvent(event DiscordEvent) {
+	channel, ok := b.toScratchcord[event.Message.ChannelID]
+	if !ok {
+		return
+	}
+
+	switch event.Type {
+	case "create":
+		// Webhook messages are skipped so our own webhook subscriptions don't echo back
+		if event.Message.Author == nil || event.Message.WebhookID != "" {
+			return
+		}
+		db_msg := Messages{
+			Message:         DiscordMessageContent(event.Message),
+			UserId:          0,
+			Type:            7,
+			Channel:         channel,
+			Timestamp:       uint64(time.Now().Unix()),
+			BridgedUsername: DiscordDisplayName(event.Message),
+			BridgedAvatar:   DiscordAvatarURL(*event.Message.Author),
+			BridgedFrom:     "discord",
+		}
+		if err := db.Create(&db_msg).Error; err != nil {
+			log.Println("failed to store bridged discord message:", err)
+			return
+		}
+		db.Create(&DiscordBridgedMessages{
+			MessageId:        db_msg.ID,
+			DiscordMessageId: event.Message.ID,
+			DiscordChannelId: event.Message.ChannelID,
+		})
+	case "update":
+		bridged := DiscordBridgedMessages{}
+		if err := db.First(&bridged, "discord_message_id = ?", event.Message.ID).Error; err != nil {
+			return
+		}
+		db_msg := Messages{}
+		if err := db.First(&db_msg, "id = ? AND type = ?", bridged.MessageId, 7).Error; err != nil {
+			return
+		}
+		db_msg.Message = DiscordMessageContent(event.Message)
+		db.Save(&db_msg)
+	case "delete":
+		bridged := DiscordBridgedMessages{}
+		if err := db.First(&bridged, "discord_message_id = ?", event.Message.ID).Error; err != nil {
+			return
+		}
+		// The link goes first, so we don't try to delete it from discord again
+		db.Delete(&bridged)
+		db_msg := Messages{}
+		if err := db.First(&db_msg, "id = ?", bridged.MessageId).Error; err == nil {
+			db.Delete(&db_msg)
+		}
+	}
+}
+
+func (b *DiscordBridge) HandleScratchcordEvent(msg BroadcastDBMessage) {
+	// Messages bridged from discord came from there in the first place, only deletes go back
+	if msg.data.Type == 7 && msg.data.BridgedFrom == "discord" && msg.event != "message_deleted" {
+		return
+	}
+	discordChannel, ok := b.toDiscord[msg.data.Channel]
+	if !ok {
+		return
+	}
+
+	switch msg.event {
+	case "new_message":
+		user := Accounts{}
+		db.First(&user, "id = ?", msg.data.UserId)
+		username, _, contents, ok := DescribeMessageForWebhook(msg, user)
+		if !ok {
+			return
+		}
+		discordMessageId, err := b.client.SendMessage(discordChannel, FormatDiscordBridgeMessage(username, contents))
+		if err != nil {
+			log.Println("failed to bridge message to discord:", err)
+			return
+		}
+		db.Create(&DiscordBridgedMessages{
+			MessageId:        msg.data.ID,
+			DiscordMessageId: discordMessageId,
+			DiscordChannelId: discordChannel,
+		})
+	case "message_updated":
+		bridged := DiscordBridgedMessages{}
+		if err := db.First(&bridged, "message_id = ?", msg.data.ID).Error; err != nil {
+			return
+		}
+		user := Accounts{}
+		db.First(&user, "id = ?", msg.data.UserId)
+		username, _, contents, ok := DescribeMessageForWebhook(msg, user)
+		if !ok {
+			return
+		}
+		if err := b.client.EditMessage(bridged.DiscordChannelId, bridged.DiscordMessageId, FormatDiscordBridgeMessage(username, contents)); err != nil {
+			log.Println("failed to edit bridged discord message:", err)
+		}
+	case "message_deleted":
+		bridged := DiscordBridgedMessages{}
+		if err := db.First(&bridged, "message_id = ?", msg.data.ID).Error; err != nil {
+			return
+		}
+		if err := b.client.DeleteMessage(bridged.DiscordChannelId, bridged.DiscordMessageId); err != nil {
+			log.Println("failed to delete bridged discord message:", err)
+		}
+		db.Delete(&bridged)
+	}
+}
+
+func FormatDiscordBridgeMessage(username string, contents string) string {
+	message := "**" + username + "**: " + contents
+	// Discord counts characters, and cutting bytes could split one in half
+	if utf8.RuneCountInString(message) > discord_max_message_length {
+		message = string([]rune(message)[:discord_max_message_length])
+	}
+	return message
+}
+
+// Talks to discord over the gateway (for recieving) and the REST API (for sending)
+type DiscordGatewayClient struct {
+	token      string
+	apiUrl     string
+	gatewayUrl string
+	httpClient *http.Client
+	events     chan DiscordEvent
+
+	mutex    sync.Mutex
+	selfId   string
+	sequence *int64
+}
+
+type discordGatewayPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d,omitempty"`
+	S  *int64          `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+func NewDiscordGatewayClient(token string, apiUrl string, gatewayUrl string) *DiscordGatewayClient {
+	return &DiscordGatewayClient{
+		token:      token,
+		apiUrl:     strings.TrimSuffix(apiUrl, "/"),
+		gatewayUrl: gatewayUrl,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		events:     make(chan DiscordEvent, 64),
+	}
+}
+
+func (d *DiscordGatewayClient) Events() <-chan DiscordEvent {
+	return d.events
+}
+
+func (d *DiscordGatewayClient) Start() {
+	go func() {
+		for {
+			err := d.connect()
+			log.Println("discord gateway disconnected:", err)
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func (d *DiscordGatewayClient) connect() error {
+	conn, _, err := fastws.DefaultDialer.Dial(d.gatewayUrl, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var writeMutex sync.Mutex
+	send := func(op int, data interface{}) error {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		return conn.WriteJSON(discordGatewayPayload{Op: op, D: raw})
+	}
+
+	// The first thing discord sends is how often it wants a heartbeat
+	hello := discordGatewayPayload{}
+	if err := conn.ReadJSON(&hello); err != nil {
+		return err
+	}
+	if hello.Op != 10 {
+		return fmt.Errorf("expected hello from discord gateway, got op %d", hello.Op)
+	}
+	helloData := struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}{}
+	if err := json.Unmarshal(hello.D, &helloData); err != nil {
+		return err
+	}
+
+	identify := map[string]interface{}{
+		"token":   d.token,
+		"intents": discord_gateway_intents,
+		"properties": map[string]string{
+			"os":      "linux",
+			"browser": "scratchcord",
+			"device":  "scratchcord",
+		},
+	}
+	if err := send(2, identify); err != nil {
+		return err
+	}
+
+	stopHeartbeat := make(chan struct{})
+	defer close(stopHeartbeat)
+	go func() {
+		ticker := time.NewTicker(time.Duration(helloData.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopHeartbeat:
+				return
+			case <-ticker.C:
+				d.mutex.Lock()
+				sequence := d.sequence
+				d.mutex.Unlock()
+				if err := send(1, sequence); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		payload := discordGatewayPayload{}
+		if err := conn.ReadJSON(&payload); err != nil {
+			return err
+		}
+
+		switch payload.Op {
+		case 0: // Dispatch
+			d.mutex.Lock()
+			if payload.S != nil {
+				d.sequence = payload.S
+			}
+			d.mutex.Unlock()
+			d.handleDispatch(payload.T, payload.D)
+		case 1: // Heartbeat request
+			d.mutex.Lock()
+			sequence := d.sequence
+			d.mutex.Unlock()
+			if err := send(1, sequence); err != nil {
+				return err
+			}
+		case 7: // Reconnect
+			return errors.New("discord asked us to reconnect")
+		case 9: // Invalid session
+			return errors.New("discord gateway session invalidated")
+		}
+	}
+}
+
+func (d *DiscordGatewayClient) handleDispatch(eventName string, data json.RawMessage) {
+	switch eventName {
+	case "READY":
+		ready := struct {
+			User DiscordUser `json:"user"`
+		}{}
+		if err := json.Unmarshal(data, &ready); err == nil {
+			d.mutex.Lock()
+			d.selfId = ready.User.ID
+			d.mutex.Unlock()
+		}
+	case "MESSAGE_CREATE", "MESSAGE_UPDATE", "MESSAGE_DELETE":
+		message := DiscordMessage{}
+		if err := json.Unmarshal(data, &message); err != nil {
+			log.Println("failed to decode discord message:", err)
+			return
+		}
+		// Don't bounce our own messages back
+		d.mutex.Lock()
+		selfId := d.selfId
+		d.mutex.Unlock()
+		if message.Author != nil && message.Author.ID == selfId {
+			return
+		}
+
+		event := DiscordEvent{Message: message}
+		switch eventName {
+		case "MESSAGE_CREATE":
+			event.Type = "create"
+		case "MESSAGE_UPDATE":
+			// Updates without an author are things like embeds loading
+			if message.Author == nil {
+				return
+			}
+			event.Type = "update"
+		case "MESSAGE_DELETE":
+			event.Type = "delete"
+		}
+		d.events <- event
+	}
+}
+
+func (d *DiscordGatewayClient) request(method string, path string, body interface{}) ([]byte, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Retry a couple times if we're rate limited
+	for attempt := 0; attempt < 3; attempt++ {
+		req, err := http.NewRequest(method, d.apiUrl+path, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bot "+d.token)
+		req.Header.Set("User-Agent", "DiscordBot (Scratchcord, 1.0)")
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		res, err := d.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resBody, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusTooManyRequests {
+			time.Sleep(ParseRetryAfter(res.Header.Get("Retry-After"), resBody))
+			continue
+		}
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return nil, fmt.Errorf("discord responded with %d: %s", res.StatusCode, string(resBody))
+		}
+		return resBody, nil
+	}
+	return nil, errors.New("discord rate limit retries exhausted")
+}
+
+func (d *DiscordGatewayClient) SendMessage(channelId string, content string) (string, error) {
+	body := map[string]interface{}{
+		"content":          content,
+		"allowed_mentions": discord_no_mentions,
+	}
+	res, err := d.request("POST", "/channels/"+url.PathEscape(channelId)+"/messages", body)
+	if err != nil {
+		return "", err
+	}
+	message := DiscordMessage{}
+	if err := json.Unmarshal(res, &message); err != nil {
+		return "", err
+	}
+	return message.ID, nil
+}
+
+func (d *DiscordGatewayClient) EditMessage(channelId string, messageId string, content string) error {
+	body := map[string]interface{}{
+		"content":          content,
+		"allowed_mentions": discord_no_mentions, // Edits can ping too
+	}
+	_, err := d.request("PATCH", "/channels/"+url.PathEscape(channelId)+"/messages/"+url.PathEscape(messageId), body)
+	return err
+}
+
+func (d *DiscordGatewayClient) DeleteMessage(channelId string, messageId string) error {
+	_, err := d.request("DELETE", "/channels/"+url.PathEscape(channelId)+"/messages/"+url.PathEscape(messageId), nil)
+	return err
+}
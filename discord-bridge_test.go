@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// Stands in for discord, remembering what the bridge sent
+type fakeDiscordClient struct {
+	events chan DiscordEvent
+	sent   []string
+	edited []string
+}
+
+func (f *fakeDiscordClient) Events() <-chan DiscordEvent {
+	return f.events
+}
+
+func (f *fakeDiscordClient) SendMessage(channelId string, content string) (string, error) {
+	f.sent = append(f.sent, content)
+	return "discord-message", nil
+}
+
+func (f *fakeDiscordClient) EditMessage(channelId string, messageId string, content string) error {
+	f.edited = append(f.edited, content)
+	return nil
+}
+
+func (f *fakeDiscordClient) DeleteMessage(channelId string, messageId string) error {
+	return nil
+}
+
+func TestDiscordBridgeSkipsItsOwnMessages(t *testing.T) {
+	setup_test_db(t, &Messages{}, &DiscordBridgedMessages{}, &Accounts{})
+	client := &fakeDiscordClient{events: make(chan DiscordEvent)}
+	bridge := NewDiscordBridge(client, map[string]string{"1234": "general"})
+
+	// Messages that came from discord don't go back to it
+	for _, event := range []string{"new_message", "message_updated"} {
+		bridge.HandleScratchcordEvent(BroadcastDBMessage{event: event, data: Messages{
+			Type:        7,
+			Channel:     "general",
+			BridgedFrom: "discord",
+		}})
+	}
+	if len(client.sent) != 0 || len(client.edited) != 0 {
+		t.Fatalf("bridged messages were echoed back to discord: %v %v", client.sent, client.edited)
+	}
+
+	// Webhook messages (like our own webhook subscriptions) don't come back from discord
+	bridge.HandleDiscordEvent(DiscordEvent{Type: "create", Message: DiscordMessage{
+		ID:        "1",
+		ChannelID: "1234",
+		Content:   "hi",
+		WebhookID: "5678",
+		Author:    &DiscordUser{ID: "5678", Username: "hook"},
+	}})
+	var count int64
+	db.Model(&Messages{}).Count(&count)
+	if count != 0 {
+		t.Fatal("webhook message was bridged from discord")
+	}
+
+	// The gateway drops messages from the bot itself
+	gateway := NewDiscordGatewayClient("token", "http://127.0.0.1", "")
+	gateway.handleDispatch("READY", json.RawMessage(`{"user": {"id": "42"}}`))
+	gateway.handleDispatch("MESSAGE_CREATE", json.RawMessage(`{"id": "2", "channel_id": "1234", "content": "hi", "author": {"id": "42"}}`))
+	gateway.handleDispatch("MESSAGE_CREATE", json.RawMessage(`{"id": "3", "channel_id": "1234", "content": "hi", "author": {"id": "7"}}`))
+	if event := <-gateway.Events(); event.Message.ID != "3" || len(gateway.Events()) != 0 {
+		t.Fatalf("gateway didn't skip its own message, got %s", event.Message.ID)
+	}
+}
+
+func TestDiscordBridgeSuppressesMentions(t *testing.T) {
+	bodies := []map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, _ := io.ReadAll(r.Body)
+		body := map[string]interface{}{}
+		json.Unmarshal(raw, &body)
+		bodies = append(bodies, body)
+		w.Write([]byte(`{"id": "1"}`))
+	}))
+	defer server.Close()
+
+	client := NewDiscordGatewayClient("token", server.URL, "")
+	if _, err := client.SendMessage("1234", "@everyone hi"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.EditMessage("1234", "1", "@everyone hi again"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(bodies))
+	}
+	for _, body := range bodies {
+		allowed, ok := body["allowed_mentions"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("no allowed_mentions in %v", body)
+		}
+		if parse, ok := allowed["parse"].([]interface{}); !ok || len(parse) != 0 {
+			t.Fatalf("mentions aren't suppressed: %v", allowed)
+		}
+	}
+}
+
+func TestFormatDiscordBridgeMessageTruncates(t *testing.T) {
+	message := FormatDiscordBridgeMessage("someone", strings.Repeat("é", discord_max_message_length))
+	if !utf8.ValidString(message) {
+		t.Fatal("truncating split a character")
+	}
+	if utf8.RuneCountInString(message) != discord_max_message_length {
+		t.Fatalf("expected %d characters, got %d", discord_max_message_length, utf8.RuneCountInString(message))
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Accounts can have an email, which has to be verified before it gets used. A verified email lets
+// people reset their password without an admin.
+//
+// Verification & reset tokens are single use, expire, and are only stored as a hash.
+
+const (
+	email_token_verify = "verify"
+	email_token_reset  = "reset"
+
+	email_verify_duration   = 24 * time.Hour
+	password_reset_duration = time.Hour
+	password_reset_cooldown = time.Minute // How often a reset email can be sent to the same account
+	email_max_length        = 254
+)
+
+var (
+	ErrEmailDisabled     = errors.New("email is not set up")
+	ErrEmailInvalid      = errors.New("email invalid")
+	ErrEmailTokenInvalid = errors.New("token invalid")
+)
+
+type EmailTokens struct {
+	gorm.Model
+	AccountId uint   `gorm:"index"`
+	Kind      string // "verify" or "reset"
+	TokenHash string `gorm:"uniqueIndex"`
+	Email     string // The address the token was sent to
+	ExpiresAt uint64
+}
+
+type SetEmailRequest struct {
+	Password string
+	Email    string // Empty to remove it
+}
+
+type RequestPasswordResetRequest struct {
+	Username string
+	Email    string
+}
+
+type ResetPasswordWithTokenRequest struct {
+	Token       string
+	NewPassword string
+}
+
+func NormalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email || len(email) > email_max_length {
+		return "", ErrEmailInvalid
+	}
+	return strings.ToLower(email), nil
+}
+
+// Makes a token & stores its hash, replacing any others of the same kind for the account
+func CreateEmailToken(accountId uint, kind string, email string, duration time.Duration) (string, error) {
+	token, err := RandomURLString(32)
+	if err != nil {
+		return "", err
+	}
+	db.Unscoped().Where("(account_id = ? AND kind = ?) OR expires_at < ?", accountId, kind, time.Now().Unix()).Delete(&EmailTokens{})
+	err = db.Create(&EmailTokens{
+		AccountId: accountId,
+		Kind:      kind,
+		TokenHash: HashOpaqueToken(token),
+		Email:     email,
+		ExpiresAt: uint64(time.Now().Add(duration).Unix()),
+	}).Error
+	return token, err
+}
+
+func FindEmailToken(token string, kind string) (EmailTokens, error) {
+	emailToken := EmailTokens{}
+	if token == "" {
+		return emailToken, ErrEmailTokenInvalid
+	}
+	if err := db.First(&emailToken, "token_hash = ? AND kind = ?", HashOpaqueToken(token), kind).Error; err != nil {
+		return emailToken, ErrEmailTokenInvalid
+	}
+	if emailToken.ExpiresAt < uint64(time.Now().Unix()) {
+		return emailToken, ErrEmailTokenInvalid
+	}
+	return emailToken, nil
+}
+
+// Uses up a token, so it can't be used again. Only one request gets it if two race.
+func RedeemEmailToken(tx *gorm.DB, emailToken EmailTokens) error {
+	result := tx.Unscoped().Delete(&EmailTokens{}, emailToken.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrEmailTokenInvalid
+	}
+	return nil
+}
+
+func SendVerificationEmail(account Accounts) error {
+	token, err := CreateEmailToken(account.ID, email_token_verify, account.Email, email_verify_duration)
+	if err != nil {
+		return err
+	}
+	SendEmailAsync(account.Email, "Verify your email", fmt.Sprintf(
+		"Hi %s,\n\nTo verify this email for your Scratchcord account, go to:\n\n%s\n\nThis expires in a day. If this wasn't you, you can ignore this email.\n",
+		account.Username, server_url+"/verify_email?token="+token,
+	))
+	return nil
+}
+
+// Sends a reset email if the account is allowed one, staying quiet either way
+func SendPasswordResetEmail(account Accounts) {
+	if !account.EmailVerified || account.Email == "" {
+		return
+	}
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil || !slices.Contains(ranks, "CanChangePassword") {
+		return
+	}
+	var recent int64 = 0
+	db.Model(&EmailTokens{}).Where("account_id = ? AND kind = ? AND created_at > ?", account.ID, email_token_reset, time.Now().Add(-password_reset_cooldown)).Count(&recent)
+	if recent > 0 {
+		return
+	}
+
+	token, err := CreateEmailToken(account.ID, email_token_reset, account.Email, password_reset_duration)
+	if err != nil {
+		return
+	}
+	SendEmailAsync(account.Email, "Reset your password", fmt.Sprintf(
+		"Hi %s,\n\nSomeone asked to reset the password for your Scratchcord account. To pick a new one, enter this code:\n\n%s\n\nThis expires in an hour. If this wasn't you, you can ignore this email.\n",
+		account.Username, token,
+	))
+}
+
+func get_email(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	return c.JSON(fiber.Map{"email": account.Email, "verified": account.EmailVerified})
+}
+
+func set_email(c *fiber.Ctx) error {
+	if !EmailEnabled() {
+		return c.SendString(ErrEmailDisabled.Error() + "!")
+	}
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	r := new(SetEmailRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if err := CheckPassword(account.PasswordHash, r.Password); err != nil {
+		return c.SendString("wrong password!")
+	}
+
+	email := ""
+	if r.Email != "" {
+		if email, err = NormalizeEmail(r.Email); err != nil {
+			return c.SendString(err.Error() + "!")
+		}
+	}
+	account.Email = email
+	account.EmailVerified = false
+	if err := db.Model(&account).UpdateColumns(map[string]interface{}{"email": email, "email_verified": false}).Error; err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	// Nothing sent to the old address works anymore
+	db.Unscoped().Where("account_id = ?", account.ID).Delete(&EmailTokens{})
+
+	if email != "" {
+		if err := SendVerificationEmail(account); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	return c.SendString("sucess!")
+}
+
+func verify_email(c *fiber.Ctx) error {
+	emailToken, err := FindEmailToken(c.Query("token"), email_token_verify)
+	if err == nil {
+		err = RedeemEmailToken(db, emailToken)
+	}
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	result := db.Model(&Accounts{}).
+		Where("id = ? AND email = ?", emailToken.AccountId, emailToken.Email).
+		Update("email_verified", true)
+	if result.RowsAffected == 0 {
+		return c.SendString(ErrEmailTokenInvalid.Error() + "!")
+	}
+	return c.SendString("sucess!")
+}
+
+// Always says it worked, so this can't be used to find out who has an email
+func request_password_reset(c *fiber.Ctx) error {
+	if !EmailEnabled() {
+		return c.SendString(ErrEmailDisabled.Error() + "!")
+	}
+	r := new(RequestPasswordResetRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	go func() {
+		accounts := []Accounts{}
+		if r.Username != "" {
+			if account, err := FindAccountByUsername(r.Username); err == nil {
+				accounts = append(accounts, account)
+			}
+		} else if email, err := NormalizeEmail(r.Email); err == nil {
+			db.Find(&accounts, "email = ? AND email_verified = ?", email, true)
+		}
+		for _, account := range accounts {
+			SendPasswordResetEmail(account)
+		}
+	}()
+	return c.SendString("sucess!")
+}
+
+func reset_password(c *fiber.Ctx) error {
+	r := new(ResetPasswordWithTokenRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	emailToken, err := FindEmailToken(r.Token, email_token_reset)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ? AND email = ?", emailToken.AccountId, emailToken.Email).Error; err != nil {
+		return c.SendString(ErrEmailTokenInvalid.Error() + "!")
+	}
+	if violations := CheckPasswordPolicy(r.NewPassword, account.Username); len(violations) > 0 {
+		return send_password_violations(c, violations)
+	}
+	hash, err := HashPassword(r.NewPassword)
+	if err != nil {
+		return c.SendString("password invalid!")
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := RedeemEmailToken(tx, emailToken); err != nil {
+			return err
+		}
+		return tx.Model(&account).Update("password_hash", hash).Error
+	})
+	if errors.Is(err, ErrEmailTokenInvalid) {
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// Whoever knew the old password is logged out, and the owner isn't locked out anymore
+	if err := RevokeAccountTokens(&account); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	ClearLoginFailures(account.Username)
+	return c.SendString("sucess!")
+}
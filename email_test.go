@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func setup_test_email(t *testing.T) (*fiber.App, *fakeMailer, Accounts) {
+	setup_test_ranks(t)
+	if err := db.AutoMigrate(&Accounts{}, &EmailTokens{}, &Sessions{}, &RefreshTokens{}, &LoginLockouts{}, &RankChanges{}); err != nil {
+		t.Fatal(err)
+	}
+	setup_test_hasher()
+	fake := &fakeMailer{sent: make(chan string, 1)}
+	mailer = fake
+	t.Cleanup(func() { mailer = nil })
+
+	hash, err := HashPassword("an old password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := Accounts{Username: "someone", PasswordHash: hash, Ranks: `["Member"]`, Email: "someone@example.com", EmailVerified: true}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Post("/request_password_reset", request_password_reset)
+	app.Post("/reset_password", reset_password)
+	return app, fake, account
+}
+
+func post_test_json(t *testing.T, app *fiber.App, path string, body interface{}) string {
+	raw, _ := json.Marshal(body)
+	res, err := app.Test(httptest.NewRequest("POST", path, strings.NewReader(string(raw))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, _ := io.ReadAll(res.Body)
+	return string(response)
+}
+
+func TestPasswordReset(t *testing.T) {
+	app, fake, account := setup_test_email(t)
+
+	if response := post_test_json(t, app, "/request_password_reset", RequestPasswordResetRequest{Username: "someone"}); response != "sucess!" {
+		t.Fatal(response)
+	}
+	var body string
+	select {
+	case body = <-fake.sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reset email was sent")
+	}
+	_, token, _ := strings.Cut(body, "enter this code:\n\n")
+	token, _, _ = strings.Cut(token, "\n")
+
+	// Only the hash is kept
+	stored := EmailTokens{}
+	db.First(&stored, "account_id = ?", account.ID)
+	if stored.TokenHash != HashOpaqueToken(token) || strings.Contains(stored.TokenHash, token) {
+		t.Fatal("the token itself was stored")
+	}
+
+	reset := ResetPasswordWithTokenRequest{Token: token, NewPassword: "a brand new password"}
+	if response := post_test_json(t, app, "/reset_password", reset); response != "sucess!" {
+		t.Fatal(response)
+	}
+	db.First(&account, account.ID)
+	if err := CheckPassword(account.PasswordHash, "a brand new password"); err != nil {
+		t.Fatal("password wasn't changed")
+	}
+
+	// Single use
+	reset.NewPassword = "another new password"
+	if response := post_test_json(t, app, "/reset_password", reset); response != "token invalid!" {
+		t.Fatalf("token was used twice: %s", response)
+	}
+}
+
+func TestPasswordResetExpired(t *testing.T) {
+	app, _, account := setup_test_email(t)
+
+	token, err := CreateEmailToken(account.ID, email_token_reset, account.Email, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := ResetPasswordWithTokenRequest{Token: token, NewPassword: "a brand new password"}
+	if response := post_test_json(t, app, "/reset_password", reset); response != "token invalid!" {
+		t.Fatalf("expired token was accepted: %s", response)
+	}
+}
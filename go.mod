@@ -1,6 +1,7 @@
 module scratchcord-server
 
-go 1.22.2
+go 1.23.0
+
 toolchain go1.24.1
 
 require (
@@ -9,6 +10,7 @@ require (
 	github.com/gtuk/discordwebhook v1.2.0
 	github.com/joho/godotenv v1.5.1
 	golang.org/x/crypto v0.36.0
+	golang.org/x/text v0.23.0
 	gorm.io/driver/sqlite v1.5.6
 	gorm.io/gorm v1.25.12
 )
@@ -17,14 +19,13 @@ require (
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
 	github.com/mattn/go-sqlite3 v1.14.23 // indirect
-	golang.org/x/text v0.23.0 // indirect
 )
 
 require (
 	github.com/MicahParks/keyfunc/v2 v2.1.0 // indirect
 	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/chai2010/webp v1.4.0
-	github.com/fasthttp/websocket v1.5.8 // indirect
+	github.com/fasthttp/websocket v1.5.8
 	github.com/gofiber/contrib/jwt v1.0.10 // direct
 	github.com/golang-jwt/jwt/v5 v5.2.2
 	github.com/google/uuid v1.6.0
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	irc_server_name      = "scratchcord"
+	irc_max_line_length  = 512
+	irc_read_timeout     = 5 * time.Minute
+	irc_ping_interval    = 2 * time.Minute
+	irc_register_timeout = 30 * time.Second
+)
+
+var (
+	irc_listen_address string = os.Getenv("SCRATCHCORD_IRC_ADDR") // Example: :6667
+)
+
+// One connected IRC client
+type IRCClient struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	// Set while registering
+	password     string
+	nick         string
+	userReceived bool
+	registered   bool
+
+	account Accounts
+	ranks   []string
+
+	mutex        sync.Mutex
+	channels     map[string]bool
+	sentMessages map[uint]bool // Messages this client sent, so they don't get echoed back
+	usernames    map[uint]string
+}
+
+func start_irc_gateway() {
+	if irc_listen_address == "" {
+		return
+	}
+	listener, err := net.Listen("tcp", irc_listen_address)
+	if err != nil {
+		log.Fatalf("failed to start IRC gateway: %v", err)
+	}
+	log.Printf("IRC gateway listening on %s", irc_listen_address)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				log.Println("IRC accept:", err)
+				continue
+			}
+			go HandleIRCConnection(conn)
+		}
+	}()
+}
+
+// Splits an IRC line into the command and it's parameters (RFC 1459 section 2.3.1)
+func ParseIRCLine(line string) (string, []string) {
+	line = strings.TrimRight(line, "\r\n")
+	// We don't care about the prefix clients send
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var trailing *string
+	if before, after, found := strings.Cut(line, " :"); found {
+		line = before
+		trailing = &after
+	}
+	params := strings.Fields(line)
+	if len(params) == 0 {
+		return "", nil
+	}
+	command := strings.ToUpper(params[0])
+	params = params[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+	return command, params
+}
+
+// Usernames can have characters that nicks can't
+func IRCNick(username string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', ',', '*', '?', '!', '@', '#', ':', '\r', '\n', '\x00':
+			return '_'
+		}
+		return r
+	}, username)
+}
+
+// The IP without the port, for login lockouts
+func IRCRemoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// IRC channels are prefixed with #, scratchcord ones aren't
+func IRCChannelToScratchcord(channel string) string {
+	return strings.TrimPrefix(channel, "#")
+}
+
+func HandleIRCConnection(conn net.Conn) {
+	client := &IRCClient{
+		conn:         conn,
+		nick:         "*",
+		channels:     make(map[string]bool),
+		sentMessages: make(map[uint]bool),
+		usernames:    make(map[uint]string),
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, irc_max_line_length)
+	conn.SetReadDeadline(time.Now().Add(irc_register_timeout))
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	forwarding := false
+	for {
+		rawLine, err := reader.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			// Overly long lines get dropped
+			for errors.Is(err, bufio.ErrBufferFull) {
+				_, err = reader.ReadSlice('\n')
+			}
+			if err != nil {
+				break
+			}
+			continue
+		}
+		if err != nil {
+			break
+		}
+		if client.registered {
+			conn.SetReadDeadline(time.Now().Add(irc_read_timeout))
+		}
+
+		command, params := ParseIRCLine(string(rawLine))
+		if command == "" {
+			continue
+		}
+		if !client.HandleCommand(command, params) {
+			break
+		}
+
+		// Once they're logged in, start sending them messages
+		if client.registered && !forwarding {
+			forwarding = true
+			conn.SetReadDeadline(time.Now().Add(irc_read_timeout))
+			go client.ForwardMessages(stop)
+			go client.KeepAlive(stop)
+			// Password changes log IRC clients out too
+			removeConnection := LiveConnections.Add(client.account.ID, "", func() { conn.Close() })
+			defer removeConnection()
+		}
+	}
+
+	client.mutex.Lock()
+	for channel := range client.channels {
+		ChannelPresence.Leave(channel, client.account.ID)
+	}
+	client.mutex.Unlock()
+}
+
+func (c *IRCClient) Send(line string) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	c.conn.Write([]byte(line + "\r\n"))
+}
+
+// Sends a numeric reply
+func (c *IRCClient) Reply(numeric string, params ...string) {
+	line := ":" + irc_server_name + " " + numeric + " " + c.nick
+	for i, param := range params {
+		if i == len(params)-1 {
+			line += " :" + param
+		} else {
+			line += " " + param
+		}
+	}
+	c.Send(line)
+}
+
+// Handles a single command, returns false when the connection should be closed
+func (c *IRCClient) HandleCommand(command string, params []string) bool {
+	switch command {
+	case "CAP":
+		// We don't support any capabilities, but some clients wait for this
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			c.Send(":" + irc_server_name + " CAP * LS :")
+		}
+		return true
+	case "PING":
+		token := irc_server_name
+		if len(params) > 0 {
+			token = params[0]
+		}
+		c.Send(":" + irc_server_name + " PONG " + irc_server_name + " :" + token)
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		c.Send("ERROR :Closing Link: " + c.nick + " (Quit)")
+		return false
+	}
+
+	if !c.registered {
+		switch command {
+		case "PASS":
+			if len(params) < 1 {
+				c.Reply("461", "PASS", "Not enough parameters")
+				return true
+			}
+			c.password = params[0]
+		case "NICK":
+			if len(params) < 1 {
+				c.Reply("431", "No nickname given")
+				return true
+			}
+			c.nick = params[0]
+		case "USER":
+			if len(params) < 4 {
+				c.Reply("461", "USER", "Not enough parameters")
+				return true
+			}
+			c.userReceived = true
+		default:
+			c.Reply("451", "You have not registered")
+			return true
+		}
+		// NICK and USER can come in either order
+		if c.userReceived && c.nick != "*" {
+			return c.Login()
+		}
+		return true
+	}
+
+	switch command {
+	case "PASS", "USER":
+		c.Reply("462", "You may not reregister")
+	case "NICK":
+		// Nicks are usernames here, so they can't be changed
+		c.Reply("432", IRCNick(c.account.Username), "Nicknames are your Scratchcord username")
+	case "JOIN":
+		if len(params) < 1 {
+			c.Reply("461", "JOIN", "Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			c.Join(channel)
+		}
+	case "PART":
+		if len(params) < 1 {
+			c.Reply("461", "PART", "Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			c.Part(channel)
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			c.Reply("412", "No text to send")
+			return true
+		}
+		c.PrivMsg(params[0], params[1])
+	case "NAMES":
+		if len(params) < 1 {
+			c.Reply("366", "*", "End of /NAMES list")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			c.Names(channel)
+		}
+	case "TOPIC":
+		if len(params) < 1 {
+			c.Reply("461", "TOPIC", "Not enough parameters")
+			return true
+		}
+		if len(params) > 1 {
+			c.Reply("482", params[0], "Channel topics can't be changed on Scratchcord")
+			return true
+		}
+		c.Reply("331", params[0], "No topic is set")
+	default:
+		c.Reply("421", command, "Unknown command")
+	}
+	return true
+}
+
+// Logs in with PASS as the password and NICK as the username
+func (c *IRCClient) Login() bool {
+	account, ranks, err := AuthenticateAccount(c.nick, c.password, IRCRemoteIP(c.conn))
+	if errors.Is(err, ErrLoginRestricted) || errors.Is(err, ErrWrongCredentials) || errors.Is(err, ErrTooManyAttempts) || errors.Is(err, ErrPendingApproval) || errors.Is(err, ErrTwoFactorRequired) {
+		c.Reply("464", "Password incorrect")
+		c.Send("ERROR :Closing Link: " + c.nick + " (" + err.Error() + ")")
+		return false
+	} else if err != nil {
+		c.Send("ERROR :Closing Link: " + c.nick + " (an internal server error occured)")
+		return false
+	}
+	c.account = account
+	c.ranks = ranks
+	c.registered = true
+
+	// Let the client know what their nick actually is
+	nick := IRCNick(account.Username)
+	if nick != c.nick {
+		c.Send(":" + c.nick + " NICK " + nick)
+		c.nick = nick
+	}
+
+	RecordLogin(&account)
+
+	c.Reply("001", "Welcome to Scratchcord, "+c.nick)
+	c.Reply("002", "Your host is "+irc_server_name)
+	c.Reply("003", "This server speaks just enough IRC to chat")
+	c.Reply("004", irc_server_name, "scratchcord", "o", "o")
+	if motd == "" {
+		c.Reply("422", "MOTD File is missing")
+	} else {
+		c.Reply("375", "- "+irc_server_name+" Message of the day - ")
+		for _, line := range strings.Split(motd, "\n") {
+			c.Reply("372", "- "+line)
+		}
+		c.Reply("376", "End of /MOTD command")
+	}
+	return true
+}
+
+func (c *IRCClient) Join(ircChannel string) {
+	if !strings.HasPrefix(ircChannel, "#") || len(ircChannel) < 2 {
+		c.Reply("403", ircChannel, "No such channel")
+		return
+	}
+	channel := IRCChannelToScratchcord(ircChannel)
+
+	c.mutex.Lock()
+	alreadyJoined := c.channels[channel]
+	c.channels[channel] = true
+	c.mutex.Unlock()
+	if alreadyJoined {
+		return
+	}
+	ChannelPresence.Join(channel, c.account.ID)
+
+	c.Send(":" + c.Prefix() + " JOIN " + ircChannel)
+	c.Reply("331", ircChannel, "No topic is set")
+	c.Names(ircChannel)
+}
+
+func (c *IRCClient) Part(ircChannel string) {
+	channel := IRCChannelToScratchcord(ircChannel)
+
+	c.mutex.Lock()
+	joined := c.channels[channel]
+	delete(c.channels, channel)
+	c.mutex.Unlock()
+	if !joined {
+		c.Reply("442", ircChannel, "You're not on that channel")
+		return
+	}
+	ChannelPresence.Leave(channel, c.account.ID)
+	c.Send(":" + c.Prefix() + " PART " + ircChannel)
+}
+
+func (c *IRCClient) Names(ircChannel string) {
+	channel := IRCChannelToScratchcord(ircChannel)
+	userIds := ChannelPresence.Users(channel)
+
+	accounts := []Accounts{}
+	if len(userIds) > 0 {
+		db.Find(&accounts, "id IN ?", userIds)
+	}
+	nicks := make([]string, 0, len(accounts))
+	for _, account := range accounts {
+		nicks = append(nicks, IRCNick(account.Username))
+	}
+	slices.Sort(nicks)
+
+	// Keep each line short enough for old clients
+	line := ""
+	for _, nick := range nicks {
+		if len(line)+len(nick) > 400 {
+			c.Reply("353", "=", ircChannel, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += nick
+	}
+	if line != "" {
+		c.Reply("353", "=", ircChannel, line)
+	}
+	c.Reply("366", ircChannel, "End of /NAMES list")
+}
+
+func (c *IRCClient) PrivMsg(target string, text string) {
+	if !strings.HasPrefix(target, "#") {
+		c.Reply("401", target, "Scratchcord doesn't have private messages")
+		return
+	}
+	channel := IRCChannelToScratchcord(target)
+
+	c.mutex.Lock()
+	joined := c.channels[channel]
+	c.mutex.Unlock()
+	if !joined {
+		c.Reply("404", target, "Cannot send to channel")
+		return
+	}
+	if !slices.Contains(c.ranks, "CanSendMessage") {
+		c.Reply("404", target, "Cannot send to channel")
+		return
+	}
+
+	// /me becomes *text*
+	if strings.HasPrefix(text, "\x01ACTION ") {
+		text = "*" + strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01") + "*"
+	} else if strings.HasPrefix(text, "\x01") {
+		// Other CTCP requests don't mean anything here
+		return
+	}
+
+	db_msg := Messages{
+		Message:   text,
+		UserId:    c.account.ID,
+		Type:      1,
+		Channel:   channel,
+		Timestamp: uint64(time.Now().Unix()),
+	}
+	// The broadcast can happen before Create returns, so the lock is held across it
+	c.mutex.Lock()
+	db.Create(&db_msg)
+	c.sentMessages[db_msg.ID] = true
+	c.mutex.Unlock()
+}
+
+func (c *IRCClient) Prefix() string {
+	return c.nick + "!" + c.nick + "@" + irc_server_name
+}
+
+// Gets the IRC prefix of whoever sent a message
+func (c *IRCClient) SenderPrefix(message Messages) string {
+	if message.Type == 7 {
+		nick := IRCNick(message.BridgedUsername)
+		return nick + "!" + nick + "@bridge." + irc_server_name
+	}
+	if message.Type >= 100 {
+		return "System!system@" + irc_server_name
+	}
+
+	c.mutex.Lock()
+	username, ok := c.usernames[message.UserId]
+	c.mutex.Unlock()
+	if !ok {
+		user := Accounts{}
+		db.First(&user, "id = ?", message.UserId)
+		username = IRCNick(user.Username)
+		c.mutex.Lock()
+		c.usernames[message.UserId] = username
+		c.mutex.Unlock()
+	}
+	return username + "!" + username + "@" + irc_server_name
+}
+
+// Sends text to a channel, split by line since IRC can't have newlines in messages
+func (c *IRCClient) SendText(prefix string, command string, ircChannel string, text string) {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		c.Send(":" + prefix + " " + command + " " + ircChannel + " :" + line)
+	}
+}
+
+func (c *IRCClient) ForwardMessages(stop <-chan struct{}) {
+	eventChannel := BroadcastPublisher.Subscribe()
+	defer BroadcastPublisher.Unsubscribe(eventChannel)
+
+	for {
+		var recv_msg BroadcastDBMessage
+		select {
+		case <-stop:
+			return
+		case recv_msg = <-eventChannel:
+		}
+		if recv_msg.event != "new_message" {
+			continue
+		}
+
+		// Handle kicking
+		if recv_msg.data.Type == 105 || (recv_msg.data.Type == 104 && recv_msg.data.UserId == c.account.ID) {
+			c.Send("ERROR :Closing Link: " + c.nick + " (Kicked: " + recv_msg.data.Message + ")")
+			c.conn.Close()
+			return
+		}
+
+		isGlobal := recv_msg.data.Type == 100 || recv_msg.data.Type == 101
+		c.mutex.Lock()
+		joined := c.channels[recv_msg.data.Channel]
+		ownMessage := c.sentMessages[recv_msg.data.ID]
+		delete(c.sentMessages, recv_msg.data.ID)
+		c.mutex.Unlock()
+		if (!joined && !isGlobal) || ownMessage {
+			continue
+		}
+		ircChannel := "#" + recv_msg.data.Channel
+
+		switch recv_msg.data.Type {
+		case 1, 5, 7: // Normal, TTS and bridged messages
+			permission := "CanReadMessages"
+			if recv_msg.data.Type == 5 {
+				permission = "CanReadTTS"
+			}
+			if !slices.Contains(c.ranks, permission) {
+				continue
+			}
+			c.SendText(c.SenderPrefix(recv_msg.data), "PRIVMSG", ircChannel, recv_msg.data.Message)
+		case 2: // Nudge
+			if !slices.Contains(c.ranks, "CanReadNudges") {
+				continue
+			}
+			c.Send(":" + c.SenderPrefix(recv_msg.data) + " PRIVMSG " + ircChannel + " :\x01ACTION sent a nudge!\x01")
+		case 100, 101, 102, 103:
+			if !slices.Contains(c.ranks, "CanReadSpecialMessages") {
+				continue
+			}
+			if isGlobal {
+				// Global messages go everywhere the client is
+				c.mutex.Lock()
+				channels := make([]string, 0, len(c.channels))
+				for channel := range c.channels {
+					channels = append(channels, channel)
+				}
+				c.mutex.Unlock()
+				for _, channel := range channels {
+					c.SendText(c.SenderPrefix(recv_msg.data), "NOTICE", "#"+channel, recv_msg.data.Message)
+				}
+			} else {
+				c.SendText(c.SenderPrefix(recv_msg.data), "NOTICE", ircChannel, recv_msg.data.Message)
+			}
+		}
+	}
+}
+
+// Pings the client every so often so dead connections get noticed
+func (c *IRCClient) KeepAlive(stop <-chan struct{}) {
+	ticker := time.NewTicker(irc_ping_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			c.Send("PING :" + irc_server_name)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Failed logins are counted per username and per IP. Once there's too many, logins from there are
+// locked for a while, and every failure after that doubles how long. Usernames are counted whether
+// or not the account exists, so lockouts don't give away which ones do.
+
+const (
+	username_lockout_threshold = 5  // Failures before a username gets locked
+	ip_lockout_threshold       = 20 // IPs get more, since a few people can share one
+	lockout_base_duration      = 30 * time.Second
+	lockout_max_duration       = time.Hour
+	login_failure_window       = time.Hour // Failures older than this are forgotten
+)
+
+var (
+	ErrWrongCredentials = errors.New("wrong username or password")
+	ErrTooManyAttempts  = errors.New("too many attempts")
+)
+
+var (
+	lockoutMutex sync.Mutex
+
+	// Checked against when the account doesn't exist, so that takes as long as a wrong password
+	dummyPasswordHash     string
+	dummyPasswordHashOnce sync.Once
+)
+
+type LoginLockouts struct {
+	gorm.Model
+	Kind        string `gorm:"uniqueIndex:idx_lockout_key"` // "username" or "ip"
+	Value       string `gorm:"uniqueIndex:idx_lockout_key"`
+	Failures    uint
+	LastFailure uint64
+	LockedUntil uint64
+}
+
+type LockoutInfoResponse struct {
+	Kind        string
+	Value       string
+	Failures    uint
+	LastFailure uint64
+	LockedUntil uint64
+}
+
+type ClearLockoutRequest struct {
+	Kind  string
+	Value string
+}
+
+func LockoutDuration(failures uint, threshold uint) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+	duration := lockout_base_duration
+	for i := threshold; i < failures; i++ {
+		duration *= 2
+		if duration >= lockout_max_duration {
+			return lockout_max_duration
+		}
+	}
+	return duration
+}
+
+func lockout_keys(username string, ip string) map[string]string {
+	return map[string]string{
+		"username": UsernameKey(username),
+		"ip":       ip,
+	}
+}
+
+// How long until logins for this username from this IP are allowed again
+func LockoutRemaining(username string, ip string) time.Duration {
+	now := uint64(time.Now().Unix())
+	var remaining uint64 = 0
+	for kind, value := range lockout_keys(username, ip) {
+		lockout := LoginLockouts{}
+		if err := db.First(&lockout, "kind = ? AND value = ?", kind, value).Error; err != nil {
+			continue
+		}
+		if lockout.LockedUntil > now && lockout.LockedUntil-now > remaining {
+			remaining = lockout.LockedUntil - now
+		}
+	}
+	return time.Duration(remaining) * time.Second
+}
+
+func RecordLoginFailure(username string, ip string) {
+	lockoutMutex.Lock()
+	defer lockoutMutex.Unlock()
+
+	now := time.Now()
+	for kind, value := range lockout_keys(username, ip) {
+		threshold := uint(username_lockout_threshold)
+		if kind == "ip" {
+			threshold = ip_lockout_threshold
+		}
+
+		lockout := LoginLockouts{}
+		db.FirstOrInit(&lockout, LoginLockouts{Kind: kind, Value: value})
+		if now.Sub(time.Unix(int64(lockout.LastFailure), 0)) > login_failure_window {
+			lockout.Failures = 0
+		}
+		lockout.Failures++
+		lockout.LastFailure = uint64(now.Unix())
+		if duration := LockoutDuration(lockout.Failures, threshold); duration > 0 {
+			lockout.LockedUntil = uint64(now.Add(duration).Unix())
+			log.Printf("login locked for %s %s for %s after %d failures", kind, value, duration, lockout.Failures)
+		}
+		if err := db.Save(&lockout).Error; err != nil {
+			log.Printf("failed to save login failure: %v", err)
+		}
+	}
+}
+
+// A successful login clears the username's failures. The IP's are left, or one account could be used to reset them.
+func ClearLoginFailures(username string) {
+	db.Unscoped().Where("kind = ? AND value = ?", "username", UsernameKey(username)).Delete(&LoginLockouts{})
+}
+
+func CheckDummyPassword(password string) {
+	dummyPasswordHashOnce.Do(func() {
+		dummyPasswordHash, _ = HashPassword("not a real password")
+	})
+	CheckPassword(dummyPasswordHash, password)
+}
+
+// Replies to a locked out login, with when to try again
+func send_too_many_attempts(c *fiber.Ctx, username string) error {
+	remaining := LockoutRemaining(username, c.IP())
+	c.Set(fiber.HeaderRetryAfter, fmt.Sprint(int(remaining.Seconds())))
+	return c.Status(fiber.StatusTooManyRequests).SendString(ErrTooManyAttempts.Error() + "!")
+}
+
+func ListLockoutsAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageLockouts"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	// Nothing older than the window counts anymore
+	cutoff := time.Now().Add(-login_failure_window).Unix()
+	db.Unscoped().Where("last_failure < ? AND locked_until < ?", cutoff, time.Now().Unix()).Delete(&LoginLockouts{})
+
+	lockouts := []LoginLockouts{}
+	db.Order("last_failure desc").Find(&lockouts)
+	response := make([]LockoutInfoResponse, 0, len(lockouts))
+	for _, lockout := range lockouts {
+		response = append(response, LockoutInfoResponse{
+			Kind:        lockout.Kind,
+			Value:       lockout.Value,
+			Failures:    lockout.Failures,
+			LastFailure: lockout.LastFailure,
+			LockedUntil: lockout.LockedUntil,
+		})
+	}
+	return c.JSON(response)
+}
+
+func ClearLockoutAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageLockouts"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(ClearLockoutRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if r.Kind != "username" && r.Kind != "ip" {
+		return c.SendString("malformed input!")
+	}
+	value := r.Value
+	if r.Kind == "username" {
+		value = UsernameKey(value)
+	}
+	result := db.Unscoped().Where("kind = ? AND value = ?", r.Kind, value).Delete(&LoginLockouts{})
+	if result.RowsAffected == 0 {
+		return c.SendString("lockout does not exist!")
+	}
+	return c.SendString("sucess!")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Email goes out through a Mailer, which is SMTP unless something else gets plugged in.
+// Without SCRATCHCORD_SMTP_ADDR there's no mailer, and everything needing email is turned off.
+
+var (
+	smtp_addr     string = os.Getenv("SCRATCHCORD_SMTP_ADDR") // Example: smtp.example.com:587
+	smtp_username string = os.Getenv("SCRATCHCORD_SMTP_USERNAME")
+	smtp_password string = os.Getenv("SCRATCHCORD_SMTP_PASSWORD")
+	smtp_from     string = os.Getenv("SCRATCHCORD_SMTP_FROM") // Example: Scratchcord <noreply@example.com>
+)
+
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+var mailer Mailer
+
+type SMTPMailer struct {
+	Addr     string
+	Username string
+	Password string
+	From     string
+}
+
+func setup_mailer() {
+	if smtp_addr == "" {
+		return
+	}
+	if _, err := mail.ParseAddress(smtp_from); err != nil {
+		log.Fatalf("SCRATCHCORD_SMTP_FROM is invalid: %v", err)
+	}
+	mailer = &SMTPMailer{
+		Addr:     smtp_addr,
+		Username: smtp_username,
+		Password: smtp_password,
+		From:     smtp_from,
+	}
+	if server_url == "" {
+		log.Printf("SCRATCHCORD_SERVER_URL isn't set, so email verification links won't work")
+	}
+	log.Printf("sending email through %s", smtp_addr)
+}
+
+func EmailEnabled() bool {
+	return mailer != nil
+}
+
+// Sends a plain text email. This upgrades to TLS if the server offers it, and only logs in if there's a username.
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	from, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return err
+	}
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, from.Address, []string{to}, BuildEmail(m.From, to, subject, body))
+}
+
+func BuildEmail(from string, to string, subject string, body string) []byte {
+	domain := "localhost"
+	if address, err := mail.ParseAddress(from); err == nil {
+		if _, host, found := strings.Cut(address.Address, "@"); found {
+			domain = host
+		}
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@%s>\r\n", uuid.NewString(), domain)
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+	return []byte(message.String())
+}
+
+// Sends in the background, so requests don't wait on (or give anything away by) how long SMTP takes
+func SendEmailAsync(to string, subject string, body string) {
+	if mailer == nil {
+		return
+	}
+	go func() {
+		if err := mailer.Send(to, subject, body); err != nil {
+			log.Printf("failed to send email to %s: %v", to, err)
+		}
+	}()
+}
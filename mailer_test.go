@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// A tiny SMTP server that takes one email and hands over everything it was sent
+func start_smtp_sink(t *testing.T) (string, <-chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan []string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		lines := []string{}
+		text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			lines = append(lines, line)
+			switch command := strings.ToUpper(strings.Fields(line + " ")[0]); command {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				lines = append(lines, data...)
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				received <- lines
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailerSend(t *testing.T) {
+	addr, received := start_smtp_sink(t)
+	mailer := &SMTPMailer{Addr: addr, From: "Scratchcord <noreply@example.com>"}
+	if err := mailer.Send("someone@example.com", "Héllo", "first line\nsecond line"); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := <-received
+	sent := strings.Join(lines, "\n")
+	for _, expected := range []string{
+		"MAIL FROM:<noreply@example.com>",
+		"RCPT TO:<someone@example.com>",
+		"From: Scratchcord <noreply@example.com>",
+		"To: someone@example.com",
+		"Subject: =?utf-8?q?H=C3=A9llo?=",
+		"Content-Type: text/plain; charset=utf-8",
+		"first line\nsecond line",
+	} {
+		if !strings.Contains(sent, expected) {
+			t.Errorf("expected %q in what was sent:\n%s", expected, sent)
+		}
+	}
+}
+
+// Keeps emails instead of sending them
+type fakeMailer struct {
+	sent chan string
+}
+
+func (m *fakeMailer) Send(to string, subject string, body string) error {
+	m.sent <- body
+	return nil
+}
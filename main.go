@@ -1,8 +1,6 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"errors"
 	"log"
 	"os"
@@ -48,11 +46,32 @@ type RecievedMessageResponse struct {
 	MessageId uint
 	Message   string
 }
+type RecievedAccountDeletedResponse struct {
+	Cmd       string
+	UserId    uint
+	NewUserId uint
+}
 type RecievedMessageResponseNoBody struct {
 	Cmd       string
 	UserId    uint
 	MessageId uint
 }
+type RecievedBridgedMessageResponse struct {
+	Cmd       string
+	MessageId uint
+	Message   string
+	Username  string
+	Avatar    string
+}
+type EditMessageRequest struct {
+	Cmd       string
+	MessageId uint
+	Message   string
+}
+type DeleteMessageRequest struct {
+	Cmd       string
+	MessageId uint
+}
 type RecievedTypingResponse struct {
 	Cmd    string
 	UserId uint
@@ -62,8 +81,9 @@ type KickedResponse struct {
 	Message string
 }
 type BroadcastDBMessage struct {
-	event string
-	data  Messages
+	event     string
+	data      Messages
+	newUserId uint // For "account_deleted", who the account's messages belong to now (0 if they were deleted)
 }
 type UserInfoResponse struct {
 	ID             uint
@@ -73,23 +93,22 @@ type UserInfoResponse struct {
 	LastLogin      uint64
 	Ranks          string
 	EffectiveRanks []string // Consistency be dammed
+	Bot            bool
 }
 
-const (
-	hash_default_cost int = 14
-)
-
 var (
-	privateKey                  *rsa.PrivateKey
 	motd                        string   = os.Getenv("SCRATCHCORD_MOTD")
 	webhook_url                 string   = os.Getenv("SCRATCHCORD_WEBHOOK_URL")
-	admin_password              string   = os.Getenv("SCRATCHCORD_ADMIN_PASSWORD")
-	server_url                  string   = os.Getenv("SCRATCHCORD_SERVER_URL") // Example: http://127.0.0.1 or https://example.com/scratchcord/api
+	admin_password              string   = os.Getenv("SCRATCHCORD_ADMIN_PASSWORD") // Not used anymore, see bootstrap.go
+	server_url                  string   = os.Getenv("SCRATCHCORD_SERVER_URL")     // Example: http://127.0.0.1 or https://example.com/scratchcord/api
 	upload_directory            string   = os.Getenv("SCRATCHCORD_MEDIA_PATH")
 	key_path                    string   = os.Getenv("SCRATCHCORD_KEY_PATH")
-	permitted_protocol_versions []string = []string{"SCLPV10", "SCPV10"}
+	permitted_protocol_versions []string = []string{"SCLPV10", "SCPV10", "SCPV11"}
+	legacy_protocol_versions    []string = []string{"SCLPV10", "SCPV10"} // These get 72 hour tokens instead of refresh tokens
+	allow_legacy_tokens         bool     = os.Getenv("SCRATCHCORD_LEGACY_TOKENS") != "false"
 	db                          *gorm.DB
 	BroadcastPublisher          = NewEventPublisher()
+	ChannelPresence             = NewPresenceTracker()
 )
 
 func main() {
@@ -100,31 +119,12 @@ func main() {
 
 	var err error
 
-	// Init Key Directories
-	if _, err := os.Stat(key_path); errors.Is(err, os.ErrNotExist) {
-		os.Mkdir(key_path+"/", os.ModePerm)
-	}
-
 	// Auth setup
-	privDataPEM, err := os.ReadFile(key_path + "/auth-key.pem")
+	setup_password_hasher()
+	setup_signing_keys()
+	check_breached_passwords_path()
+	check_registration_mode()
 
-	if err != nil {
-		log.Printf("Auth private key not found! Generating Authentication Private Key...")
-
-		// A private key has not been generated, lets create one and add it to the console.
-		rng := rand.Reader
-		privateKey, err = rsa.GenerateKey(rng, 2048)
-		if err != nil {
-			log.Fatalf("rsa.GenerateKey: %v", err)
-		}
-
-		os.WriteFile(key_path+"/auth-key.pem", []byte(ExportRsaPrivateKeyAsPemStr(privateKey)), 0644)
-	} else {
-		privateKey, err = ParseRsaPrivateKeyFromPemStr(string(privDataPEM))
-		if err != nil {
-			panic(err)
-		}
-	}
 	// Database
 	if _, err := os.Stat(os.Getenv("SCRATCHCORD_DB_PATH")); errors.Is(err, os.ErrNotExist) {
 		os.Create(os.Getenv("SCRATCHCORD_DB_PATH"))
@@ -145,12 +145,38 @@ func main() {
 	db.AutoMigrate(&Messages{})
 	db.AutoMigrate(&Accounts{})
 	db.AutoMigrate(&Ranks{})
+	db.AutoMigrate(&Webhooks{})
+	db.AutoMigrate(&WebhookDeliveries{})
+	db.AutoMigrate(&DiscordBridgedMessages{})
+	db.AutoMigrate(&MatrixBridgedMessages{})
+	db.AutoMigrate(&MatrixPuppets{})
+	db.AutoMigrate(&Sessions{})
+	db.AutoMigrate(&RefreshTokens{})
+	db.AutoMigrate(&BotTokens{})
+	db.AutoMigrate(&OidcIdentities{})
+	db.AutoMigrate(&TwoFactorSecrets{})
+	db.AutoMigrate(&LoginLockouts{})
+	db.AutoMigrate(&Invites{})
+	db.AutoMigrate(&PreviousUsernames{})
+	db.AutoMigrate(&EmailTokens{})
+	db.AutoMigrate(&RankChanges{})
+	db.AutoMigrate(&DataExports{})
+	setup_confusables()
+	setup_username_keys()
 
 	// Initialize Ranks
 	InitializeRanks()
 
-	// Register default admin account (in order to be able to administer without DB edits)
-	register_default_admin_account()
+	// Commands like recover-admin run instead of the server
+	if run_command(os.Args[1:]) {
+		return
+	}
+
+	// Lets the owner account be made on the first run
+	start_bootstrap()
+
+	// Email, if it's set up
+	setup_mailer()
 
 	// Create fiber application
 	app := fiber.New(fiber.Config{
@@ -165,9 +191,16 @@ func main() {
 	}))
 
 	// Paths
+	app.Get("/.well-known/jwks.json", jwks)
 	app.Get("/hello", hello)
 	app.Post("/login", login)
 	app.Post("/register", register)
+	app.Post("/refresh", refresh)
+	app.Post("/login_2fa", login_2fa)
+	app.Post("/bootstrap", bootstrap)
+	app.Post("/request_password_reset", request_password_reset)
+	app.Post("/reset_password", reset_password)
+	app.Get("/verify_email", verify_email)
 
 	app.Get("/get_user_info", get_user_info)
 	app.Get("/get_rank_info", GetRankInfo)
@@ -177,6 +210,8 @@ func main() {
 	// Add a websocket path
 	app.Use("/ws", websockek_path)
 	app.Get("/ws/:channel", websocket.New(global_channel_websocket_handler))
+	app.Use("/cloudlink", websockek_path)
+	app.Get("/cloudlink", websocket.New(cloudlink_websocket_handler))
 
 	app.Get("/monitor", monitor.New(
 		monitor.Config{
@@ -184,17 +219,36 @@ func main() {
 			Refresh: (50 * time.Millisecond),
 		},
 	))
+	// Matrix appservice endpoints, these use the homeserver's token instead of ours
+	start_matrix_bridge(app)
+	// OpenID Connect login, if it's set up
+	start_oidc(app)
+
 	// Handling Authenticated Points
 
+	// Bot tokens, these skip the JWT middleware
+	app.Use(bot_auth_middleware)
+
 	// JWT Middleware
 	app.Use(jwtware.New(jwtware.Config{
-		SigningKey: jwtware.SigningKey{
-			JWTAlg: jwtware.RS256,
-			Key:    privateKey.Public(),
+		KeyFunc: SigningKeys.Keyfunc,
+		Filter: func(c *fiber.Ctx) bool {
+			return c.Locals("user") != nil
+		},
+		// Tokens can be revoked before they expire (password changes etc.)
+		SuccessHandler: func(c *fiber.Ctx) error {
+			if err := CheckTokenIsCurrent(c.Locals("user").(*jwt.Token)); err != nil {
+				return c.Status(fiber.StatusUnauthorized).SendString("token revoked!")
+			}
+			return c.Next()
 		},
 	}))
 
-	start_discord_webhook() // Start the discord webhook
+	start_webhook_dispatcher()       // Start the outgoing webhooks
+	start_discord_bridge()           // Start the discord bridge, if it's set up
+	start_irc_gateway()              // Start the IRC gateway, if it's set up
+	start_account_deletion_sweeper() // Delete accounts once their grace period is over
+	start_data_exporter()            // Build data exports in the background
 
 	app.Post("/reauth", reauth)
 	app.Get("/check_auth", check_auth)
@@ -203,6 +257,21 @@ func main() {
 	// User Management
 	app.Post("/change_password", change_password)
 	app.Post("/upload_profile_picture", UploadProfilePicture)
+	app.Post("/change_username", change_username)
+	app.Get("/list_sessions", list_sessions)
+	app.Post("/revoke_session", revoke_session)
+	app.Post("/revoke_all_sessions", revoke_all_sessions)
+	app.Post("/setup_2fa", setup_2fa)
+	app.Post("/enable_2fa", enable_2fa)
+	app.Post("/disable_2fa", disable_2fa)
+	app.Post("/regenerate_recovery_codes", regenerate_recovery_codes)
+	app.Get("/get_email", get_email)
+	app.Post("/set_email", set_email)
+	app.Post("/delete_account", delete_account)
+	app.Post("/cancel_account_deletion", cancel_account_deletion)
+	app.Post("/request_data_export", request_data_export)
+	app.Get("/data_export_status", data_export_status)
+	app.Get("/download_data_export", download_data_export)
 
 	// Admin Requests
 	app.Post("/admin/api/grant_rank", GrantRanksAPI)
@@ -210,7 +279,31 @@ func main() {
 
 	app.Post("/admin/api/delete_rank", DeleteRankAPI)
 	app.Post("/admin/api/create_rank", CreateRankAPI)
+	app.Post("/admin/api/modify_rank", ModifyRankAPI)
 	app.Post("/admin/api/reset_password", ChangePasswordAdmin)
+	app.Post("/admin/api/delete_user", DeleteUserAPI)
+
+	app.Get("/admin/api/list_sessions", ListSessionsAdmin)
+	app.Post("/admin/api/revoke_session", RevokeSessionAdmin)
+	app.Post("/admin/api/revoke_all_sessions", RevokeAllSessionsAdmin)
+	app.Post("/admin/api/reset_2fa", ResetTwoFactorAdmin)
+	app.Get("/admin/api/list_lockouts", ListLockoutsAPI)
+	app.Post("/admin/api/clear_lockout", ClearLockoutAPI)
+	app.Post("/admin/api/create_invite", CreateInviteAPI)
+	app.Post("/admin/api/delete_invite", DeleteInviteAPI)
+	app.Get("/admin/api/list_invites", ListInvitesAPI)
+	app.Get("/admin/api/list_pending_registrations", ListPendingRegistrationsAPI)
+	app.Post("/admin/api/approve_registration", ApproveRegistrationAPI)
+	app.Post("/admin/api/reject_registration", RejectRegistrationAPI)
+
+	app.Post("/admin/api/create_webhook", CreateWebhookAPI)
+	app.Post("/admin/api/delete_webhook", DeleteWebhookAPI)
+	app.Get("/admin/api/list_webhooks", ListWebhooksAPI)
+
+	app.Post("/admin/api/create_bot", CreateBotAPI)
+	app.Post("/admin/api/create_bot_token", CreateBotTokenAPI)
+	app.Post("/admin/api/revoke_bot_token", RevokeBotTokenAPI)
+	app.Get("/admin/api/list_bot_tokens", ListBotTokensAPI)
 
 	log.Fatal(app.Listen(":3000"))
 	// Access the websocket server: ws://0.0.0.0:3000/
@@ -239,6 +332,15 @@ func (m *Messages) AfterUpdate(tx *gorm.DB) (err error) {
 	return
 }
 
+func (m *Messages) AfterDelete(tx *gorm.DB) (err error) {
+	msg := BroadcastDBMessage{
+		event: "message_deleted",
+		data:  *m,
+	}
+	BroadcastPublisher.Publish(msg)
+	return
+}
+
 func hello(c *fiber.Ctx) error {
 	// Variable is only valid within this handler
 	return c.SendString("Hello, World!")
@@ -254,6 +356,10 @@ func get_offline_messages(c *fiber.Ctx) error {
 		return c.SendString("Invalid Channel!")
 	}
 
+	if !TokenCanUseChannel(user, channel) {
+		return c.SendString("channel not allowed!")
+	}
+
 	offline_messages := []Messages{}
 	db.Order("timestamp ASC").Limit(30).Find(&offline_messages, "channel = ?", channel)
 	return c.JSON(offline_messages)
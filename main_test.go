@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Points db at a fresh database with tables for the given models
+func setup_test_db(tb testing.TB, models ...interface{}) {
+	tb.Helper()
+	var err error
+	db, err = gorm.Open(sqlite.Open(filepath.Join(tb.TempDir(), "test.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := db.AutoMigrate(models...); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Points uploads at a temporary directory and default avatars at a local server
+func setup_test_avatars(tb testing.TB) {
+	tb.Helper()
+	upload_directory = tb.TempDir()
+	if err := os.MkdirAll(filepath.Join(upload_directory, "profile-pictures"), 0755); err != nil {
+		tb.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("RIFF"))
+	}))
+	tb.Cleanup(server.Close)
+	default_avatar_api = server.URL + "/?seed="
+}
+
+// Cheap password hashing, the real settings are slow on purpose
+func setup_test_hasher() {
+	passwordHasher = PasswordHasher{Algorithm: hash_argon2id, Memory: 1024, Time: 1, Threads: 1}
+	passwordHashSlots = make(chan struct{}, 2)
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"slices"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
-	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type RankModifyJson struct {
@@ -13,8 +16,8 @@ type RankModifyJson struct {
 	Rank   string
 }
 type DeleteRankRequestJson struct {
-	RemoveRankFromUsers bool
-	Rank                string
+	RemoveRankFromUsers bool // Otherwise ranks that anyone still has can't be deleted
+	RankName            string
 }
 
 type ResetPasswordAdmin struct {
@@ -109,7 +112,13 @@ func CreateRankAPI(c *fiber.Ctx) error {
 			ParentRanks:      string(parentRanksJSON),
 			SubtractiveRanks: string(subtractiveRanksJSON),
 		}
-		if err := db.Create(&newRank).Error; err != nil {
+		if err := CheckRankGraphChange([]Ranks{newRank}, nil); err != nil {
+			c.SendStatus(fiber.StatusBadRequest)
+			return c.SendString(err.Error() + "!")
+		}
+		err = db.Create(&newRank).Error
+		InvalidateRankCache()
+		if err != nil {
 			c.SendStatus(fiber.StatusInternalServerError)
 			return c.SendString("failed to create rank: " + err.Error())
 		}
@@ -119,8 +128,13 @@ func CreateRankAPI(c *fiber.Ctx) error {
 	}
 }
 
-// TODO: move this to
+// Sets another account's password, for admins with CanResetOtherUsersPasswords
 func ChangePasswordAdmin(c *fiber.Ctx) error {
+	// Check if the user is authorized to do this action
+	if err := CheckIfTokenHasRank(c, "CanResetOtherUsersPasswords"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
 	// Decode the request JSON
 	r := new(ResetPasswordAdmin)
 	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
@@ -136,88 +150,290 @@ func ChangePasswordAdmin(c *fiber.Ctx) error {
 		return c.SendString("account does not exist!")
 	}
 
-	// Check permissions
-	ranks, err := GetEffectivePermissions(account.Ranks)
+	if violations := CheckPasswordPolicy(r.NewPassword, account.Username); len(violations) > 0 {
+		return send_password_violations(c, violations)
+	}
+
+	// Generate New password Password
+	hash, err := HashPassword(r.NewPassword)
 	if err != nil {
+		return c.SendString("password invalid!")
+	}
+
+	// Save the new password in the DB
+	account.PasswordHash = hash
+	db.Model(&account).UpdateColumn("password_hash", hash)
+
+	// Log the user out everywhere
+	if err := RevokeAccountTokens(&account); err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
+	return c.SendString("sucess!")
+}
+
+// Only the fields that are set get changed
+type ModifyRankRequestJson struct {
+	RankName         string // The rank to change
+	NewRankName      *string
+	RankStrength     *uint
+	Color            *string
+	ShowToOtherUsers *bool
+	ParentRanks      *[]string
+	SubtractiveRanks *[]string
+}
 
-	if !slices.Contains(ranks, "CanResetOtherUsersPasswords") {
-		return c.SendString("changing profile pictures is restricted!")
+var (
+	ErrRankNameEmpty         = errors.New("rank name can't be empty")
+	ErrRankNameTaken         = errors.New("rank name already taken")
+	ErrRankStrengthTaken     = errors.New("rank strength already taken")
+	ErrRequiredRankRenamed   = errors.New("built in ranks can't be renamed")
+	ErrConfiguredRankRenamed = errors.New("rank is used in the OpenID Connect settings, change them first")
+	ErrRankListInvalid       = errors.New("rank list invalid")
+	ErrRankInUse             = errors.New("rank is still used")
+)
+
+// The ranks in required_ranks.json, which the server depends on by name
+func IsRequiredRank(rankName string) bool {
+	var requiredRanks []DefaultRanksJson
+	if err := json.Unmarshal(requiredRanksJson, &requiredRanks); err != nil {
+		return false
 	}
+	return slices.ContainsFunc(requiredRanks, func(r DefaultRanksJson) bool { return r.RankName == rankName })
+}
 
-	// Generate New password Password
-	hash, err := bcrypt.GenerateFromPassword([]byte(r.NewPassword), hash_default_cost)
+// Swaps a rank's name in a JSON array of rank names, and whether it was there
+func rename_in_rank_list(rankList string, oldName string, newName string) (string, bool, error) {
+	var ranks []string
+	if err := json.Unmarshal([]byte(rankList), &ranks); err != nil {
+		return rankList, false, err
+	}
+	if !slices.Contains(ranks, oldName) {
+		return rankList, false, nil
+	}
+	for i, rank := range ranks {
+		if rank == oldName {
+			ranks[i] = newName
+		}
+	}
+	renamed, err := json.Marshal(ranks)
+	return string(renamed), true, err
+}
+
+// Accounts that have the rank
+func accounts_with_rank(tx *gorm.DB, rankName string) ([]Accounts, error) {
+	accounts := []Accounts{}
+	if err := tx.Where("ranks LIKE ?", rank_list_like(rankName)).Find(&accounts).Error; err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(accounts, func(a Accounts) bool {
+		var ranks []string
+		json.Unmarshal([]byte(a.Ranks), &ranks)
+		return !slices.Contains(ranks, rankName)
+	}), nil
+}
+
+// Bot tokens scoped to the rank
+func bot_tokens_with_rank(tx *gorm.DB, rankName string) ([]BotTokens, error) {
+	tokens := []BotTokens{}
+	if err := tx.Where("permissions LIKE ?", rank_list_like(rankName)).Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(tokens, func(t BotTokens) bool {
+		var permissions []string
+		json.Unmarshal([]byte(t.Permissions), &permissions)
+		return !slices.Contains(permissions, rankName)
+	}), nil
+}
+
+// Renames a rank everywhere it's used: on accounts, bot tokens, invites & other ranks
+func rename_rank_references(tx *gorm.DB, oldName string, newName string, otherRanks []Ranks) error {
+	accounts, err := accounts_with_rank(tx, oldName)
 	if err != nil {
-		return c.SendString("password invalid!")
+		return err
+	}
+	for _, account := range accounts {
+		var ranks []string
+		if err := json.Unmarshal([]byte(account.Ranks), &ranks); err != nil {
+			return fmt.Errorf("failed to read account %d's ranks: %w", account.ID, err)
+		}
+		renamed := slices.Clone(ranks)
+		for i, rank := range renamed {
+			if rank == oldName {
+				renamed[i] = newName
+			}
+		}
+		// Goes in their rank history as losing the old name & getting the new one
+		if err := SetAccountRanks(tx, &account, renamed); err != nil {
+			return err
+		}
 	}
 
-	// Save the new password in the DB
-	account.PasswordHash = string(hash)
-	db.Save(&account)
+	for _, rank := range otherRanks {
+		if err := tx.Model(&Ranks{}).Where("rank_strength = ?", rank.RankStrength).Updates(map[string]interface{}{
+			"parent_ranks":      rank.ParentRanks,
+			"subtractive_ranks": rank.SubtractiveRanks,
+		}).Error; err != nil {
+			return err
+		}
+	}
 
-	// TODO: Make it invalidate all past tokens
+	// Bot tokens are scoped to permissions, which are ranks too
+	tokens, err := bot_tokens_with_rank(tx, oldName)
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		permissions, found, err := rename_in_rank_list(token.Permissions, oldName, newName)
+		if err != nil {
+			return fmt.Errorf("failed to read bot token %d's permissions: %w", token.ID, err)
+		}
+		if !found {
+			continue
+		}
+		if err := tx.Model(&BotTokens{}).Where("id = ?", token.ID).UpdateColumn("permissions", permissions).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&Invites{}).Where("rank = ?", oldName).Update("rank", newName).Error
+}
+
+func ModifyRankAPI(c *fiber.Ctx) error {
+	// Check if the user is authorized to do this action
+	if err := CheckIfTokenHasRank(c, "CanModifyRanks"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	var request ModifyRankRequestJson
+	if err := json.Unmarshal(c.Body(), &request); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// Checked & written in one transaction, so two changes at once can't both take the same name or strength
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return modify_rank(tx, request)
+	})
+	InvalidateRankCache()
+	if errors.Is(err, ErrRankNameTaken) || errors.Is(err, ErrRankStrengthTaken) {
+		c.SendStatus(fiber.StatusConflict)
+		return c.SendString(err.Error() + "!")
+	} else if errors.Is(err, ErrRankNameEmpty) || errors.Is(err, ErrRequiredRankRenamed) || errors.Is(err, ErrConfiguredRankRenamed) ||
+		errors.Is(err, ErrRankMissing) || errors.Is(err, ErrRankCycle) || errors.Is(err, ErrRankListInvalid) {
+		c.SendStatus(fiber.StatusBadRequest)
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return c.SendString("failed to modify rank: " + err.Error())
+	}
 	return c.SendString("sucess!")
 }
 
-// func ModifyRankAPI(c *fiber.Ctx) error {
-// 	// Check if the user is authorized to do this action
-// 	if err := CheckIfTokenHasRank(c, "CanModifyRanks"); err != nil {
-// 		return c.SendStatus(fiber.StatusUnauthorized)
-// 	}
-
-// 	var rank DefaultRanksJson
-// 	if err := json.Unmarshal(c.Body(), &rank); err != nil {
-// 		return c.SendStatus(fiber.StatusBadRequest)
-// 	}
-
-// 	// Check if rank exists
-// 	existingRank := Ranks{}
-// 	result := db.Where("rank_name = ?", rank.RankName).First(&existingRank)
-// 	if result.RowsAffected != 0 {
-// 		// Rank exist, let's modify it
-
-// 		// Check if the marshal elements were included
-// 		// and if it is, we set that to the rank.
-// 		if rank.ParentRanks != nil {
-// 			parentRanksJSON, err := json.Marshal(rank.ParentRanks)
-// 			if err != nil {
-// 				c.SendStatus(fiber.StatusBadRequest)
-// 				return c.SendString("failed to marshal parent ranks: " + err.Error())
-// 			}
-// 			existingRank.ParentRanks = string(parentRanksJSON)
-// 		}
-// 		if rank.SubtractiveRanks != nil {
-// 			subtractiveRanksJSON, err := json.Marshal(rank.SubtractiveRanks)
-// 			if err != nil {
-// 				c.SendStatus(fiber.StatusBadRequest)
-// 				return c.SendString("failed to marshal subtractive ranks: " + err.Error())
-// 			}
-// 			existingRank.SubtractiveRanks = string(subtractiveRanksJSON)
-// 		}
-
-// 		if &rank.RankStrength != nil {
-// 			existingRank.RankStrength = rank.RankStrength
-// 		}
-// 		if &rank.RankName != nil {
-// 			existingRank.RankName = rank.RankName
-// 		}
-// 		if &rank.Color != nil {
-// 			existingRank.Color = rank.Color
-// 		}
-// 		if &rank.ShowToOtherUsers != nil {
-// 			existingRank.ShowToOtherUsers = rank.ShowToOtherUsers
-// 		}
-
-// 		if err := db.Save(&existingRank).Error; err != nil {
-// 			c.SendStatus(fiber.StatusInternalServerError)
-// 			return c.SendString("failed to modify rank: " + err.Error())
-// 		}
-// 		return c.SendString("sucess!")
-// 	} else {
-// 		return c.SendStatus(fiber.StatusBadRequest)
-// 	}
-// }
+func modify_rank(tx *gorm.DB, request ModifyRankRequestJson) error {
+	// Check if rank exists
+	existingRank := Ranks{}
+	if err := tx.Where("rank_name = ?", request.RankName).First(&existingRank).Error; err != nil {
+		return fmt.Errorf("%w: %s", ErrRankMissing, request.RankName)
+	}
+	oldName, oldStrength := existingRank.RankName, existingRank.RankStrength
+
+	// Apply whatever was included
+	if request.RankStrength != nil && *request.RankStrength != oldStrength {
+		var count int64
+		if err := tx.Model(&Ranks{}).Where("rank_strength = ?", *request.RankStrength).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRankStrengthTaken
+		}
+		existingRank.RankStrength = *request.RankStrength
+	}
+	if request.Color != nil {
+		existingRank.Color = *request.Color
+	}
+	if request.ShowToOtherUsers != nil {
+		existingRank.ShowToOtherUsers = *request.ShowToOtherUsers
+	}
+	if request.ParentRanks != nil {
+		if err := existingRank.SetParentRanks(*request.ParentRanks); err != nil {
+			return fmt.Errorf("%w: %w", ErrRankListInvalid, err)
+		}
+	}
+	if request.SubtractiveRanks != nil {
+		if err := existingRank.SetSubtractiveRanks(*request.SubtractiveRanks); err != nil {
+			return fmt.Errorf("%w: %w", ErrRankListInvalid, err)
+		}
+	}
+
+	// A new name has to be swapped in everywhere the old one was, including the rank's own parents
+	newName := oldName
+	if request.NewRankName != nil {
+		newName = strings.TrimSpace(*request.NewRankName)
+	}
+	renamed := newName != oldName
+	changedRanks := []Ranks{}
+	removedRanks := []string{}
+	if renamed {
+		if newName == "" {
+			return ErrRankNameEmpty
+		}
+		if IsRequiredRank(oldName) {
+			return ErrRequiredRankRenamed
+		}
+		if OIDCConfigUsesRank(oldName) {
+			return ErrConfiguredRankRenamed
+		}
+		var count int64
+		if err := tx.Model(&Ranks{}).Where("rank_name = ?", newName).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return ErrRankNameTaken
+		}
+		existingRank.RankName = newName
+		removedRanks = append(removedRanks, oldName)
+
+		otherRanks := []Ranks{}
+		if err := tx.Where("rank_name != ?", oldName).Find(&otherRanks).Error; err != nil {
+			return err
+		}
+		for _, rank := range append(otherRanks, existingRank) {
+			parentRanks, parentFound, err := rename_in_rank_list(rank.ParentRanks, oldName, newName)
+			if err != nil {
+				return err
+			}
+			subtractiveRanks, subtractiveFound, err := rename_in_rank_list(rank.SubtractiveRanks, oldName, newName)
+			if err != nil {
+				return err
+			}
+			rank.ParentRanks, rank.SubtractiveRanks = parentRanks, subtractiveRanks
+			if rank.RankName == newName {
+				existingRank = rank
+			} else if parentFound || subtractiveFound {
+				changedRanks = append(changedRanks, rank)
+			}
+		}
+	}
+
+	if err := CheckRankGraphChange(append(slices.Clone(changedRanks), existingRank), removedRanks); err != nil {
+		return err
+	}
+
+	// Keyed by the old strength, since that might be changing too
+	if err := tx.Model(&Ranks{}).Where("rank_strength = ?", oldStrength).Updates(map[string]interface{}{
+		"rank_strength":       existingRank.RankStrength,
+		"rank_name":           existingRank.RankName,
+		"color":               existingRank.Color,
+		"show_to_other_users": existingRank.ShowToOtherUsers,
+		"parent_ranks":        existingRank.ParentRanks,
+		"subtractive_ranks":   existingRank.SubtractiveRanks,
+	}).Error; err != nil {
+		return err
+	}
+	if renamed {
+		return rename_rank_references(tx, oldName, existingRank.RankName, changedRanks)
+	}
+	return nil
+}
 
 func DeleteRankAPI(c *fiber.Ctx) error {
 	// Check if the user is authorized to do this action
@@ -225,21 +441,74 @@ func DeleteRankAPI(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusUnauthorized)
 	}
 
-	var rank DefaultRanksJson
-	if err := json.Unmarshal(c.Body(), &rank); err != nil {
+	var request DeleteRankRequestJson
+	if err := json.Unmarshal(c.Body(), &request); err != nil {
 		return c.SendStatus(fiber.StatusBadRequest)
 	}
 
-	// Check if rank exists
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return delete_rank(tx, request.RankName, request.RemoveRankFromUsers)
+	})
+	InvalidateRankCache()
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.SendString("rank doesn't exist!")
+	} else if errors.Is(err, ErrRankInUse) || errors.Is(err, ErrRankMissing) || errors.Is(err, ErrRankCycle) {
+		c.SendStatus(fiber.StatusBadRequest)
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		return c.SendString("failed to delete rank" + err.Error())
+	}
+	return c.SendString("sucess!")
+}
+
+// Deletes a rank, first taking it away from any accounts, invites & bot tokens that have it if
+// removeFromUsers is set. Otherwise ErrRankInUse, since they'd be left with a rank that doesn't exist.
+func delete_rank(tx *gorm.DB, rankName string, removeFromUsers bool) error {
 	existingRank := Ranks{}
-	result := db.Where("rank_name = ?", rank.RankName).First(&existingRank)
-	if result.RowsAffected != 0 {
-		// Rank exists, time to remove it!
-		if err := result.Delete(&existingRank).Error; err != nil {
-			return c.SendString("failed to delete rank" + err.Error())
+	if err := tx.Where("rank_name = ?", rankName).First(&existingRank).Error; err != nil {
+		return err
+	}
+	// Make sure no other rank still needs it
+	if err := CheckRankGraphChange(nil, []string{existingRank.RankName}); err != nil {
+		return err
+	}
+
+	accounts, err := accounts_with_rank(tx, rankName)
+	if err != nil {
+		return err
+	}
+	tokens, err := bot_tokens_with_rank(tx, rankName)
+	if err != nil {
+		return err
+	}
+	var invites int64
+	if err := tx.Model(&Invites{}).Where("rank = ?", rankName).Count(&invites).Error; err != nil {
+		return err
+	}
+
+	if !removeFromUsers && (len(accounts) > 0 || len(tokens) > 0 || invites > 0) {
+		return fmt.Errorf("%w by %d accounts, %d bot tokens & %d invites, set RemoveRankFromUsers to take it away", ErrRankInUse, len(accounts), len(tokens), invites)
+	}
+	for _, account := range accounts {
+		var ranks []string
+		json.Unmarshal([]byte(account.Ranks), &ranks)
+		if err := SetAccountRanks(tx, &account, slices.DeleteFunc(ranks, func(r string) bool { return r == rankName })); err != nil {
+			return err
 		}
-		return c.SendString("sucess!")
-	} else {
-		return c.SendString("rank doesn't exist!")
 	}
+	for _, token := range tokens {
+		var permissions []string
+		json.Unmarshal([]byte(token.Permissions), &permissions)
+		permissionsJSON, _ := json.Marshal(slices.DeleteFunc(permissions, func(p string) bool { return p == rankName }))
+		if err := tx.Model(&BotTokens{}).Where("id = ?", token.ID).UpdateColumn("permissions", string(permissionsJSON)).Error; err != nil {
+			return err
+		}
+	}
+	// An invite for a rank that's gone can't be used anymore
+	if err := tx.Where("rank = ?", rankName).Delete(&Invites{}).Error; err != nil {
+		return err
+	}
+
+	// Time to remove it!
+	return tx.Delete(&existingRank).Error
 }
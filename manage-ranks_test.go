@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// json.Marshal escapes & < >, so these are stored differently to how they're named
+func TestRankWithEscapedNameIsRenamedAndDeleted(t *testing.T) {
+	setup_test_ranks(t)
+	if err := db.AutoMigrate(&Accounts{}, &BotTokens{}, &Invites{}, &RankChanges{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Create(&Ranks{RankStrength: 4242, RankName: "Q&A", ParentRanks: `[]`, SubtractiveRanks: `[]`}).Error; err != nil {
+		t.Fatal(err)
+	}
+	InvalidateRankCache()
+	ranksJSON, _ := json.Marshal([]string{"Member", "Q&A"})
+	account := Accounts{Username: "someone", Ranks: string(ranksJSON)}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := BotTokens{AccountId: account.ID, TokenHash: "hash", Permissions: string(ranksJSON)}
+	if err := db.Create(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	holders := func() ([]string, []string) {
+		db.First(&account, account.ID)
+		db.First(&token, token.ID)
+		var ranks, permissions []string
+		json.Unmarshal([]byte(account.Ranks), &ranks)
+		json.Unmarshal([]byte(token.Permissions), &permissions)
+		return ranks, permissions
+	}
+
+	newName := "Help & Support"
+	err := db.Transaction(func(tx *gorm.DB) error {
+		return modify_rank(tx, ModifyRankRequestJson{RankName: "Q&A", NewRankName: &newName})
+	})
+	InvalidateRankCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranks, permissions := holders()
+	if !slices.Contains(ranks, newName) || !slices.Contains(permissions, newName) {
+		t.Fatalf("rename missed the holders: account has %v, bot token has %v", ranks, permissions)
+	}
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return delete_rank(tx, newName, false)
+	})
+	if err == nil {
+		t.Fatal("rank was deleted while still held")
+	}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return delete_rank(tx, newName, true)
+	})
+	InvalidateRankCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranks, permissions = holders()
+	if slices.Contains(ranks, newName) || slices.Contains(permissions, newName) {
+		t.Fatalf("delete missed the holders: account has %v, bot token has %v", ranks, permissions)
+	}
+}
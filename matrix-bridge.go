@@ -0,0 +1,682 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type MatrixBridgedMessages struct {
+	ID        uint   `gorm:"primaryKey"`
+	MessageId uint   `gorm:"uniqueIndex"` // The scratchcord side
+	EventId   string `gorm:"index"`
+	RoomId    string
+	SenderId  string // Edits & redactions have to come from the same matrix user
+}
+
+// The matrix users we puppet for scratchcord accounts
+type MatrixPuppets struct {
+	AccountId   uint `gorm:"primaryKey"`
+	UserId      string
+	DisplayName string // What we last set, so we know when to update it
+	Avatar      string // The scratchcord avatar url we last uploaded
+}
+
+// Everything the bridge needs from the homeserver. The real one talks to the
+// client-server API as an application service, but a local stand-in works too.
+type MatrixClient interface {
+	RegisterPuppet(localpart string) error
+	SetDisplayName(userId string, displayName string) error
+	SetAvatarURL(userId string, mxc string) error
+	UploadMedia(contentType string, data []byte) (string, error)
+	JoinRoom(userId string, roomId string) error
+	SendMessage(userId string, roomId string, content map[string]interface{}) (string, error)
+	Redact(userId string, roomId string, eventId string) error
+	GetProfile(userId string) (MatrixProfile, error)
+}
+
+type MatrixProfile struct {
+	DisplayName string `json:"displayname"`
+	AvatarURL   string `json:"avatar_url"`
+}
+
+type MatrixEvent struct {
+	EventId string                 `json:"event_id"`
+	RoomId  string                 `json:"room_id"`
+	Sender  string                 `json:"sender"`
+	Type    string                 `json:"type"`
+	Redacts string                 `json:"redacts"`
+	Content map[string]interface{} `json:"content"`
+}
+
+type MatrixTransaction struct {
+	Events []MatrixEvent `json:"events"`
+}
+
+type MatrixBridge struct {
+	client        MatrixClient
+	homeserverUrl string
+	serverName    string
+	puppetPrefix  string
+	botLocalpart  string
+	// Scratchcord channel -> room id, and the other way around
+	toMatrix      map[string]string
+	toScratchcord map[string]string
+
+	mutex            sync.Mutex
+	joinedRooms      map[string]bool // "user id|room id"
+	transactions     map[string]bool
+	transactionOrder []string // The last matrix_max_transactions ids, oldest gets forgotten first
+	transactionNext  int
+	profiles         map[string]MatrixProfile
+}
+
+// Homeservers only retry recent transactions, so this many is plenty to remember
+const matrix_max_transactions = 1000
+
+var (
+	matrix_homeserver_url string = os.Getenv("SCRATCHCORD_MATRIX_HOMESERVER_URL") // Example: http://127.0.0.1:8008
+	matrix_server_name    string = os.Getenv("SCRATCHCORD_MATRIX_SERVER_NAME")    // Example: example.com
+	matrix_as_token       string = os.Getenv("SCRATCHCORD_MATRIX_AS_TOKEN")
+	matrix_hs_token       string = os.Getenv("SCRATCHCORD_MATRIX_HS_TOKEN")
+	matrix_rooms          string = os.Getenv("SCRATCHCORD_MATRIX_ROOMS") // Example: general=!abcdef:example.com,random=!ghijkl:example.com
+	matrix_puppet_prefix  string = os.Getenv("SCRATCHCORD_MATRIX_PUPPET_PREFIX")
+	matrix_bot_localpart  string = os.Getenv("SCRATCHCORD_MATRIX_BOT_LOCALPART")
+	matrixBridge          *MatrixBridge
+)
+
+// Parses "channel=!room:server,channel=!room:server"
+func ParseMatrixRooms(mapping string) (map[string]string, error) {
+	rooms := make(map[string]string)
+	for _, pair := range strings.Split(mapping, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		channel, roomId, found := strings.Cut(pair, "=")
+		if !found || channel == "" || !strings.HasPrefix(roomId, "!") {
+			return nil, fmt.Errorf("invalid matrix room mapping: %q", pair)
+		}
+		rooms[channel] = roomId
+	}
+	return rooms, nil
+}
+
+func NewMatrixBridge(client MatrixClient, homeserverUrl string, serverName string, puppetPrefix string, botLocalpart string, rooms map[string]string) *MatrixBridge {
+	bridge := &MatrixBridge{
+		client:           client,
+		homeserverUrl:    strings.TrimSuffix(homeserverUrl, "/"),
+		serverName:       serverName,
+		puppetPrefix:     puppetPrefix,
+		botLocalpart:     botLocalpart,
+		toMatrix:         rooms,
+		toScratchcord:    make(map[string]string),
+		joinedRooms:      make(map[string]bool),
+		transactions:     make(map[string]bool),
+		transactionOrder: make([]string, 0, matrix_max_transactions),
+		profiles:         make(map[string]MatrixProfile),
+	}
+	for channel, roomId := range rooms {
+		bridge.toScratchcord[roomId] = channel
+	}
+	return bridge
+}
+
+func start_matrix_bridge(app *fiber.App) {
+	if matrix_homeserver_url == "" {
+		return
+	}
+	if matrix_as_token == "" || matrix_hs_token == "" || matrix_server_name == "" {
+		log.Fatal("the matrix bridge needs SCRATCHCORD_MATRIX_AS_TOKEN, SCRATCHCORD_MATRIX_HS_TOKEN and SCRATCHCORD_MATRIX_SERVER_NAME")
+	}
+	rooms, err := ParseMatrixRooms(matrix_rooms)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if matrix_puppet_prefix == "" {
+		matrix_puppet_prefix = "scratchcord_"
+	}
+	if matrix_bot_localpart == "" {
+		matrix_bot_localpart = "scratchcord"
+	}
+
+	client := NewMatrixAppserviceClient(matrix_homeserver_url, matrix_as_token)
+	matrixBridge = NewMatrixBridge(client, matrix_homeserver_url, matrix_server_name, matrix_puppet_prefix, matrix_bot_localpart, rooms)
+
+	// The homeserver pushes events to us here
+	app.Put("/_matrix/app/v1/transactions/:txnId", MatrixTransactionAPI)
+	app.Put("/transactions/:txnId", MatrixTransactionAPI) // Older homeservers
+	app.Get("/_matrix/app/v1/users/:userId", MatrixUserQueryAPI)
+	app.Get("/_matrix/app/v1/rooms/:alias", MatrixRoomQueryAPI)
+
+	matrixBridge.Start()
+}
+
+func (b *MatrixBridge) Start() {
+	// The bot sends system messages, so it needs to be in every room
+	for _, roomId := range b.toMatrix {
+		if err := b.client.JoinRoom(b.BotUserId(), roomId); err != nil {
+			log.Printf("matrix bot failed to join %s: %v", roomId, err)
+		}
+	}
+
+	go func() {
+		eventChannel := BroadcastPublisher.Subscribe()
+		for msg := range eventChannel {
+			b.HandleScratchcordEvent(msg)
+		}
+	}()
+}
+
+func (b *MatrixBridge) BotUserId() string {
+	return "@" + b.botLocalpart + ":" + b.serverName
+}
+
+func (b *MatrixBridge) PuppetLocalpart(accountId uint) string {
+	return b.puppetPrefix + strconv.FormatUint(uint64(accountId), 10)
+}
+
+func (b *MatrixBridge) PuppetUserId(accountId uint) string {
+	return "@" + b.PuppetLocalpart(accountId) + ":" + b.serverName
+}
+
+// Checks if a matrix user is one of ours, so their messages don't get bridged back
+func (b *MatrixBridge) IsBridgeUser(userId string) bool {
+	return userId == b.BotUserId() || (strings.HasPrefix(userId, "@"+b.puppetPrefix) && strings.HasSuffix(userId, ":"+b.serverName))
+}
+
+// Turns mxc://server/id into something scratch clients can load
+func (b *MatrixBridge) MxcToHTTP(mxc string) string {
+	serverAndId, found := strings.CutPrefix(mxc, "mxc://")
+	if !found {
+		return ""
+	}
+	return b.homeserverUrl + "/_matrix/media/v3/download/" + serverAndId
+}
+
+// Makes sure the account has a puppet with an up to date name & avatar
+func (b *MatrixBridge) EnsurePuppet(account Accounts) (string, error) {
+	puppet := MatrixPuppets{}
+	result := db.First(&puppet, "account_id = ?", account.ID)
+	if result.RowsAffected == 0 {
+		// Registering an existing user fails, which is fine
+		if err := b.client.RegisterPuppet(b.PuppetLocalpart(account.ID)); err != nil {
+			log.Printf("matrix puppet registration for %d: %v", account.ID, err)
+		}
+		puppet = MatrixPuppets{
+			AccountId: account.ID,
+			UserId:    b.PuppetUserId(account.ID),
+		}
+	}
+
+	if puppet.DisplayName != account.Username {
+		if err := b.client.SetDisplayName(puppet.UserId, account.Username); err != nil {
+			return "", err
+		}
+		puppet.DisplayName = account.Username
+	}
+	if puppet.Avatar != account.Avatar {
+		if err := b.SyncPuppetAvatar(puppet.UserId, account.Avatar); err != nil {
+			log.Printf("failed to sync matrix avatar for %d: %v", account.ID, err)
+		} else {
+			puppet.Avatar = account.Avatar
+		}
+	}
+	db.Save(&puppet)
+	return puppet.UserId, nil
+}
+
+// Uploads an avatar from our profile picture store to the homeserver
+func (b *MatrixBridge) SyncPuppetAvatar(userId string, avatar string) error {
+	fileName, found := strings.CutPrefix(avatar, server_url+"/uploads/profile-pictures/")
+	if !found {
+		// Not one of ours (like the default admin avatar), so there's nothing to upload
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(upload_directory, "profile-pictures", filepath.Base(fileName)))
+	if err != nil {
+		return err
+	}
+	mxc, err := b.client.UploadMedia("image/webp", data)
+	if err != nil {
+		return err
+	}
+	return b.client.SetAvatarURL(userId, mxc)
+}
+
+func (b *MatrixBridge) EnsureJoined(userId string, roomId string) error {
+	key := userId + "|" + roomId
+	b.mutex.Lock()
+	joined := b.joinedRooms[key]
+	b.mutex.Unlock()
+	if joined {
+		return nil
+	}
+	if err := b.client.JoinRoom(userId, roomId); err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	b.joinedRooms[key] = true
+	b.mutex.Unlock()
+	return nil
+}
+
+func (b *MatrixBridge) HandleScratchcordEvent(msg BroadcastDBMessage) {
+	// Messages bridged from matrix came from there in the first place, only deletes go back
+	if msg.data.Type == 7 && msg.data.BridgedFrom == "matrix" && msg.event != "message_deleted" {
+		return
+	}
+	roomId, ok := b.toMatrix[msg.data.Channel]
+	if !ok {
+		return
+	}
+
+	switch msg.event {
+	case "new_message":
+		userId, content, ok := b.BuildMatrixMessage(msg.data)
+		if !ok {
+			return
+		}
+		if err := b.EnsureJoined(userId, roomId); err != nil {
+			log.Printf("matrix user %s failed to join %s: %v", userId, roomId, err)
+			return
+		}
+		eventId, err := b.client.SendMessage(userId, roomId, content)
+		if err != nil {
+			log.Println("failed to bridge message to matrix:", err)
+			return
+		}
+		db.Create(&MatrixBridgedMessages{
+			MessageId: msg.data.ID,
+			EventId:   eventId,
+			RoomId:    roomId,
+			SenderId:  userId,
+		})
+	case "message_updated":
+		bridged := MatrixBridgedMessages{}
+		if err := db.First(&bridged, "message_id = ?", msg.data.ID).Error; err != nil {
+			return
+		}
+		_, content, ok := b.BuildMatrixMessage(msg.data)
+		if !ok {
+			return
+		}
+		// Edits are a new event that replaces the old one
+		edit := map[string]interface{}{
+			"msgtype":       content["msgtype"],
+			"body":          "* " + content["body"].(string),
+			"m.new_content": content,
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.replace",
+				"event_id": bridged.EventId,
+			},
+		}
+		if _, err := b.client.SendMessage(bridged.SenderId, bridged.RoomId, edit); err != nil {
+			log.Println("failed to edit bridged matrix message:", err)
+		}
+	case "message_deleted":
+		bridged := MatrixBridgedMessages{}
+		if err := db.First(&bridged, "message_id = ?", msg.data.ID).Error; err != nil {
+			return
+		}
+		if err := b.client.Redact(bridged.SenderId, bridged.RoomId, bridged.EventId); err != nil {
+			log.Println("failed to redact bridged matrix message:", err)
+		}
+		db.Delete(&bridged)
+	}
+}
+
+// Works out who should send a scratchcord message on matrix, and what it looks like
+func (b *MatrixBridge) BuildMatrixMessage(message Messages) (string, map[string]interface{}, bool) {
+	switch message.Type {
+	case 1, 5, 2:
+		account := Accounts{}
+		if err := db.First(&account, "id = ?", message.UserId).Error; err != nil {
+			return "", nil, false
+		}
+		userId, err := b.EnsurePuppet(account)
+		if err != nil {
+			log.Printf("failed to set up matrix puppet for %d: %v", account.ID, err)
+			return "", nil, false
+		}
+		if message.Type == 2 {
+			return userId, map[string]interface{}{"msgtype": "m.emote", "body": "sent a nudge!"}, true
+		}
+		return userId, map[string]interface{}{"msgtype": "m.text", "body": message.Message}, true
+	case 7:
+		// From another bridge, so the bot relays it
+		return b.BotUserId(), map[string]interface{}{"msgtype": "m.text", "body": message.BridgedUsername + ": " + message.Message}, true
+	case 100, 101, 102, 103:
+		account := Accounts{}
+		db.First(&account, "id = ?", message.UserId)
+		return b.BotUserId(), map[string]interface{}{"msgtype": "m.notice", "body": account.Username + ": " + message.Message}, true
+	}
+	return "", nil, false
+}
+
+// Gets the name & avatar of a matrix user, cached since every message needs it
+func (b *MatrixBridge) Profile(userId string) MatrixProfile {
+	b.mutex.Lock()
+	profile, ok := b.profiles[userId]
+	b.mutex.Unlock()
+	if ok {
+		return profile
+	}
+
+	profile, err := b.client.GetProfile(userId)
+	if err != nil || profile.DisplayName == "" {
+		// Fall back to the localpart
+		profile.DisplayName = strings.TrimPrefix(strings.SplitN(userId, ":", 2)[0], "@")
+	}
+	b.mutex.Lock()
+	b.profiles[userId] = profile
+	b.mutex.Unlock()
+	return profile
+}
+
+// Matrix messages can be files, those get sent as links
+func (b *MatrixBridge) MatrixMessageBody(content map[string]interface{}) string {
+	body, _ := content["body"].(string)
+	if mxc, ok := content["url"].(string); ok {
+		if link := b.MxcToHTTP(mxc); link != "" {
+			body = body + " " + link
+		}
+	}
+	if msgtype, _ := content["msgtype"].(string); msgtype == "m.emote" {
+		body = "*" + body + "*"
+	}
+	return body
+}
+
+func (b *MatrixBridge) HandleMatrixEvent(event MatrixEvent) {
+	channel, ok := b.toScratchcord[event.RoomId]
+	if !ok || b.IsBridgeUser(event.Sender) {
+		return
+	}
+
+	switch event.Type {
+	case "m.room.message":
+		// Edits
+		if relatesTo, ok := event.Content["m.relates_to"].(map[string]interface{}); ok && relatesTo["rel_type"] == "m.replace" {
+			originalId, _ := relatesTo["event_id"].(string)
+			newContent, ok := event.Content["m.new_content"].(map[string]interface{})
+			if !ok {
+				return
+			}
+			bridged := MatrixBridgedMessages{}
+			if err := db.First(&bridged, "event_id = ? AND sender_id = ?", originalId, event.Sender).Error; err != nil {
+				return
+			}
+			db_msg := Messages{}
+			if err := db.First(&db_msg, "id = ? AND type = ?", bridged.MessageId, 7).Error; err != nil {
+				return
+			}
+			db_msg.Message = b.MatrixMessageBody(newContent)
+			db.Save(&db_msg)
+			return
+		}
+
+		profile := b.Profile(event.Sender)
+		db_msg := Messages{
+			Message:         b.MatrixMessageBody(event.Content),
+			UserId:          0,
+			Type:            7,
+			Channel:         channel,
+			Timestamp:       uint64(time.Now().Unix()),
+			BridgedUsername: profile.DisplayName,
+			BridgedAvatar:   b.MxcToHTTP(profile.AvatarURL),
+			BridgedFrom:     "matrix",
+		}
+		if err := db.Create(&db_msg).Error; err != nil {
+			log.Println("failed to store bridged matrix message:", err)
+			return
+		}
+		db.Create(&MatrixBridgedMessages{
+			MessageId: db_msg.ID,
+			EventId:   event.EventId,
+			RoomId:    event.RoomId,
+			SenderId:  event.Sender,
+		})
+	case "m.room.redaction":
+		// Newer room versions put this in the content
+		redacts := event.Redacts
+		if redacts == "" {
+			redacts, _ = event.Content["redacts"].(string)
+		}
+		bridged := MatrixBridgedMessages{}
+		if err := db.First(&bridged, "event_id = ?", redacts).Error; err != nil {
+			return
+		}
+		// The link goes first, so we don't try to redact it again
+		db.Delete(&bridged)
+		db_msg := Messages{}
+		if err := db.First(&db_msg, "id = ?", bridged.MessageId).Error; err == nil {
+			db.Delete(&db_msg)
+		}
+	case "m.room.member":
+		// Forget cached names when people change them
+		b.mutex.Lock()
+		delete(b.profiles, event.Sender)
+		b.mutex.Unlock()
+	}
+}
+
+// Remembers a transaction id, and says if it was already handled
+func (b *MatrixBridge) SeenTransaction(txnId string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.transactions[txnId] {
+		return true
+	}
+	if len(b.transactionOrder) < matrix_max_transactions {
+		b.transactionOrder = append(b.transactionOrder, txnId)
+	} else {
+		delete(b.transactions, b.transactionOrder[b.transactionNext])
+		b.transactionOrder[b.transactionNext] = txnId
+		b.transactionNext = (b.transactionNext + 1) % matrix_max_transactions
+	}
+	b.transactions[txnId] = true
+	return false
+}
+
+// Checks the homeserver's token on requests it makes to us
+func CheckMatrixHomeserverToken(c *fiber.Ctx) bool {
+	token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = c.Query("access_token")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(matrix_hs_token)) == 1
+}
+
+func MatrixTransactionAPI(c *fiber.Ctx) error {
+	if !CheckMatrixHomeserverToken(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"errcode": "M_FORBIDDEN"})
+	}
+
+	// The homeserver retries transactions until we say OK, so only handle each one once
+	if matrixBridge.SeenTransaction(c.Params("txnId")) {
+		return c.JSON(fiber.Map{})
+	}
+
+	transaction := MatrixTransaction{}
+	if err := json.Unmarshal(c.Body(), &transaction); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"errcode": "M_NOT_JSON"})
+	}
+	for _, event := range transaction.Events {
+		matrixBridge.HandleMatrixEvent(event)
+	}
+	return c.JSON(fiber.Map{})
+}
+
+// The homeserver asks about users in our namespace, we only have the ones for existing accounts
+func MatrixUserQueryAPI(c *fiber.Ctx) error {
+	if !CheckMatrixHomeserverToken(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"errcode": "M_FORBIDDEN"})
+	}
+	userId, _ := url.PathUnescape(c.Params("userId"))
+	localpart := strings.TrimPrefix(strings.SplitN(userId, ":", 2)[0], "@")
+	accountId, found := strings.CutPrefix(localpart, matrixBridge.puppetPrefix)
+	if !found {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"errcode": "M_NOT_FOUND"})
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", accountId).Error; err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"errcode": "M_NOT_FOUND"})
+	}
+	if _, err := matrixBridge.EnsurePuppet(account); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"errcode": "M_UNKNOWN"})
+	}
+	return c.JSON(fiber.Map{})
+}
+
+// Rooms are mapped by hand, so we never create them from aliases
+func MatrixRoomQueryAPI(c *fiber.Ctx) error {
+	if !CheckMatrixHomeserverToken(c) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"errcode": "M_FORBIDDEN"})
+	}
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"errcode": "M_NOT_FOUND"})
+}
+
+// Talks to a homeserver's client-server API as an application service
+type MatrixAppserviceClient struct {
+	homeserverUrl string
+	asToken       string
+	httpClient    *http.Client
+}
+
+func NewMatrixAppserviceClient(homeserverUrl string, asToken string) *MatrixAppserviceClient {
+	return &MatrixAppserviceClient{
+		homeserverUrl: strings.TrimSuffix(homeserverUrl, "/"),
+		asToken:       asToken,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Makes a request, as userId if it's set (that's how appservices puppet users)
+func (m *MatrixAppserviceClient) request(method string, path string, userId string, contentType string, body []byte) ([]byte, error) {
+	requestUrl := m.homeserverUrl + path
+	if userId != "" {
+		separator := "?"
+		if strings.Contains(path, "?") {
+			separator = "&"
+		}
+		requestUrl += separator + "user_id=" + url.QueryEscape(userId)
+	}
+
+	req, err := http.NewRequest(method, requestUrl, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.asToken)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	res, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return resBody, fmt.Errorf("homeserver responded with %d: %s", res.StatusCode, string(resBody))
+	}
+	return resBody, nil
+}
+
+func (m *MatrixAppserviceClient) requestJSON(method string, path string, userId string, body interface{}) ([]byte, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return m.request(method, path, userId, "application/json", payload)
+}
+
+func (m *MatrixAppserviceClient) RegisterPuppet(localpart string) error {
+	body := map[string]interface{}{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}
+	res, err := m.requestJSON("POST", "/_matrix/client/v3/register", "", body)
+	if err != nil && strings.Contains(string(res), "M_USER_IN_USE") {
+		return nil
+	}
+	return err
+}
+
+func (m *MatrixAppserviceClient) SetDisplayName(userId string, displayName string) error {
+	_, err := m.requestJSON("PUT", "/_matrix/client/v3/profile/"+url.PathEscape(userId)+"/displayname", userId, map[string]string{"displayname": displayName})
+	return err
+}
+
+func (m *MatrixAppserviceClient) SetAvatarURL(userId string, mxc string) error {
+	_, err := m.requestJSON("PUT", "/_matrix/client/v3/profile/"+url.PathEscape(userId)+"/avatar_url", userId, map[string]string{"avatar_url": mxc})
+	return err
+}
+
+func (m *MatrixAppserviceClient) UploadMedia(contentType string, data []byte) (string, error) {
+	res, err := m.request("POST", "/_matrix/media/v3/upload", "", contentType, data)
+	if err != nil {
+		return "", err
+	}
+	upload := struct {
+		ContentURI string `json:"content_uri"`
+	}{}
+	if err := json.Unmarshal(res, &upload); err != nil {
+		return "", err
+	}
+	return upload.ContentURI, nil
+}
+
+func (m *MatrixAppserviceClient) JoinRoom(userId string, roomId string) error {
+	_, err := m.requestJSON("POST", "/_matrix/client/v3/join/"+url.PathEscape(roomId), userId, map[string]string{})
+	return err
+}
+
+func (m *MatrixAppserviceClient) SendMessage(userId string, roomId string, content map[string]interface{}) (string, error) {
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomId) + "/send/m.room.message/" + uuid.NewString()
+	res, err := m.requestJSON("PUT", path, userId, content)
+	if err != nil {
+		return "", err
+	}
+	sent := struct {
+		EventId string `json:"event_id"`
+	}{}
+	if err := json.Unmarshal(res, &sent); err != nil {
+		return "", err
+	}
+	return sent.EventId, nil
+}
+
+func (m *MatrixAppserviceClient) Redact(userId string, roomId string, eventId string) error {
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomId) + "/redact/" + url.PathEscape(eventId) + "/" + uuid.NewString()
+	_, err := m.requestJSON("PUT", path, userId, map[string]string{})
+	return err
+}
+
+func (m *MatrixAppserviceClient) GetProfile(userId string) (MatrixProfile, error) {
+	profile := MatrixProfile{}
+	res, err := m.request("GET", "/_matrix/client/v3/profile/"+url.PathEscape(userId), "", "", nil)
+	if err != nil {
+		return profile, err
+	}
+	err = json.Unmarshal(res, &profile)
+	return profile, err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Stands in for the homeserver, remembering what the bridge did
+type fakeMatrixClient struct {
+	registered []string
+	names      map[string]string
+	sent       []string // "user id|room id|body"
+}
+
+func (f *fakeMatrixClient) RegisterPuppet(localpart string) error {
+	f.registered = append(f.registered, localpart)
+	return nil
+}
+
+func (f *fakeMatrixClient) SetDisplayName(userId string, displayName string) error {
+	f.names[userId] = displayName
+	return nil
+}
+
+func (f *fakeMatrixClient) SetAvatarURL(userId string, mxc string) error {
+	return nil
+}
+
+func (f *fakeMatrixClient) UploadMedia(contentType string, data []byte) (string, error) {
+	return "mxc://example.com/avatar", nil
+}
+
+func (f *fakeMatrixClient) JoinRoom(userId string, roomId string) error {
+	return nil
+}
+
+func (f *fakeMatrixClient) SendMessage(userId string, roomId string, content map[string]interface{}) (string, error) {
+	body, _ := content["body"].(string)
+	f.sent = append(f.sent, userId+"|"+roomId+"|"+body)
+	return fmt.Sprintf("$event%d", len(f.sent)), nil
+}
+
+func (f *fakeMatrixClient) Redact(userId string, roomId string, eventId string) error {
+	return nil
+}
+
+func (f *fakeMatrixClient) GetProfile(userId string) (MatrixProfile, error) {
+	return MatrixProfile{DisplayName: "Someone on matrix"}, nil
+}
+
+func setup_test_matrix(t *testing.T) (*fakeMatrixClient, *fiber.App) {
+	setup_test_db(t, &Messages{}, &Accounts{}, &MatrixBridgedMessages{}, &MatrixPuppets{})
+	client := &fakeMatrixClient{names: make(map[string]string)}
+	matrixBridge = NewMatrixBridge(client, "http://127.0.0.1:8008", "example.com", "scratchcord_", "scratchcord", map[string]string{"general": "!general:example.com"})
+	t.Cleanup(func() { matrixBridge = nil })
+
+	previousToken := matrix_hs_token
+	matrix_hs_token = "homeserver token"
+	t.Cleanup(func() { matrix_hs_token = previousToken })
+
+	app := fiber.New()
+	app.Put("/_matrix/app/v1/transactions/:txnId", MatrixTransactionAPI)
+	return client, app
+}
+
+func put_test_transaction(t *testing.T, app *fiber.App, txnId string, token string, events ...MatrixEvent) int {
+	body := `{"events": [`
+	for i, event := range events {
+		if i > 0 {
+			body += ","
+		}
+		body += fmt.Sprintf(`{"event_id": %q, "room_id": %q, "sender": %q, "type": "m.room.message", "content": {"msgtype": "m.text", "body": "hi"}}`, event.EventId, event.RoomId, event.Sender)
+	}
+	body += `]}`
+	req := httptest.NewRequest("PUT", "/_matrix/app/v1/transactions/"+txnId, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode
+}
+
+func count_test_messages() int64 {
+	var count int64
+	db.Model(&Messages{}).Count(&count)
+	return count
+}
+
+func TestMatrixTransactions(t *testing.T) {
+	_, app := setup_test_matrix(t)
+	event := MatrixEvent{EventId: "$1", RoomId: "!general:example.com", Sender: "@someone:example.com"}
+
+	// Only the homeserver can push events
+	if status := put_test_transaction(t, app, "1", "", event); status != fiber.StatusForbidden {
+		t.Fatalf("transaction without a token got %d", status)
+	}
+	if status := put_test_transaction(t, app, "1", "wrong token", event); status != fiber.StatusForbidden {
+		t.Fatalf("transaction with the wrong token got %d", status)
+	}
+
+	// Retried transactions only get handled once
+	for range 2 {
+		if status := put_test_transaction(t, app, "2", "homeserver token", event); status != fiber.StatusOK {
+			t.Fatalf("transaction got %d", status)
+		}
+	}
+	if count := count_test_messages(); count != 1 {
+		t.Fatalf("expected 1 bridged message, got %d", count)
+	}
+
+	// Our own puppets & bot echo back from the homeserver, those aren't bridged again
+	put_test_transaction(t, app, "3", "homeserver token",
+		MatrixEvent{EventId: "$2", RoomId: "!general:example.com", Sender: "@scratchcord_1:example.com"},
+		MatrixEvent{EventId: "$3", RoomId: "!general:example.com", Sender: "@scratchcord:example.com"},
+	)
+	if count := count_test_messages(); count != 1 {
+		t.Fatalf("the bridge's own messages were bridged back, %d messages", count)
+	}
+}
+
+func TestMatrixTransactionsAreBounded(t *testing.T) {
+	setup_test_matrix(t)
+	for i := range matrix_max_transactions + 10 {
+		matrixBridge.SeenTransaction(fmt.Sprint(i))
+	}
+	if len(matrixBridge.transactions) != matrix_max_transactions {
+		t.Fatalf("expected %d remembered transactions, got %d", matrix_max_transactions, len(matrixBridge.transactions))
+	}
+	if !matrixBridge.SeenTransaction(fmt.Sprint(matrix_max_transactions + 9)) {
+		t.Fatal("a recent transaction was forgotten")
+	}
+	if matrixBridge.SeenTransaction("0") {
+		t.Fatal("the oldest transaction wasn't forgotten")
+	}
+}
+
+func TestMatrixPuppets(t *testing.T) {
+	client, _ := setup_test_matrix(t)
+	account := Accounts{Username: "someone", Ranks: `[]`}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// The first message makes the account a puppet, the second reuses it
+	for i, text := range []string{"hello", "again"} {
+		message := Messages{Type: 1, UserId: account.ID, Channel: "general", Message: text}
+		message.ID = uint(i + 1)
+		matrixBridge.HandleScratchcordEvent(BroadcastDBMessage{event: "new_message", data: message})
+	}
+	puppet := fmt.Sprintf("@scratchcord_%d:example.com", account.ID)
+	if len(client.registered) != 1 || client.names[puppet] != "someone" {
+		t.Fatalf("puppet wasn't set up once: registered %v, names %v", client.registered, client.names)
+	}
+	expected := []string{puppet + "|!general:example.com|hello", puppet + "|!general:example.com|again"}
+	if strings.Join(client.sent, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected %v, got %v", expected, client.sent)
+	}
+
+	// Messages that came from matrix don't go back
+	bridged := Messages{Type: 7, Channel: "general", BridgedFrom: "matrix"}
+	bridged.ID = 3
+	matrixBridge.HandleScratchcordEvent(BroadcastDBMessage{event: "new_message", data: bridged})
+	if len(client.sent) != 2 {
+		t.Fatal("message from matrix was echoed back")
+	}
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Logging in with an OpenID Connect provider (authorization code flow with PKCE).
+// Point the browser at /oidc/login, and once the provider sends it back to /oidc/callback
+// it gets the same response as /login.
+
+var (
+	oidc_issuer        string = os.Getenv("SCRATCHCORD_OIDC_ISSUER")
+	oidc_client_id     string = os.Getenv("SCRATCHCORD_OIDC_CLIENT_ID")
+	oidc_client_secret string = os.Getenv("SCRATCHCORD_OIDC_CLIENT_SECRET")
+	oidc_redirect_url  string = os.Getenv("SCRATCHCORD_OIDC_REDIRECT_URL") // Defaults to SCRATCHCORD_SERVER_URL + /oidc/callback
+	oidc_scopes        string = os.Getenv("SCRATCHCORD_OIDC_SCOPES")
+	oidc_default_rank  string = os.Getenv("SCRATCHCORD_OIDC_DEFAULT_RANK")
+	oidc_groups_claim  string = os.Getenv("SCRATCHCORD_OIDC_GROUPS_CLAIM")
+	oidc_group_ranks   string = os.Getenv("SCRATCHCORD_OIDC_GROUP_RANKS") // "group=Rank,other group=Other Rank"
+	OIDC               *OIDCProvider
+)
+
+const (
+	oidc_login_timeout = 10 * time.Minute
+	oidc_http_timeout  = 10 * time.Second
+)
+
+// Links a provider's user to an account
+type OidcIdentities struct {
+	gorm.Model
+	Issuer    string `gorm:"uniqueIndex:idx_oidc_subject"`
+	Subject   string `gorm:"uniqueIndex:idx_oidc_subject"`
+	AccountId uint   `gorm:"index"`
+}
+
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type OIDCTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IdToken     string `json:"id_token"`
+	Error       string `json:"error"`
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// A login that's waiting for the provider to send the user back
+type OIDCPendingLogin struct {
+	Verifier      string
+	Nonce         string
+	ClientVersion string
+	Expires       time.Time
+}
+
+type OIDCProvider struct {
+	Discovery   OIDCDiscovery
+	ClientId    string
+	Secret      string
+	Redirect    string
+	Scopes      string
+	DefaultRank string
+	GroupsClaim string
+	GroupRanks  map[string]string
+
+	client *http.Client
+
+	mutex   sync.Mutex
+	keys    map[string]interface{}
+	pending map[string]OIDCPendingLogin // state -> login
+}
+
+func ParseOIDCGroupRanks(config string) map[string]string {
+	groupRanks := make(map[string]string)
+	for _, pair := range strings.Split(config, ",") {
+		group, rank, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		groupRanks[strings.TrimSpace(group)] = strings.TrimSpace(rank)
+	}
+	return groupRanks
+}
+
+// Whether the OpenID Connect settings name a rank, so renaming it would leave them pointing at nothing.
+// This goes by the settings even when OpenID Connect is off, in case it gets turned on later.
+func OIDCConfigUsesRank(rankName string) bool {
+	if rankName == oidc_default_rank {
+		return true
+	}
+	for _, rank := range ParseOIDCGroupRanks(oidc_group_ranks) {
+		if rank == rankName {
+			return true
+		}
+	}
+	return false
+}
+
+func NewOIDCProvider(issuer string, clientId string) (*OIDCProvider, error) {
+	p := &OIDCProvider{
+		ClientId:    clientId,
+		Secret:      oidc_client_secret,
+		Redirect:    oidc_redirect_url,
+		Scopes:      oidc_scopes,
+		DefaultRank: oidc_default_rank,
+		GroupsClaim: oidc_groups_claim,
+		GroupRanks:  ParseOIDCGroupRanks(oidc_group_ranks),
+		client:      &http.Client{Timeout: oidc_http_timeout},
+		keys:        make(map[string]interface{}),
+		pending:     make(map[string]OIDCPendingLogin),
+	}
+	if p.Redirect == "" {
+		p.Redirect = server_url + "/oidc/callback"
+	}
+	if p.Scopes == "" {
+		p.Scopes = "openid profile"
+	}
+	if p.DefaultRank == "" {
+		p.DefaultRank = "Member"
+	}
+	if p.GroupsClaim == "" {
+		p.GroupsClaim = "groups"
+	}
+
+	res, err := p.client.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("openid configuration returned %d", res.StatusCode)
+	}
+	if err := json.NewDecoder(res.Body).Decode(&p.Discovery); err != nil {
+		return nil, err
+	}
+	if p.Discovery.Issuer != issuer {
+		return nil, fmt.Errorf("issuer mismatch: expected %s, got %s", issuer, p.Discovery.Issuer)
+	}
+	return p, nil
+}
+
+func RandomURLString(length int) (string, error) {
+	raw := make([]byte, length)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Starts a login, returning where to send the browser
+func (p *OIDCProvider) StartLogin(clientVersion string) (string, error) {
+	state, err := RandomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	nonce, err := RandomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := RandomURLString(48)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	p.mutex.Lock()
+	// Clean up logins nobody finished
+	for oldState, login := range p.pending {
+		if time.Now().After(login.Expires) {
+			delete(p.pending, oldState)
+		}
+	}
+	p.pending[state] = OIDCPendingLogin{
+		Verifier:      verifier,
+		Nonce:         nonce,
+		ClientVersion: clientVersion,
+		Expires:       time.Now().Add(oidc_login_timeout),
+	}
+	p.mutex.Unlock()
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.ClientId)
+	query.Set("redirect_uri", p.Redirect)
+	query.Set("scope", p.Scopes)
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.Discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return p.Discovery.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Each state can only be used once
+func (p *OIDCProvider) TakePendingLogin(state string) (OIDCPendingLogin, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	login, ok := p.pending[state]
+	delete(p.pending, state)
+	if !ok || time.Now().After(login.Expires) {
+		return login, false
+	}
+	return login, true
+}
+
+func (p *OIDCProvider) ExchangeCode(code string, verifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.Redirect)
+	form.Set("client_id", p.ClientId)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, p.Discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.Secret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.Secret))
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	tokenResponse := OIDCTokenResponse{}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", fmt.Errorf("token endpoint returned %d", res.StatusCode)
+	}
+	if tokenResponse.Error != "" {
+		return "", errors.New(tokenResponse.Error)
+	}
+	if tokenResponse.IdToken == "" {
+		return "", errors.New("no id token")
+	}
+	return tokenResponse.IdToken, nil
+}
+
+func ParseJWK(key JWK) (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch key.Kty {
+	case "RSA":
+		n, err := decode(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve: %s", key.Crv)
+		}
+		x, err := decode(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type: %s", key.Kty)
+}
+
+func (p *OIDCProvider) FetchKeys() error {
+	res, err := p.client.Get(p.Discovery.JwksURI)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&jwks); err != nil {
+		return err
+	}
+	keys := make(map[string]interface{})
+	for _, key := range jwks.Keys {
+		parsed, err := ParseJWK(key)
+		if err != nil {
+			log.Printf("skipping provider key %s: %v", key.Kid, err)
+			continue
+		}
+		keys[key.Kid] = parsed
+	}
+
+	p.mutex.Lock()
+	p.keys = keys
+	p.mutex.Unlock()
+	return nil
+}
+
+func (p *OIDCProvider) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	p.mutex.Lock()
+	key, ok := p.keys[kid]
+	p.mutex.Unlock()
+	if !ok {
+		// The provider might have rotated its keys
+		if err := p.FetchKeys(); err != nil {
+			return nil, err
+		}
+		p.mutex.Lock()
+		key, ok = p.keys[kid]
+		p.mutex.Unlock()
+		if !ok {
+			return nil, fmt.Errorf("unknown provider key: %s", kid)
+		}
+	}
+	return key, nil
+}
+
+func (p *OIDCProvider) VerifyIdToken(idToken string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, p.Keyfunc,
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(p.Discovery.Issuer),
+		jwt.WithAudience(p.ClientId),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("no subject")
+	}
+	return claims, nil
+}
+
+// Groups can be a list or a single string
+func (p *OIDCProvider) GroupsFromClaims(claims jwt.MapClaims) []string {
+	groups := []string{}
+	switch v := claims[p.GroupsClaim].(type) {
+	case string:
+		groups = append(groups, v)
+	case []interface{}:
+		for _, group := range v {
+			if s, ok := group.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	return groups
+}
+
+// Gives the account the ranks its groups map to, & takes away mapped ranks for groups it left.
+// Ranks that aren't mapped to a group are left alone.
+func (p *OIDCProvider) SyncGroupRanks(ranks []string, groups []string) []string {
+	wanted := []string{}
+	for group, rank := range p.GroupRanks {
+		if slices.Contains(groups, group) && !slices.Contains(wanted, rank) {
+			wanted = append(wanted, rank)
+		}
+	}
+	synced := []string{}
+	for _, rank := range ranks {
+		isMapped := false
+		for _, mappedRank := range p.GroupRanks {
+			if rank == mappedRank {
+				isMapped = true
+				break
+			}
+		}
+		if !isMapped || slices.Contains(wanted, rank) {
+			synced = append(synced, rank)
+		}
+	}
+	for _, rank := range wanted {
+		if !slices.Contains(synced, rank) {
+			synced = append(synced, rank)
+		}
+	}
+	return synced
+}
+
+// Picks a free username based on what the provider calls the user
+func FreeUsername(preferred string) string {
+	// Drop anything usernames can't have, & leave room for a number on the end
+	preferred = strings.Map(func(r rune) rune {
+		if IsUsernameCharacter(r) {
+			return r
+		}
+		return -1
+	}, NormalizeUsername(preferred))
+	if runes := []rune(preferred); len(runes) > username_max_length-4 {
+		preferred = string(runes[:username_max_length-4])
+	}
+	if ValidateUsername(preferred) != nil || IsUsernameReserved(preferred) || IsUsernameProtected(preferred, 0) {
+		preferred = "user"
+	}
+
+	username := preferred
+	for i := 2; ; i++ {
+		if _, err := CheckNewUsername(username, 0); err == nil {
+			return username
+		}
+		username = fmt.Sprintf("%s%d", preferred, i)
+	}
+}
+
+// Finds (or makes) the account a provider user is linked to
+func (p *OIDCProvider) LinkAccount(claims jwt.MapClaims) (Accounts, error) {
+	subject, _ := claims["sub"].(string)
+	groups := p.GroupsFromClaims(claims)
+	account := Accounts{}
+
+	identity := OidcIdentities{}
+	err := db.First(&identity, "issuer = ? AND subject = ?", p.Discovery.Issuer, subject).Error
+	if err == nil {
+		if err := db.First(&account, "id = ?", identity.AccountId).Error; err != nil {
+			return account, ErrAccountDoesNotExist
+		}
+	} else {
+		// First login, which is registering, so the registration mode applies. There's no way to
+		// pass an invite code through the provider, so invite only servers can't take new users.
+		rank, _, err := CheckRegistrationAllowed("")
+		if errors.Is(err, ErrInviteInvalid) {
+			return account, ErrInviteRequired
+		} else if err != nil {
+			return account, err
+		}
+		if rank == default_rank {
+			rank = p.DefaultRank
+		}
+
+		// Make them an account
+		preferred, _ := claims["preferred_username"].(string)
+		if preferred == "" {
+			preferred, _ = claims["name"].(string)
+		}
+		username := FreeUsername(preferred)
+		avatar, err := GenerateDefaultAvatar(username)
+		if err != nil {
+			return account, err
+		}
+		ranksJSON, _ := json.Marshal([]string{rank})
+		account = Accounts{
+			Username:    username,
+			Avatar:      avatar,
+			DateCreated: uint64(time.Now().Unix()),
+			LastLogin:   uint64(time.Now().Unix()),
+			Ranks:       string(ranksJSON),
+		}
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Create(&account).Error; err != nil {
+				return err
+			}
+			return tx.Create(&OidcIdentities{
+				Issuer:    p.Discovery.Issuer,
+				Subject:   subject,
+				AccountId: account.ID,
+			}).Error
+		})
+		if err != nil {
+			return account, err
+		}
+	}
+
+	if len(p.GroupRanks) > 0 {
+		var ranks []string
+		if err := json.Unmarshal([]byte(account.Ranks), &ranks); err != nil {
+			return account, err
+		}
+		synced := p.SyncGroupRanks(ranks, groups)
+		if !slices.Equal(synced, ranks) {
+			if err := SetAccountRanks(db, &account, synced); err != nil {
+				return account, err
+			}
+		}
+	}
+	return account, nil
+}
+
+func oidc_login(c *fiber.Ctx) error {
+	clientVersion := c.Query("client_version")
+	if !ClientVersionSupported(clientVersion) {
+		return c.SendString("client version not supported!")
+	}
+	redirect, err := OIDC.StartLogin(clientVersion)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.Redirect(redirect)
+}
+
+func oidc_callback(c *fiber.Ctx) error {
+	if providerError := c.Query("error"); providerError != "" {
+		return c.SendString("login failed: " + providerError + "!")
+	}
+	login, ok := OIDC.TakePendingLogin(c.Query("state"))
+	if !ok {
+		return c.SendString("login expired!")
+	}
+
+	idToken, err := OIDC.ExchangeCode(c.Query("code"), login.Verifier)
+	if err != nil {
+		log.Printf("oidc code exchange failed: %v", err)
+		return c.SendString("login failed!")
+	}
+	claims, err := OIDC.VerifyIdToken(idToken, login.Nonce)
+	if err != nil {
+		log.Printf("oidc id token invalid: %v", err)
+		return c.SendString("login failed!")
+	}
+
+	account, err := OIDC.LinkAccount(claims)
+	if errors.Is(err, ErrAccountDoesNotExist) || errors.Is(err, ErrRegistrationClosed) || errors.Is(err, ErrInviteRequired) {
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		log.Printf("oidc account linking failed: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	// The provider's own checks don't count as our second factor
+	ranks, err := CheckLoginAllowed(account)
+	if errors.Is(err, ErrTwoFactorRequired) {
+		return start_two_factor_login(c, account, login.ClientVersion)
+	} else if errors.Is(err, ErrLoginRestricted) || errors.Is(err, ErrPendingApproval) {
+		return c.SendString(err.Error() + "!")
+	} else if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	session, err := StartSession(c, account.ID, login.ClientVersion)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	response, err := IssueTokens(account, session, login.ClientVersion)
+	if err != nil {
+		log.Printf("token.SignedString: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	RecordLogin(&account)
+	response["avatar"] = account.Avatar
+	response["ranks"] = ranks
+	response["motd"] = motd
+	return c.JSON(response)
+}
+
+func start_oidc(app *fiber.App) {
+	if oidc_issuer == "" || oidc_client_id == "" {
+		return
+	}
+	provider, err := NewOIDCProvider(oidc_issuer, oidc_client_id)
+	if err != nil {
+		log.Fatalf("failed to set up OpenID Connect: %v", err)
+	}
+	if err := provider.FetchKeys(); err != nil {
+		log.Printf("failed to fetch OpenID Connect keys, will retry on login: %v", err)
+	}
+	OIDC = provider
+
+	app.Get("/oidc/login", oidc_login)
+	app.Get("/oidc/callback", oidc_callback)
+	log.Printf("OpenID Connect login enabled with %s", oidc_issuer)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A provider that signs whatever claims it's given, once the PKCE verifier checks out
+type mockOIDCProvider struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func new_mock_oidc_provider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockOIDCProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(OIDCDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JwksURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]JWK{"keys": {{
+			Kty: "RSA",
+			Kid: "test",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			json.NewEncoder(w).Encode(OIDCTokenResponse{Error: "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(OIDCTokenResponse{IdToken: idp.sign(t, idp.claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockOIDCProvider) sign(t *testing.T, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func setup_test_oidc(t *testing.T) (*mockOIDCProvider, *OIDCProvider) {
+	setup_test_ranks(t)
+	setup_test_avatars(t)
+	if err := db.AutoMigrate(&Accounts{}, &OidcIdentities{}, &PreviousUsernames{}, &RankChanges{}); err != nil {
+		t.Fatal(err)
+	}
+	idp := new_mock_oidc_provider(t)
+	provider, err := NewOIDCProvider(idp.server.URL, "scratchcord")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.GroupRanks = map[string]string{"supporters": "Supporter"}
+	return idp, provider
+}
+
+// Starts a login and gets the id token for it, like the browser going there and back
+func (idp *mockOIDCProvider) login(t *testing.T, provider *OIDCProvider, claims jwt.MapClaims) (string, OIDCPendingLogin) {
+	redirect, err := provider.StartLogin("SCPV11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := parsed.Query()
+	idp.challenge = query.Get("code_challenge")
+	login, ok := provider.TakePendingLogin(query.Get("state"))
+	if !ok {
+		t.Fatal("login wasn't pending")
+	}
+
+	idp.claims = jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   "scratchcord",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for claim, value := range claims {
+		idp.claims[claim] = value
+	}
+	idToken, err := provider.ExchangeCode("code", login.Verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idToken, login
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	idp, provider := setup_test_oidc(t)
+	idToken, login := idp.login(t, provider, jwt.MapClaims{"sub": "someone"})
+
+	if _, err := provider.ExchangeCode("code", "not the verifier"); err == nil {
+		t.Fatal("code was exchanged without the right PKCE verifier")
+	}
+	if _, err := provider.VerifyIdToken(idToken, login.Nonce); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.VerifyIdToken(idToken, "another login's nonce"); err == nil {
+		t.Fatal("token with the wrong nonce was accepted")
+	}
+
+	tests := map[string]jwt.MapClaims{
+		"audience": {"aud": "another client"},
+		"issuer":   {"iss": "https://someone.else"},
+		"expiry":   {"exp": time.Now().Add(-time.Minute).Unix()},
+		"subject":  {"sub": ""},
+	}
+	for name, changed := range tests {
+		claims := jwt.MapClaims{}
+		for claim, value := range idp.claims {
+			claims[claim] = value
+		}
+		for claim, value := range changed {
+			claims[claim] = value
+		}
+		if _, err := provider.VerifyIdToken(idp.sign(t, claims), login.Nonce); err == nil {
+			t.Errorf("token with the wrong %s was accepted", name)
+		}
+	}
+	if _, ok := provider.TakePendingLogin("made up state"); ok {
+		t.Fatal("made up state was accepted")
+	}
+}
+
+func TestOIDCFirstLoginAndGroupSync(t *testing.T) {
+	idp, provider := setup_test_oidc(t)
+
+	// First login makes an account with the default rank, plus the ranks its groups map to
+	idToken, login := idp.login(t, provider, jwt.MapClaims{"sub": "someone", "preferred_username": "someone", "groups": []string{"supporters", "unmapped"}})
+	claims, err := provider.VerifyIdToken(idToken, login.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := provider.LinkAccount(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranks []string
+	json.Unmarshal([]byte(account.Ranks), &ranks)
+	if account.Username != "someone" || !slices.Equal(ranks, []string{"Member", "Supporter"}) {
+		t.Fatalf("expected someone with Member & Supporter, got %s with %v", account.Username, ranks)
+	}
+
+	// Leaving the group takes the rank away again, on the same account
+	idToken, login = idp.login(t, provider, jwt.MapClaims{"sub": "someone", "preferred_username": "someone", "groups": []string{}})
+	claims, err = provider.VerifyIdToken(idToken, login.Nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	relinked, err := provider.LinkAccount(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(relinked.Ranks), &ranks)
+	if relinked.ID != account.ID || !slices.Equal(ranks, []string{"Member"}) {
+		t.Fatalf("expected account %d with Member, got %d with %v", account.ID, relinked.ID, ranks)
+	}
+
+	var changes int64
+	db.Model(&RankChanges{}).Where("account_id = ? AND rank = ?", account.ID, "Supporter").Count(&changes)
+	if changes != 2 {
+		t.Fatalf("expected Supporter to be granted & revoked in the rank history, got %d changes", changes)
+	}
+}
+
+func TestOIDCFollowsRegistrationMode(t *testing.T) {
+	idp, provider := setup_test_oidc(t)
+	t.Cleanup(func() { registration_mode = "" })
+
+	link := func(subject string) (Accounts, error) {
+		idToken, login := idp.login(t, provider, jwt.MapClaims{"sub": subject, "preferred_username": subject})
+		claims, err := provider.VerifyIdToken(idToken, login.Nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return provider.LinkAccount(claims)
+	}
+
+	registration_mode = registration_closed
+	if _, err := link("closed"); !errors.Is(err, ErrRegistrationClosed) {
+		t.Fatalf("account was made while registration is closed: %v", err)
+	}
+	registration_mode = registration_invite
+	if _, err := link("invite"); !errors.Is(err, ErrInviteRequired) {
+		t.Fatalf("account was made without an invite: %v", err)
+	}
+	var count int64
+	db.Model(&Accounts{}).Count(&count)
+	if count != 0 {
+		t.Fatalf("expected no accounts, got %d", count)
+	}
+
+	registration_mode = registration_approval
+	account, err := link("approval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.Ranks != `["Pending"]` {
+		t.Fatalf("expected a pending account, got %s", account.Ranks)
+	}
+	if _, err := CheckLoginAllowed(account); !errors.Is(err, ErrPendingApproval) {
+		t.Fatalf("pending account could log in: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Passwords are hashed with argon2id or bcrypt, picked with SCRATCHCORD_PASSWORD_HASH. The algorithm
+// & its parameters are kept in the hash itself (PHC format for argon2id, "$2a$cost$..." for bcrypt),
+// so old hashes keep working after the settings change, and get rehashed next time that user logs in.
+//
+// Hashing takes a lot of CPU on purpose, so only a few happen at once. A burst of logins waits
+// its turn instead of slowing down everything else.
+
+var (
+	password_hash_algorithm string = os.Getenv("SCRATCHCORD_PASSWORD_HASH") // "argon2id" or "bcrypt"
+	bcrypt_cost             string = os.Getenv("SCRATCHCORD_BCRYPT_COST")
+	argon2_memory           string = os.Getenv("SCRATCHCORD_ARGON2_MEMORY") // KiB
+	argon2_time             string = os.Getenv("SCRATCHCORD_ARGON2_TIME")
+	argon2_threads          string = os.Getenv("SCRATCHCORD_ARGON2_THREADS")
+	password_hash_workers   string = os.Getenv("SCRATCHCORD_PASSWORD_HASH_WORKERS")
+)
+
+const (
+	hash_argon2id = "argon2id"
+	hash_bcrypt   = "bcrypt"
+
+	// OWASP's recommended argon2id settings
+	default_argon2_memory  = 19 * 1024
+	default_argon2_time    = 2
+	default_argon2_threads = 1
+	argon2_salt_length     = 16
+	argon2_key_length      = 32
+
+	default_bcrypt_cost = 12
+)
+
+var (
+	ErrPasswordMismatch = errors.New("wrong password")
+	ErrHashInvalid      = errors.New("password hash invalid")
+)
+
+type PasswordHasher struct {
+	Algorithm  string
+	BcryptCost int
+	Memory     uint32
+	Time       uint32
+	Threads    uint8
+}
+
+var passwordHasher PasswordHasher
+
+// Only this many hashes happen at once
+var passwordHashSlots chan struct{}
+
+func env_int(name string, value string, fallback int) int {
+	if value == "" {
+		return fallback
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed < 1 {
+		log.Printf("%s is invalid, using %d", name, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func setup_password_hasher() {
+	passwordHasher = PasswordHasher{
+		Algorithm:  password_hash_algorithm,
+		BcryptCost: env_int("SCRATCHCORD_BCRYPT_COST", bcrypt_cost, default_bcrypt_cost),
+		Memory:     uint32(env_int("SCRATCHCORD_ARGON2_MEMORY", argon2_memory, default_argon2_memory)),
+		Time:       uint32(env_int("SCRATCHCORD_ARGON2_TIME", argon2_time, default_argon2_time)),
+		Threads:    uint8(env_int("SCRATCHCORD_ARGON2_THREADS", argon2_threads, default_argon2_threads)),
+	}
+	if passwordHasher.Algorithm == "" {
+		passwordHasher.Algorithm = hash_argon2id
+	}
+	if passwordHasher.Algorithm != hash_argon2id && passwordHasher.Algorithm != hash_bcrypt {
+		log.Fatalf("SCRATCHCORD_PASSWORD_HASH must be %s or %s", hash_argon2id, hash_bcrypt)
+	}
+	if passwordHasher.BcryptCost < bcrypt.MinCost || passwordHasher.BcryptCost > bcrypt.MaxCost {
+		log.Fatalf("SCRATCHCORD_BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	workers := env_int("SCRATCHCORD_PASSWORD_HASH_WORKERS", password_hash_workers, max(1, runtime.NumCPU()/2))
+	passwordHashSlots = make(chan struct{}, workers)
+}
+
+// Waits for a free slot to hash in, release it when done
+func acquire_password_hash_slot() {
+	passwordHashSlots <- struct{}{}
+}
+
+func release_password_hash_slot() {
+	<-passwordHashSlots
+}
+
+func HashPassword(password string) (string, error) {
+	acquire_password_hash_slot()
+	defer release_password_hash_slot()
+	return passwordHasher.Hash(password)
+}
+
+// Checks a password against a hash made with any settings, ErrPasswordMismatch if it's wrong
+func CheckPassword(hash string, password string) error {
+	acquire_password_hash_slot()
+	defer release_password_hash_slot()
+	return passwordHasher.Check(hash, password)
+}
+
+// Whether a hash was made with different settings than now, so should be redone
+func PasswordNeedsRehash(hash string) bool {
+	return passwordHasher.NeedsRehash(hash)
+}
+
+func (h PasswordHasher) Hash(password string) (string, error) {
+	if h.Algorithm == hash_bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2_salt_length)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, argon2_key_length)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h PasswordHasher) Check(hash string, password string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, key, err := ParseArgon2Hash(hash)
+		if err != nil {
+			return err
+		}
+		check := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(key)))
+		if subtle.ConstantTimeCompare(check, key) != 1 {
+			return ErrPasswordMismatch
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrPasswordMismatch
+	} else if err != nil {
+		return ErrHashInvalid
+	}
+	return nil
+}
+
+func (h PasswordHasher) NeedsRehash(hash string) bool {
+	if h.Algorithm == hash_bcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost != h.BcryptCost
+	}
+	params, _, _, err := ParseArgon2Hash(hash)
+	return err != nil || params.Memory != h.Memory || params.Time != h.Time || params.Threads != h.Threads
+}
+
+// Reads "$argon2id$v=19$m=19456,t=2,p=1$salt$key"
+func ParseArgon2Hash(hash string) (PasswordHasher, []byte, []byte, error) {
+	params := PasswordHasher{Algorithm: hash_argon2id}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != hash_argon2id {
+		return params, nil, nil, ErrHashInvalid
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, ErrHashInvalid
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil || params.Time < 1 || params.Threads < 1 {
+		return params, nil, nil, ErrHashInvalid
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, ErrHashInvalid
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, ErrHashInvalid
+	}
+	return params, salt, key, nil
+}
+
+// Redoes an account's hash with the current settings, now that we know the password
+func RehashPasswordIfNeeded(account Accounts, password string) {
+	if !PasswordNeedsRehash(account.PasswordHash) {
+		return
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		log.Printf("failed to rehash password for account %d: %v", account.ID, err)
+		return
+	}
+	// Only if it hasn't been changed in the meantime
+	db.Model(&Accounts{}).Where("id = ? AND password_hash = ?", account.ID, account.PasswordHash).UpdateColumn("password_hash", hash)
+}
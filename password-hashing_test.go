@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRehashSurvivesLogin(t *testing.T) {
+	setup_test_ranks(t)
+	if err := db.AutoMigrate(&Accounts{}, &LoginLockouts{}, &TwoFactorSecrets{}, &RankChanges{}); err != nil {
+		t.Fatal(err)
+	}
+	setup_test_hasher()
+
+	// Made back when the server used bcrypt
+	passwordHasher = PasswordHasher{Algorithm: hash_bcrypt, BcryptCost: 4}
+	hash, err := HashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := Accounts{Username: "someone", PasswordHash: hash, Ranks: `["Member"]`}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	setup_test_hasher()
+	account, _, err = AuthenticateAccount("someone", "correct horse battery staple", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rehash happens in the background, it's done when the hash changes
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stored := Accounts{}
+		db.First(&stored, account.ID)
+		if stored.PasswordHash != hash || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	RecordLogin(&account)
+
+	stored := Accounts{}
+	db.First(&stored, account.ID)
+	if !strings.HasPrefix(stored.PasswordHash, "$argon2id$") {
+		t.Fatalf("the rehash was undone, hash is %q", stored.PasswordHash)
+	}
+	if stored.LastLogin == 0 {
+		t.Fatal("last login wasn't recorded")
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// New passwords have to be long enough, can't have the username or a banned word in them,
+// and can't be on a breached password list.
+//
+// The breached list works like the Have I Been Pwned range API, but offline: a directory of files
+// named after the first 5 hex characters of a password's SHA-1, each line being the rest of a hash
+// & how many times it was seen ("SUFFIX:COUNT"). Only files for the prefix get read, so the list
+// can be as big as you want.
+
+var (
+	password_min_length     string = os.Getenv("SCRATCHCORD_PASSWORD_MIN_LENGTH")
+	password_banned_words   string = os.Getenv("SCRATCHCORD_PASSWORD_BANNED_WORDS") // Comma separated
+	breached_passwords_path string = os.Getenv("SCRATCHCORD_BREACHED_PASSWORDS_PATH")
+)
+
+const (
+	default_password_min_length = 8
+	password_max_length         = 72 // bcrypt ignores anything after this
+	breached_prefix_length      = 5
+)
+
+//go:embed config/common_passwords.txt
+var commonPasswordsTxt string
+
+var commonPasswords = make(map[string]bool)
+
+func init() {
+	for _, password := range strings.Split(commonPasswordsTxt, "\n") {
+		if password = strings.TrimSpace(password); password != "" {
+			commonPasswords[password] = true
+		}
+	}
+}
+
+type PasswordViolation struct {
+	Rule    string // "too_short", "too_long", "contains_username", "banned_word" or "breached"
+	Message string
+	Min     int    `json:",omitempty"`
+	Max     int    `json:",omitempty"`
+	Word    string `json:",omitempty"`
+}
+
+type PasswordPolicyResponse struct {
+	Error      string
+	Violations []PasswordViolation
+}
+
+func PasswordMinLength() int {
+	if password_min_length == "" {
+		return default_password_min_length
+	}
+	length, err := strconv.Atoi(password_min_length)
+	if err != nil {
+		log.Printf("SCRATCHCORD_PASSWORD_MIN_LENGTH is invalid, using %d", default_password_min_length)
+		return default_password_min_length
+	}
+	return length
+}
+
+func PasswordBannedWords() []string {
+	words := []string{"scratchcord"}
+	for _, word := range strings.Split(password_banned_words, ",") {
+		if word = strings.ToLower(strings.TrimSpace(word)); word != "" {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Looks up how many times a password has been seen in breaches, 0 if it's not on the list
+func BreachedPasswordCount(password string) (int, error) {
+	lowered := strings.ToLower(password)
+	if commonPasswords[lowered] {
+		return 1, nil
+	}
+	if breached_passwords_path == "" {
+		return 0, nil
+	}
+
+	hash := sha1.Sum([]byte(password))
+	hexHash := strings.ToUpper(hex.EncodeToString(hash[:]))
+	prefix, suffix := hexHash[:breached_prefix_length], hexHash[breached_prefix_length:]
+
+	file, err := os.Open(filepath.Join(breached_passwords_path, prefix))
+	if errors.Is(err, os.ErrNotExist) {
+		file, err = os.Open(filepath.Join(breached_passwords_path, prefix+".txt"))
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lineSuffix, count, _ := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if strings.EqualFold(lineSuffix, suffix) {
+			seen, err := strconv.Atoi(count)
+			if err != nil || seen < 1 {
+				seen = 1
+			}
+			return seen, nil
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// Checks a new password against the policy, returning every rule it breaks
+func CheckPasswordPolicy(password string, username string) []PasswordViolation {
+	violations := []PasswordViolation{}
+	lowered := strings.ToLower(password)
+
+	minLength := PasswordMinLength()
+	if len([]rune(password)) < minLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    "too_short",
+			Message: "password must be at least " + strconv.Itoa(minLength) + " characters!",
+			Min:     minLength,
+		})
+	}
+	if len(password) > password_max_length {
+		violations = append(violations, PasswordViolation{
+			Rule:    "too_long",
+			Message: "password must be at most " + strconv.Itoa(password_max_length) + " bytes!",
+			Max:     password_max_length,
+		})
+	}
+	if username != "" && strings.Contains(lowered, strings.ToLower(username)) {
+		violations = append(violations, PasswordViolation{
+			Rule:    "contains_username",
+			Message: "password can't contain your username!",
+		})
+	}
+	for _, word := range PasswordBannedWords() {
+		if strings.Contains(lowered, word) {
+			violations = append(violations, PasswordViolation{
+				Rule:    "banned_word",
+				Message: "password can't contain \"" + word + "\"!",
+				Word:    word,
+			})
+		}
+	}
+
+	count, err := BreachedPasswordCount(password)
+	if err != nil {
+		log.Printf("failed to check breached passwords: %v", err)
+	} else if count > 0 {
+		violations = append(violations, PasswordViolation{
+			Rule:    "breached",
+			Message: "password has been in a data breach, pick another one!",
+		})
+	}
+	return violations
+}
+
+// Replies with every rule a password breaks, so clients can show them
+func send_password_violations(c *fiber.Ctx, violations []PasswordViolation) error {
+	return c.Status(fiber.StatusBadRequest).JSON(PasswordPolicyResponse{
+		Error:      "password invalid!",
+		Violations: violations,
+	})
+}
+
+func check_breached_passwords_path() {
+	if breached_passwords_path == "" {
+		return
+	}
+	if info, err := os.Stat(breached_passwords_path); err != nil || !info.IsDir() {
+		log.Printf("SCRATCHCORD_BREACHED_PASSWORDS_PATH %s is not a directory, only the built in list will be checked", breached_passwords_path)
+	}
+}
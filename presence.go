@@ -0,0 +1,55 @@
+package main
+
+import "sync"
+
+// Keeps track of who is connected to which channel, no matter how they're connected (websocket, IRC, etc.)
+type PresenceTracker struct {
+	mutex    sync.Mutex
+	channels map[string]map[uint]int // channel -> user id -> connection count
+}
+
+func NewPresenceTracker() *PresenceTracker {
+	return &PresenceTracker{
+		channels: make(map[string]map[uint]int),
+	}
+}
+
+func (p *PresenceTracker) Join(channel string, userId uint) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.channels[channel] == nil {
+		p.channels[channel] = make(map[uint]int)
+	}
+	p.channels[channel][userId]++
+}
+
+func (p *PresenceTracker) Leave(channel string, userId uint) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	users := p.channels[channel]
+	if users == nil {
+		return
+	}
+	// Users can be connected more than once, so only remove them when their last connection leaves
+	users[userId]--
+	if users[userId] <= 0 {
+		delete(users, userId)
+	}
+	if len(users) == 0 {
+		delete(p.channels, channel)
+	}
+}
+
+// Gets the ids of everyone in a channel
+func (p *PresenceTracker) Users(channel string) []uint {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	userIds := make([]uint, 0, len(p.channels[channel]))
+	for userId := range p.channels[channel] {
+		userIds = append(userIds, userId)
+	}
+	return userIds
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"slices"
+	"strings"
 
 	_ "image/gif"
 	_ "image/jpeg"
@@ -18,6 +25,9 @@ import (
 	"github.com/nfnt/resize"
 )
 
+// Where default avatars come from, the username goes on the end
+var default_avatar_api = "https://api.dicebear.com/9.x/initials/webp?chars=1&seed="
+
 func UploadProfilePicture(c *fiber.Ctx) error {
 	// Check to see if the current token is valid.
 	user := c.Locals("user").(*jwt.Token)
@@ -45,7 +55,7 @@ func UploadProfilePicture(c *fiber.Ctx) error {
 
 	// Check if the user is allowed to change their profile picture
 
-	ranks, err := GetEffectivePermissions(account.Ranks)
+	ranks, err := GetTokenPermissions(user, account)
 	if err != nil {
 		return c.SendStatus(fiber.StatusInternalServerError)
 	}
@@ -99,8 +109,11 @@ func UploadProfilePicture(c *fiber.Ctx) error {
 	if err != nil {
 		return fmt.Errorf("failed to save WebP image: %w", err)
 	}
+	previous := account
 	account.Avatar = server_url + "/uploads/profile-pictures/" + fileName
-	db.Save(&account)
+	db.Model(&account).UpdateColumn("avatar", account.Avatar)
+	// Nothing points at the old one anymore, so it isn't kept
+	DeleteProfilePicture(previous)
 	return c.SendString("success!")
 }
 
@@ -136,3 +149,41 @@ func resizeAndCrop(img image.Image, width, height int) image.Image {
 
 	return croppedImg
 }
+
+// Makes the avatar new accounts start with, & returns its URL
+func GenerateDefaultAvatar(username string) (string, error) {
+	fileName := uuid.NewString() + ".webp"
+	destination := fmt.Sprintf(upload_directory+"/profile-pictures/%s", fileName)
+
+	// We use an API to create this
+	// Example of a request we make to generate avatars: https://api.dicebear.com/9.x/initials/webp?chars=1&seed=Preloading
+	requestURL := default_avatar_api + url.QueryEscape(username)
+	res, err := http.Get(requestURL)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// Now that we have the image, we should store it
+	// Save the WebP image data to a file
+	out, err := os.Create(destination)
+	if err != nil {
+		panic(err) // This should NEVER fail unless we run out of disk space.
+	}
+	defer out.Close()
+	io.Copy(out, res.Body)
+
+	return server_url + "/uploads/profile-pictures/" + fileName, nil
+}
+
+// Removes an account's uploaded avatar, if it has one
+func DeleteProfilePicture(account Accounts) {
+	prefix := server_url + "/uploads/profile-pictures/"
+	if !strings.HasPrefix(account.Avatar, prefix) {
+		return
+	}
+	fileName := filepath.Base(strings.TrimPrefix(account.Avatar, prefix))
+	if err := os.Remove(filepath.Join(upload_directory, "profile-pictures", fileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("failed to remove profile picture %s: %v", fileName, err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Working out a user's permissions used to take a query for every rank & parent, every login,
+// admin call & socket connect. Now the whole rank graph is loaded once and kept in memory, along
+// with the answer for every set of ranks asked about. Anything that changes a rank throws it away
+// once its change is committed, and it's loaded again next time it's needed. (Not from a gorm hook,
+// those run before the commit, so another request could load the old ranks back in right after.)
+
+const rank_cache_max_sets = 10000 // Forgets every answer once there's this many, users rarely have unique rank sets
+
+type CachedRank struct {
+	Parents     []string
+	Subtractive []string
+}
+
+type RankCache struct {
+	mutex       sync.RWMutex
+	ranks       map[string]CachedRank // nil until loaded
+	permissions map[string][]string   // Effective permissions by rank set
+	generation  uint64                // Goes up every invalidation, so a load that raced one isn't kept
+}
+
+var rankCache RankCache
+
+// Forgets the rank graph, call after changing ranks (once the transaction has committed)
+func InvalidateRankCache() {
+	rankCache.mutex.Lock()
+	defer rankCache.mutex.Unlock()
+	rankCache.ranks = nil
+	rankCache.permissions = nil
+	rankCache.generation++
+}
+
+func cached_rank(rank Ranks) (CachedRank, error) {
+	parentRanks, err := rank.GetParentRanks()
+	if err != nil {
+		return CachedRank{}, fmt.Errorf("failed to get parent ranks of %s: %w", rank.RankName, err)
+	}
+	subtractiveRanks, err := rank.GetSubtractiveRanks()
+	if err != nil {
+		return CachedRank{}, fmt.Errorf("failed to get subtractive ranks of %s: %w", rank.RankName, err)
+	}
+	return CachedRank{Parents: parentRanks, Subtractive: subtractiveRanks}, nil
+}
+
+// Loads every rank from the database, unless it already has
+func (cache *RankCache) load() (map[string]CachedRank, error) {
+	cache.mutex.RLock()
+	ranks, generation := cache.ranks, cache.generation
+	cache.mutex.RUnlock()
+	if ranks != nil {
+		return ranks, nil
+	}
+
+	rows := []Ranks{}
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to load ranks: %w", err)
+	}
+	ranks = make(map[string]CachedRank, len(rows))
+	for _, rank := range rows {
+		cached, err := cached_rank(rank)
+		if err != nil {
+			return nil, err
+		}
+		ranks[rank.RankName] = cached
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.generation == generation {
+		cache.ranks = ranks
+		cache.permissions = make(map[string][]string)
+	}
+	return ranks, nil
+}
+
+func (cache *RankCache) EffectivePermissions(userRanks []string) ([]string, error) {
+	key := strings.Join(userRanks, "\x00")
+	cache.mutex.RLock()
+	permissions, ok := cache.permissions[key]
+	generation := cache.generation
+	cache.mutex.RUnlock()
+	if ok {
+		// Copied, so callers can't change what's cached
+		return slices.Clone(permissions), nil
+	}
+
+	ranks, err := cache.load()
+	if err != nil {
+		return nil, err
+	}
+	permissions, err = resolve_effective_permissions(ranks, userRanks)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	if cache.permissions != nil && cache.generation == generation {
+		if len(cache.permissions) >= rank_cache_max_sets {
+			log.Printf("rank cache has %d rank sets, clearing it", len(cache.permissions))
+			cache.permissions = make(map[string][]string)
+		}
+		cache.permissions[key] = permissions
+	}
+	cache.mutex.Unlock()
+	return slices.Clone(permissions), nil
+}
+
+// Every rank the user's ranks add up to, including parents, minus any subtractive ranks
+func resolve_effective_permissions(ranks map[string]CachedRank, userRanks []string) ([]string, error) {
+	allPermissions := make(map[string]bool)
+
+	var addParentPermissions func(rankName string) error
+	addParentPermissions = func(rankName string) error {
+		if allPermissions[rankName] {
+			return nil
+		}
+		rank, ok := ranks[rankName]
+		if !ok {
+			return fmt.Errorf("failed to fetch rank details: %s: %w", rankName, gorm.ErrRecordNotFound)
+		}
+		allPermissions[rankName] = true
+		for _, parentRank := range rank.Parents {
+			if err := addParentPermissions(parentRank); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, rankName := range userRanks {
+		if err := addParentPermissions(rankName); err != nil {
+			return nil, err
+		}
+	}
+
+	// Only the user's own ranks can take permissions away, not ones they inherit
+	for _, rankName := range userRanks {
+		for _, subtractiveRank := range ranks[rankName].Subtractive {
+			delete(allPermissions, subtractiveRank)
+		}
+	}
+
+	effectivePermissions := make([]string, 0, len(allPermissions))
+	for permission := range allPermissions {
+		effectivePermissions = append(effectivePermissions, permission)
+	}
+	slices.Sort(effectivePermissions)
+	return effectivePermissions, nil
+}
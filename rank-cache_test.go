@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"gorm.io/gorm"
+)
+
+// Points db at a fresh database with the default & required ranks in it
+func setup_test_ranks(tb testing.TB) {
+	tb.Helper()
+	setup_test_db(tb, &Ranks{})
+	InvalidateRankCache()
+	if err := InitializeRanksFromJSON(defaultRanksJson); err != nil {
+		tb.Fatal(err)
+	}
+	if err := InitializeRanksFromJSON(requiredRanksJson); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestRankUpdateInvalidatesPermissions(t *testing.T) {
+	setup_test_ranks(t)
+
+	permissions, err := GetEffectivePermissions([]string{"Member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(permissions, "CanManageBots") {
+		t.Fatal("Member already has CanManageBots")
+	}
+
+	// Changed behind the cache's back, the memoized answer should still be used
+	if err := db.Model(&Ranks{}).Where("rank_name = ?", "Member").UpdateColumn("parent_ranks", `["CanManageBots"]`).Error; err != nil {
+		t.Fatal(err)
+	}
+	permissions, _ = GetEffectivePermissions([]string{"Member"})
+	if slices.Contains(permissions, "CanManageBots") {
+		t.Fatal("permissions weren't memoized")
+	}
+
+	// Changed the way ModifyRankAPI does it
+	parents := []string{"CanSendMessage", "CanManageBots"}
+	err = db.Transaction(func(tx *gorm.DB) error {
+		return modify_rank(tx, ModifyRankRequestJson{RankName: "Member", ParentRanks: &parents})
+	})
+	InvalidateRankCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions, err = GetEffectivePermissions([]string{"Member"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(permissions, "CanManageBots") || slices.Contains(permissions, "CanReadMessages") {
+		t.Fatalf("permissions weren't updated: %v", permissions)
+	}
+}
+
+// How GetEffectivePermissions worked before the cache, a query for every rank & parent every call
+func uncached_effective_permissions(userRanks []string) ([]string, error) {
+	allPermissions := make(map[string]bool)
+
+	var addParentPermissions func(rankName string) error
+	addParentPermissions = func(rankName string) error {
+		var rank Ranks
+		if err := db.Where("rank_name = ?", rankName).First(&rank).Error; err != nil {
+			return fmt.Errorf("failed to fetch rank details: %w", err)
+		}
+		allPermissions[rankName] = true
+		parentRanks, err := rank.GetParentRanks()
+		if err != nil {
+			return fmt.Errorf("failed to get parent ranks: %w", err)
+		}
+		for _, parentRank := range parentRanks {
+			if err := addParentPermissions(parentRank); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, rankName := range userRanks {
+		if err := addParentPermissions(rankName); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := len(userRanks) - 1; i >= 0; i-- {
+		var rank Ranks
+		if err := db.Where("rank_name = ?", userRanks[i]).First(&rank).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch rank details: %w", err)
+		}
+		subtractiveRanks, err := rank.GetSubtractiveRanks()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get subtractive ranks: %w", err)
+		}
+		for _, subtractiveRank := range subtractiveRanks {
+			delete(allPermissions, subtractiveRank)
+		}
+	}
+
+	effectivePermissions := make([]string, 0, len(allPermissions))
+	for permission := range allPermissions {
+		effectivePermissions = append(effectivePermissions, permission)
+	}
+	return effectivePermissions, nil
+}
+
+func TestCachedPermissionsMatchUncached(t *testing.T) {
+	setup_test_ranks(t)
+
+	for _, userRanks := range [][]string{{"Member"}, {"Owner", "Member"}, {"Banned", "Member"}} {
+		want, err := uncached_effective_permissions(userRanks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := GetEffectivePermissions(userRanks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(want)
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("%v: got %v, want %v", userRanks, got, want)
+		}
+	}
+}
+
+func BenchmarkGetEffectivePermissions(b *testing.B) {
+	setup_test_ranks(b)
+	ranks := `["Owner","Member"]`
+
+	// The recursive per-rank queries from before the cache, for comparison
+	b.Run("database", func(b *testing.B) {
+		for range b.N {
+			if _, err := uncached_effective_permissions([]string{"Owner", "Member"}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	// Loading the rank graph from the database every time
+	b.Run("cold", func(b *testing.B) {
+		for range b.N {
+			InvalidateRankCache()
+			if _, err := GetEffectivePermissions(ranks); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		if _, err := GetEffectivePermissions(ranks); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for range b.N {
+			if _, err := GetEffectivePermissions(ranks); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Ranks point at each other by name, so a typo or a deleted rank leaves a parent that doesn't exist
+// (and every holder of that rank can't log in), and a rank that ends up inheriting itself never
+// finishes resolving. Changes to ranks are checked here before they're saved, and anything already
+// wrong in the database gets logged on start.
+
+var (
+	ErrRankMissing = errors.New("rank doesn't exist")
+	ErrRankCycle   = errors.New("rank inherits from itself")
+)
+
+// Every problem with a rank graph, in the same order every time
+func RankGraphProblems(ranks map[string]CachedRank) []error {
+	problems := []error{}
+	names := slices.Sorted(maps.Keys(ranks))
+
+	for _, name := range names {
+		for _, parent := range ranks[name].Parents {
+			if _, ok := ranks[parent]; !ok {
+				problems = append(problems, fmt.Errorf("%w: %s's parent %s", ErrRankMissing, name, parent))
+			}
+		}
+		for _, subtractive := range ranks[name].Subtractive {
+			if _, ok := ranks[subtractive]; !ok {
+				problems = append(problems, fmt.Errorf("%w: %s's subtractive rank %s", ErrRankMissing, name, subtractive))
+			}
+		}
+	}
+
+	// Depth first through the parents, a rank that's still being visited when we get back to it is a cycle
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(ranks))
+	path := []string{}
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+		for _, parent := range ranks[name].Parents {
+			if _, ok := ranks[parent]; !ok {
+				continue
+			}
+			switch state[parent] {
+			case unvisited:
+				visit(parent)
+			case visiting:
+				cycle := path[slices.Index(path, parent):]
+				problems = append(problems, fmt.Errorf("%w: %s", ErrRankCycle, describe_rank_cycle(cycle)))
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+	return problems
+}
+
+// "A -> B -> A", starting from the first name alphabetically so the same cycle always reads the same
+func describe_rank_cycle(cycle []string) string {
+	start := slices.Index(cycle, slices.Min(cycle))
+	ordered := append(slices.Clone(cycle[start:]), cycle[:start]...)
+	return strings.Join(append(ordered, ordered[0]), " -> ")
+}
+
+// Checks the rank graph would still be valid with these ranks added (or replaced) and the removed ones
+// gone. Only problems the change would cause count, so ones already in the database don't block
+// unrelated changes.
+func CheckRankGraphChange(changed []Ranks, removed []string) error {
+	current, err := rankCache.load()
+	if err != nil {
+		return err
+	}
+	next := maps.Clone(current)
+	for _, name := range removed {
+		delete(next, name)
+	}
+	for _, rank := range changed {
+		cached, err := cached_rank(rank)
+		if err != nil {
+			return err
+		}
+		next[rank.RankName] = cached
+	}
+
+	existing := make(map[string]bool)
+	for _, problem := range RankGraphProblems(current) {
+		existing[problem.Error()] = true
+	}
+	for _, problem := range RankGraphProblems(next) {
+		if !existing[problem.Error()] {
+			return problem
+		}
+	}
+	return nil
+}
+
+// Logs anything already wrong with the ranks in the database
+func report_rank_graph_problems() {
+	ranks, err := rankCache.load()
+	if err != nil {
+		log.Printf("failed to check ranks: %v", err)
+		return
+	}
+	problems := RankGraphProblems(ranks)
+	for _, problem := range problems {
+		log.Printf("rank problem: %v", problem)
+	}
+	if len(problems) > 0 {
+		log.Printf("%d rank problems found, fix them with the rank admin APIs", len(problems))
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"slices"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
 )
 
 type Ranks struct {
@@ -20,6 +23,16 @@ type Ranks struct {
 	ParentRanks      string `gorm:"type:text"` // Stored as JSON array
 	SubtractiveRanks string `gorm:"type:text"` // Stored as JSON array
 }
+
+// Every time an account gets or loses a rank, so users can see their history
+type RankChanges struct {
+	gorm.Model
+	AccountId uint `gorm:"index"`
+	Rank      string
+	Action    string // "granted" or "revoked"
+	Date      uint64
+}
+
 type DefaultRanksJson struct {
 	RankStrength     uint
 	RankName         string
@@ -61,7 +74,9 @@ func (r *Ranks) SetSubtractiveRanks(subtractiveRanks []string) error {
 
 func AddRankToUser(id int64, rankToAdd string) error {
 	var user Accounts
-	db.First(&user, "id = ?", id)
+	if err := db.First(&user, "id = ?", id).Error; err != nil {
+		return ErrAccountDoesNotExist
+	}
 	var ranks []string
 	err := json.Unmarshal([]byte(user.Ranks), &ranks)
 	if err != nil {
@@ -70,21 +85,14 @@ func AddRankToUser(id int64, rankToAdd string) error {
 	if slices.Contains(ranks, rankToAdd) {
 		return errors.New("rank already exists")
 	}
-	ranks = append(ranks, rankToAdd)
-	jsonRanks, err := json.Marshal(ranks)
-	if err != nil {
-		return err
-	}
-	if err := db.Model(&user).Where("id = ?", id).Update("ranks", jsonRanks).Error; err != nil {
-		return err
-	}
-
-	return nil
+	return SetAccountRanks(db, &user, append(ranks, rankToAdd))
 }
 
 func RemoveRankFromUser(id int64, rankToRemove string) error {
 	var user Accounts
-	db.First(&user, "id = ?", id)
+	if err := db.First(&user, "id = ?", id).Error; err != nil {
+		return ErrAccountDoesNotExist
+	}
 	var ranks []string
 	err := json.Unmarshal([]byte(user.Ranks), &ranks)
 	if err != nil {
@@ -93,30 +101,61 @@ func RemoveRankFromUser(id int64, rankToRemove string) error {
 	if !slices.Contains(ranks, rankToRemove) {
 		return errors.New("user doesn't have the rank attempting to be removed")
 	}
+	return SetAccountRanks(db, &user, slices.DeleteFunc(ranks, func(r string) bool { return r == rankToRemove }))
+}
 
-	// Find the index of the rank to remove
-	indexToRemove := -1
-	for i, r := range ranks {
-		if r == rankToRemove {
-			indexToRemove = i
-			break
-		}
+// Every change to an account's ranks goes through here (or is a new account, see AfterCreate),
+// so the rank history users can export is complete.
+func SetAccountRanks(tx *gorm.DB, account *Accounts, ranks []string) error {
+	var oldRanks []string
+	if err := json.Unmarshal([]byte(account.Ranks), &oldRanks); err != nil {
+		return err
+	}
+	jsonRanks, err := json.Marshal(ranks)
+	if err != nil {
+		return err
+	}
+	if err := tx.Model(&Accounts{}).Where("id = ?", account.ID).UpdateColumn("ranks", string(jsonRanks)).Error; err != nil {
+		return err
+	}
+	account.Ranks = string(jsonRanks)
+	return record_rank_changes(tx, account.ID, oldRanks, ranks)
+}
+
+// New accounts start their rank history with whatever ranks they're made with
+func (a *Accounts) AfterCreate(tx *gorm.DB) (err error) {
+	var ranks []string
+	if err := json.Unmarshal([]byte(a.Ranks), &ranks); err != nil {
+		return nil
 	}
+	return record_rank_changes(tx, a.ID, nil, ranks)
+}
 
-	// If the rank was found, remove it
-	if indexToRemove != -1 {
-		ranks = append(ranks[:indexToRemove], ranks[indexToRemove+1:]...)
+// A LIKE pattern for finding a rank in a JSON rank list. The name has to be encoded the way
+// json.Marshal wrote it, since that escapes & < > ("Q&A" is stored as "Q\u0026A"). % and _ in the
+// name can still match more than they should, so check the decoded list when it matters.
+func rank_list_like(rankName string) string {
+	encoded, _ := json.Marshal(rankName)
+	return "%" + string(encoded) + "%"
+}
 
-		jsonRanks, err := json.Marshal(ranks)
-		if err != nil {
-			return err
+func record_rank_changes(tx *gorm.DB, accountId uint, oldRanks []string, newRanks []string) error {
+	changes := []RankChanges{}
+	now := uint64(time.Now().Unix())
+	for _, rank := range newRanks {
+		if !slices.Contains(oldRanks, rank) {
+			changes = append(changes, RankChanges{AccountId: accountId, Rank: rank, Action: "granted", Date: now})
 		}
-		if err := db.Model(&user).Where("id = ?", id).Update("ranks", jsonRanks).Error; err != nil {
-			return err
+	}
+	for _, rank := range oldRanks {
+		if !slices.Contains(newRanks, rank) {
+			changes = append(changes, RankChanges{AccountId: accountId, Rank: rank, Action: "revoked", Date: now})
 		}
 	}
-
-	return nil
+	if len(changes) == 0 {
+		return nil
+	}
+	return tx.Create(&changes).Error
 }
 
 func InitializeRanksFromJSON(data []byte) error {
@@ -127,12 +166,13 @@ func InitializeRanksFromJSON(data []byte) error {
 		return fmt.Errorf("failed to parse JSON data: %w", err)
 	}
 
-	// Insert default ranks into the database
+	// Work out which ranks are missing
+	newRanks := []Ranks{}
 	for _, rank := range defaultRanks {
 		// Check if rank already exists
 		existingRank := Ranks{}
 		result := db.Where("rank_name = ?", rank.RankName).First(&existingRank)
-		if result.RowsAffected == 0 {
+		if result.RowsAffected == 0 && !slices.ContainsFunc(newRanks, func(r Ranks) bool { return r.RankName == rank.RankName }) {
 			// Rank doesn't exist, create it
 
 			// Marshal parent and subtractive ranks to JSON
@@ -145,100 +185,131 @@ func InitializeRanksFromJSON(data []byte) error {
 				return fmt.Errorf("failed to marshal subtractive ranks: %w", err)
 			}
 
-			newRank := Ranks{
+			newRanks = append(newRanks, Ranks{
 				RankStrength:     rank.RankStrength,
 				RankName:         rank.RankName,
 				Color:            rank.Color,
 				ShowToOtherUsers: rank.ShowToOtherUsers,
 				ParentRanks:      string(parentRanksJSON),
 				SubtractiveRanks: string(subtractiveRanksJSON),
-			}
-			if err := db.Create(&newRank).Error; err != nil {
-				return fmt.Errorf("failed to create rank: %w", err)
-			}
+			})
+		}
+	}
+
+	// Make sure they fit with what's already there, then insert them
+	if err := CheckRankGraphChange(newRanks, nil); err != nil {
+		return fmt.Errorf("invalid ranks: %w", err)
+	}
+	defer InvalidateRankCache()
+	for _, newRank := range newRanks {
+		if err := db.Create(&newRank).Error; err != nil {
+			return fmt.Errorf("failed to create rank: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func GetEffectivePermissions(userInput interface{}) ([]string, error) {
-	// 1. Determine input type and convert to []string
-	var userRanks []string
-	switch v := userInput.(type) {
-	case []string:
-		userRanks = v
-	case string:
-		err := json.Unmarshal([]byte(v), &userRanks)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse JSON string into []string: %w", err)
-		}
-	default:
-		return nil, fmt.Errorf("invalid input type: expected []string or string (JSON array), got %T", userInput)
+// Required ranks that already exist only get made once, so when a new version adds parents (like a
+// permission for a new admin API) to them, servers that were upgraded wouldn't get them. This adds
+// whatever parent & subtractive ranks are missing (so they come back if taken away), and leaves
+// anything else an admin added alone.
+func MergeRequiredRankLists(data []byte) error {
+	var requiredRanks []DefaultRanksJson
+	if err := json.Unmarshal(data, &requiredRanks); err != nil {
+		return fmt.Errorf("failed to parse JSON data: %w", err)
 	}
 
-	// 2. Create a map to store all permissions (including inherited)
-	allPermissions := make(map[string]bool)
-
-	// 3. Helper function to recursively add parent rank permissions
-	var addParentPermissions func(rankName string) error
-	addParentPermissions = func(rankName string) error {
-		// 4. Fetch the rank details from the database
-		var rank Ranks
-		if err := db.Where("rank_name = ?", rankName).First(&rank).Error; err != nil {
-			return fmt.Errorf("failed to fetch rank details: %w", err)
+	merge := func(existing []string, required []string) ([]string, []string) {
+		added := []string{}
+		for _, rank := range required {
+			if !slices.Contains(existing, rank) {
+				existing = append(existing, rank)
+				added = append(added, rank)
+			}
 		}
+		return existing, added
+	}
 
-		// 5. Add current rank's permissions
-		allPermissions[rankName] = true
-
-		// 6. Recursively add parent rank's permissions
+	changedRanks := []Ranks{}
+	for _, required := range requiredRanks {
+		rank := Ranks{}
+		if err := db.Where("rank_name = ?", required.RankName).First(&rank).Error; err != nil {
+			continue
+		}
 		parentRanks, err := rank.GetParentRanks()
 		if err != nil {
-			return fmt.Errorf("failed to get parent ranks: %w", err)
+			return fmt.Errorf("failed to get parent ranks of %s: %w", rank.RankName, err)
 		}
-		for _, parentRank := range parentRanks {
-			if err := addParentPermissions(parentRank); err != nil {
-				return err
-			}
+		subtractiveRanks, err := rank.GetSubtractiveRanks()
+		if err != nil {
+			return fmt.Errorf("failed to get subtractive ranks of %s: %w", rank.RankName, err)
+		}
+		parentRanks, addedParents := merge(parentRanks, required.ParentRanks)
+		subtractiveRanks, addedSubtractive := merge(subtractiveRanks, required.SubtractiveRanks)
+		if len(addedParents) == 0 && len(addedSubtractive) == 0 {
+			continue
+		}
+		rank.SetParentRanks(parentRanks)
+		rank.SetSubtractiveRanks(subtractiveRanks)
+		changedRanks = append(changedRanks, rank)
+		if len(addedParents) > 0 {
+			log.Printf("adding parent ranks %v to %s", addedParents, rank.RankName)
 		}
+		if len(addedSubtractive) > 0 {
+			log.Printf("adding subtractive ranks %v to %s", addedSubtractive, rank.RankName)
+		}
+	}
+	if len(changedRanks) == 0 {
 		return nil
 	}
 
-	// 7. Iterate through user's ranks and add permissions (including parents)
-	for _, rankName := range userRanks {
-		if err := addParentPermissions(rankName); err != nil {
-			return nil, err
-		}
+	if err := CheckRankGraphChange(changedRanks, nil); err != nil {
+		return fmt.Errorf("invalid ranks: %w", err)
 	}
-
-	// 8. Iterate through user's ranks again to process subtractive ranks
-	for i := len(userRanks) - 1; i >= 0; i-- {
-		rankName := userRanks[i]
-
-		// 9. Fetch the rank details from the database
-		var rank Ranks
-		if err := db.Where("rank_name = ?", rankName).First(&rank).Error; err != nil {
-			return nil, fmt.Errorf("failed to fetch rank details: %w", err)
+	defer InvalidateRankCache()
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, rank := range changedRanks {
+			err := tx.Model(&Ranks{}).Where("rank_strength = ?", rank.RankStrength).Updates(map[string]interface{}{
+				"parent_ranks":      rank.ParentRanks,
+				"subtractive_ranks": rank.SubtractiveRanks,
+			}).Error
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+}
 
-		// 10. Remove subtractive ranks and their sub-ranks
-		subtractiveRanks, err := rank.GetSubtractiveRanks()
+func GetEffectivePermissions(userInput interface{}) ([]string, error) {
+	// 1. Determine input type and convert to []string
+	var userRanks []string
+	switch v := userInput.(type) {
+	case []string:
+		userRanks = v
+	case string:
+		err := json.Unmarshal([]byte(v), &userRanks)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get subtractive ranks: %w", err)
-		}
-		for _, subtractiveRank := range subtractiveRanks {
-			delete(allPermissions, subtractiveRank)
+			return nil, fmt.Errorf("failed to parse JSON string into []string: %w", err)
 		}
+	default:
+		return nil, fmt.Errorf("invalid input type: expected []string or string (JSON array), got %T", userInput)
 	}
 
-	// 11. Convert the map keys (which are the effective permissions) to a slice
-	effectivePermissions := make([]string, 0, len(allPermissions))
-	for permission := range allPermissions {
-		effectivePermissions = append(effectivePermissions, permission)
-	}
+	// 2. Work it out from the cached rank graph
+	return rankCache.EffectivePermissions(userRanks)
+}
 
-	return effectivePermissions, nil
+// The strength of the strongest rank in a JSON rank list, 0 if it has none
+func StrongestRankStrength(rankList string) (uint, error) {
+	var ranks []string
+	if err := json.Unmarshal([]byte(rankList), &ranks); err != nil {
+		return 0, fmt.Errorf("failed to parse rank list: %w", err)
+	}
+	var strength uint
+	err := db.Model(&Ranks{}).Where("rank_name IN ?", ranks).Select("COALESCE(MAX(rank_strength), 0)").Scan(&strength).Error
+	return strength, err
 }
 
 func GetRankInfo(c *fiber.Ctx) error {
@@ -277,6 +348,12 @@ func InitializeRanks() {
 		fmt.Println("Error veriafying & readding required ranks:", err)
 		os.Exit(1)
 	}
+	if err := MergeRequiredRankLists(requiredRanksJson); err != nil {
+		fmt.Println("Error updating required ranks:", err)
+		os.Exit(1)
+	}
+
+	report_rank_graph_problems()
 }
 
 func CheckIfTokenHasRank(c *fiber.Ctx, rank string) error {
@@ -299,7 +376,7 @@ func CheckIfTokenHasRank(c *fiber.Ctx, rank string) error {
 		return errors.New("user does not exist")
 	}
 
-	ranks, err := GetEffectivePermissions(adminAccount.Ranks)
+	ranks, err := GetTokenPermissions(user, adminAccount)
 	if err != nil {
 		return errors.New("an internal server error occured")
 	}
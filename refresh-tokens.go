@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// Clients on newer protocol versions get short lived access tokens & a refresh token.
+// Refresh tokens are single use, every refresh gives you a new one. If an old one gets used again
+// someone has a copy of it, so the whole session gets logged out.
+// Older clients keep getting 72 hour tokens until SCRATCHCORD_LEGACY_TOKENS is set to false.
+
+const (
+	access_token_lifetime  = 15 * time.Minute
+	legacy_token_lifetime  = 72 * time.Hour
+	refresh_token_lifetime = 30 * 24 * time.Hour
+)
+
+type RefreshTokens struct {
+	gorm.Model
+	TokenHash string `gorm:"uniqueIndex"` // sha256 of the token, we never store the token itself
+	SessionId string `gorm:"index"`
+	AccountId uint
+	Used      bool
+	ExpiresAt uint64
+}
+
+type RefreshRequest struct {
+	RefreshToken string
+}
+
+func ClientUsesLegacyTokens(clientVersion string) bool {
+	return slices.Contains(legacy_protocol_versions, clientVersion)
+}
+
+// Once legacy tokens are turned off, old clients aren't supported anymore
+func ClientVersionSupported(clientVersion string) bool {
+	if !slices.Contains(permitted_protocol_versions, clientVersion) {
+		return false
+	}
+	return allow_legacy_tokens || !ClientUsesLegacyTokens(clientVersion)
+}
+
+// Opaque tokens (refresh tokens, bot tokens) are only stored as a hash
+func HashOpaqueToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func CreateRefreshToken(session Sessions) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	refreshToken := RefreshTokens{
+		TokenHash: HashOpaqueToken(token),
+		SessionId: session.SessionId,
+		AccountId: session.AccountId,
+		ExpiresAt: uint64(time.Now().Add(refresh_token_lifetime).Unix()),
+	}
+	if err := db.Create(&refreshToken).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Makes the token(s) a login/register/reauth responds with, for the client's protocol version
+func IssueTokens(account Accounts, session Sessions, clientVersion string) (fiber.Map, error) {
+	if ClientUsesLegacyTokens(clientVersion) {
+		t, err := CreateAccountToken(account, session, legacy_token_lifetime)
+		if err != nil {
+			return nil, err
+		}
+		return fiber.Map{"token": t}, nil
+	}
+
+	t, err := CreateAccountToken(account, session, access_token_lifetime)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := CreateRefreshToken(session)
+	if err != nil {
+		return nil, err
+	}
+	return fiber.Map{
+		"token":         t,
+		"refresh_token": refreshToken,
+		"expires_in":    int(access_token_lifetime.Seconds()),
+	}, nil
+}
+
+func refresh(c *fiber.Ctx) error {
+	r := new(RefreshRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	refreshToken := RefreshTokens{}
+	if err := db.First(&refreshToken, "token_hash = ?", HashOpaqueToken(r.RefreshToken)).Error; err != nil {
+		return c.SendString("refresh token invalid!")
+	}
+
+	// Someone used this already, so it's been stolen (or the client is broken). Either way log the session out.
+	if refreshToken.Used {
+		log.Printf("refresh token reused for account %d, revoking session %s", refreshToken.AccountId, refreshToken.SessionId)
+		RevokeSession(refreshToken.AccountId, refreshToken.SessionId)
+		return c.SendString("refresh token reused!")
+	}
+	if refreshToken.ExpiresAt < uint64(time.Now().Unix()) {
+		return c.SendString("refresh token expired!")
+	}
+
+	// Only one request gets to use it, even if two come in at once
+	result := db.Model(&RefreshTokens{}).Where("id = ? AND used = ?", refreshToken.ID, false).Update("used", true)
+	if result.Error != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if result.RowsAffected == 0 {
+		RevokeSession(refreshToken.AccountId, refreshToken.SessionId)
+		return c.SendString("refresh token reused!")
+	}
+
+	session := Sessions{}
+	if err := db.First(&session, "session_id = ? AND account_id = ?", refreshToken.SessionId, refreshToken.AccountId).Error; err != nil {
+		return c.SendString("token revoked!")
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", refreshToken.AccountId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !slices.Contains(ranks, "CanBeLoggedInto") {
+		return c.SendString("account login is restricted!")
+	}
+
+	session.IP = c.IP()
+	session.UserAgent = c.Get(fiber.HeaderUserAgent)
+	session.LastSeen = uint64(time.Now().Unix())
+	db.Save(&session)
+
+	// Old tokens are only kept around to catch reuse, so expired ones can go
+	db.Unscoped().Where("session_id = ? AND expires_at < ?", session.SessionId, time.Now().Unix()).Delete(&RefreshTokens{})
+
+	response, err := IssueTokens(account, session, session.ClientVersion)
+	if err != nil {
+		log.Printf("token.SignedString: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(response)
+}
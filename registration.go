@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// Who can register, set with SCRATCHCORD_REGISTRATION_MODE:
+//   - open: anyone (the default)
+//   - closed: nobody, accounts have to be made some other way
+//   - invite: only people with an invite code
+//   - approval: anyone, but new accounts get the Pending rank until a moderator approves them
+//
+// Invite codes work in every mode but closed, and give the rank they were made with.
+// In approval mode they skip the queue.
+
+var registration_mode string = os.Getenv("SCRATCHCORD_REGISTRATION_MODE")
+
+const (
+	registration_open     = "open"
+	registration_closed   = "closed"
+	registration_invite   = "invite"
+	registration_approval = "approval"
+
+	pending_rank = "Pending"
+	default_rank = "Member"
+)
+
+var (
+	ErrRegistrationClosed = errors.New("registration is closed")
+	ErrInviteInvalid      = errors.New("invite code invalid")
+	ErrInviteRequired     = errors.New("registration needs an invite code")
+	ErrPendingApproval    = errors.New("account pending approval")
+)
+
+type Invites struct {
+	gorm.Model
+	Code        string `gorm:"uniqueIndex"`
+	CreatedBy   uint
+	Rank        string
+	MaxUses     uint // 0 means unlimited
+	Uses        uint
+	ExpiresAt   uint64 // 0 means never
+	DateCreated uint64
+}
+
+type CreateInviteRequest struct {
+	Rank      string
+	MaxUses   uint
+	ExpiresIn uint64 // Seconds, 0 means never
+}
+
+type DeleteInviteRequest struct {
+	InviteId uint
+}
+
+type RegistrationRequest struct {
+	UserId uint
+}
+
+type PendingRegistrationResponse struct {
+	ID          uint
+	Username    string
+	DateCreated uint64
+}
+
+func RegistrationMode() string {
+	if registration_mode == "" {
+		return registration_open
+	}
+	return registration_mode
+}
+
+func check_registration_mode() {
+	modes := []string{registration_open, registration_closed, registration_invite, registration_approval}
+	if !slices.Contains(modes, RegistrationMode()) {
+		log.Fatalf("SCRATCHCORD_REGISTRATION_MODE must be one of %v", modes)
+	}
+}
+
+func (i *Invites) Usable() bool {
+	if i.MaxUses != 0 && i.Uses >= i.MaxUses {
+		return false
+	}
+	return i.ExpiresAt == 0 || i.ExpiresAt > uint64(time.Now().Unix())
+}
+
+func FindInvite(code string) (Invites, error) {
+	invite := Invites{}
+	if code == "" {
+		return invite, ErrInviteInvalid
+	}
+	if err := db.First(&invite, "code = ?", code).Error; err != nil || !invite.Usable() {
+		return invite, ErrInviteInvalid
+	}
+	return invite, nil
+}
+
+// Uses up one use of the invite, failing if someone else got the last one first
+func RedeemInvite(tx *gorm.DB, invite Invites) error {
+	result := tx.Model(&Invites{}).
+		Where("id = ? AND (max_uses = 0 OR uses < max_uses)", invite.ID).
+		Update("uses", gorm.Expr("uses + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInviteInvalid
+	}
+	return nil
+}
+
+// Works out what rank a new account gets, & the invite it's using if there is one
+func CheckRegistrationAllowed(inviteCode string) (string, *Invites, error) {
+	mode := RegistrationMode()
+	if mode == registration_closed {
+		return "", nil, ErrRegistrationClosed
+	}
+	if inviteCode != "" || mode == registration_invite {
+		invite, err := FindInvite(inviteCode)
+		if err != nil {
+			return "", nil, err
+		}
+		return invite.Rank, &invite, nil
+	}
+	if mode == registration_approval {
+		return pending_rank, nil, nil
+	}
+	return default_rank, nil, nil
+}
+
+func CreateInviteAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageRegistrations"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(CreateInviteRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if r.Rank == "" {
+		r.Rank = default_rank
+	}
+	if r.Rank == pending_rank {
+		return c.SendString("malformed input!")
+	}
+	rank := Ranks{}
+	if err := db.First(&rank, "rank_name = ?", r.Rank).Error; err != nil {
+		return c.SendString("rank doesn't exist!")
+	}
+	// Handing out invites for other ranks is the same as granting them
+	if r.Rank != default_rank {
+		if err := CheckIfTokenHasRank(c, "CanGrantRanks"); err != nil {
+			return c.SendStatus(fiber.StatusUnauthorized)
+		}
+	}
+
+	code, err := RandomURLString(12)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	invite := Invites{
+		Code:        code,
+		CreatedBy:   uint(claims["id"].(float64)),
+		Rank:        r.Rank,
+		MaxUses:     r.MaxUses,
+		DateCreated: uint64(time.Now().Unix()),
+	}
+	if r.ExpiresIn != 0 {
+		invite.ExpiresAt = invite.DateCreated + r.ExpiresIn
+	}
+	if err := db.Create(&invite).Error; err != nil {
+		return c.SendString("failed to create invite" + err.Error())
+	}
+	return c.JSON(fiber.Map{"id": invite.ID, "code": invite.Code})
+}
+
+func ListInvitesAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageRegistrations"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	invites := []Invites{}
+	db.Order("id desc").Find(&invites)
+	return c.JSON(invites)
+}
+
+func DeleteInviteAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageRegistrations"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(DeleteInviteRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	result := db.Unscoped().Delete(&Invites{}, r.InviteId)
+	if result.RowsAffected == 0 {
+		return c.SendString("invite doesn't exist!")
+	}
+	return c.SendString("sucess!")
+}
+
+func ListPendingRegistrationsAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageRegistrations"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	accounts := []Accounts{}
+	db.Order("date_created").Find(&accounts, "ranks LIKE ?", rank_list_like(pending_rank))
+	response := make([]PendingRegistrationResponse, 0, len(accounts))
+	for _, account := range accounts {
+		response = append(response, PendingRegistrationResponse{
+			ID:          account.ID,
+			Username:    account.Username,
+			DateCreated: account.DateCreated,
+		})
+	}
+	return c.JSON(response)
+}
+
+// Gets a pending account from a request, for approving or rejecting it
+func find_pending_account(c *fiber.Ctx) (Accounts, error) {
+	r := new(RegistrationRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return Accounts{}, err
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", r.UserId).Error; err != nil {
+		return account, ErrAccountDoesNotExist
+	}
+	var ranks []string
+	if err := json.Unmarshal([]byte(account.Ranks), &ranks); err != nil || !slices.Contains(ranks, pending_rank) {
+		return account, errors.New("account is not pending")
+	}
+	return account, nil
+}
+
+func ApproveRegistrationAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageRegistrations"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	account, err := find_pending_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	if err := RemoveRankFromUser(int64(account.ID), pending_rank); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if err := AddRankToUser(int64(account.ID), default_rank); err != nil {
+		return c.SendString(err.Error())
+	}
+	return c.SendString("sucess!")
+}
+
+func RejectRegistrationAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageRegistrations"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	account, err := find_pending_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	// Frees up the username, since they never got to use it
+	DeleteProfilePicture(account)
+	db.Unscoped().Delete(&account)
+	// A provider user can sign up again, instead of being linked to an account that's gone
+	db.Unscoped().Where("account_id = ?", account.ID).Delete(&OidcIdentities{})
+	return c.SendString("sucess!")
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Every login makes a session, so users can see where they're logged in
+type Sessions struct {
+	gorm.Model
+	SessionId     string `gorm:"uniqueIndex"`
+	AccountId     uint   `gorm:"index"`
+	ClientVersion string
+	IP            string
+	UserAgent     string
+	DateCreated   uint64
+	LastSeen      uint64
+}
+
+type SessionInfoResponse struct {
+	SessionId     string
+	ClientVersion string
+	IP            string
+	UserAgent     string
+	DateCreated   uint64
+	LastSeen      uint64
+	Current       bool
+}
+
+type RevokeSessionRequest struct {
+	SessionId string
+}
+
+type AdminSessionRequest struct {
+	UserId    uint
+	SessionId string
+}
+
+// How often last seen gets written, so every request isn't a DB write
+const session_last_seen_interval = 60
+
+func StartSession(c *fiber.Ctx, accountId uint, clientVersion string) (Sessions, error) {
+	session := Sessions{
+		SessionId:     uuid.NewString(),
+		AccountId:     accountId,
+		ClientVersion: clientVersion,
+		IP:            c.IP(),
+		UserAgent:     c.Get(fiber.HeaderUserAgent),
+		DateCreated:   uint64(time.Now().Unix()),
+		LastSeen:      uint64(time.Now().Unix()),
+	}
+	err := db.Create(&session).Error
+	return session, err
+}
+
+// Reauthing keeps the same session, unless the token is from before sessions
+func RenewSession(c *fiber.Ctx, token *jwt.Token, accountId uint, clientVersion string) (Sessions, error) {
+	session := Sessions{}
+	sid := TokenSessionId(token)
+	if sid == "" || db.First(&session, "session_id = ? AND account_id = ?", sid, accountId).Error != nil {
+		return StartSession(c, accountId, clientVersion)
+	}
+
+	session.ClientVersion = clientVersion
+	session.IP = c.IP()
+	session.UserAgent = c.Get(fiber.HeaderUserAgent)
+	session.LastSeen = uint64(time.Now().Unix())
+	err := db.Save(&session).Error
+	return session, err
+}
+
+func (s *Sessions) Touch() {
+	now := uint64(time.Now().Unix())
+	if now-s.LastSeen < session_last_seen_interval {
+		return
+	}
+	s.LastSeen = now
+	db.Model(s).Update("last_seen", now)
+}
+
+func RevokeSession(accountId uint, sessionId string) bool {
+	result := db.Where("account_id = ? AND session_id = ?", accountId, sessionId).Delete(&Sessions{})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return false
+	}
+	db.Where("session_id = ?", sessionId).Delete(&RefreshTokens{})
+	LiveConnections.CloseSession(accountId, sessionId)
+	return true
+}
+
+func ListSessions(accountId uint, currentSessionId string) []SessionInfoResponse {
+	sessions := []Sessions{}
+	db.Order("last_seen desc").Find(&sessions, "account_id = ?", accountId)
+
+	response := make([]SessionInfoResponse, 0, len(sessions))
+	for _, session := range sessions {
+		response = append(response, SessionInfoResponse{
+			SessionId:     session.SessionId,
+			ClientVersion: session.ClientVersion,
+			IP:            session.IP,
+			UserAgent:     session.UserAgent,
+			DateCreated:   session.DateCreated,
+			LastSeen:      session.LastSeen,
+			Current:       session.SessionId == currentSessionId,
+		})
+	}
+	return response
+}
+
+func list_sessions(c *fiber.Ctx) error {
+	accountId, err := user_account_id(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	return c.JSON(ListSessions(accountId, TokenSessionId(c.Locals("user").(*jwt.Token))))
+}
+
+func revoke_session(c *fiber.Ctx) error {
+	accountId, err := user_account_id(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+
+	r := new(RevokeSessionRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if !RevokeSession(accountId, r.SessionId) {
+		return c.SendString("session does not exist!")
+	}
+	return c.SendString("sucess!")
+}
+
+func revoke_all_sessions(c *fiber.Ctx) error {
+	accountId, err := user_account_id(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", accountId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	if err := RevokeAccountTokens(&account); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendString("sucess!")
+}
+
+func ListSessionsAdmin(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageSessions"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	userId := c.QueryInt("userid", 0)
+	if userId == 0 {
+		return c.SendString("malformed input!")
+	}
+	return c.JSON(ListSessions(uint(userId), ""))
+}
+
+func RevokeSessionAdmin(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageSessions"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(AdminSessionRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if !RevokeSession(r.UserId, r.SessionId) {
+		return c.SendString("session does not exist!")
+	}
+	return c.SendString("sucess!")
+}
+
+func RevokeAllSessionsAdmin(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageSessions"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(AdminSessionRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", r.UserId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	if err := RevokeAccountTokens(&account); err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendString("sucess!")
+}
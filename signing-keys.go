@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Tokens are signed with the newest key, and have its id in their "kid" header.
+// Old keys are kept for checking tokens until every token they signed has expired,
+// so rotating keys doesn't log anyone out.
+
+var (
+	key_algorithm     string = os.Getenv("SCRATCHCORD_KEY_ALGORITHM")     // RS256 (default), ES256 or EdDSA
+	key_rotation_days string = os.Getenv("SCRATCHCORD_KEY_ROTATION_DAYS") // 0 turns off rotation
+	SigningKeys              = &KeyRing{}
+)
+
+const (
+	default_key_rotation_days = 90
+	legacy_key_id             = "auth-key" // The key from before rotation existed, tokens it signed don't have a kid
+	key_file_prefix           = "auth-key"
+)
+
+type SigningKey struct {
+	Kid       string
+	Algorithm string
+	Created   time.Time
+	Private   crypto.Signer
+	File      string
+}
+
+type KeyRing struct {
+	mutex sync.RWMutex
+	keys  []*SigningKey // Oldest first, the last one is used for signing
+}
+
+func SigningMethodForAlgorithm(algorithm string) (jwt.SigningMethod, error) {
+	switch algorithm {
+	case "RS256":
+		return jwt.SigningMethodRS256, nil
+	case "ES256":
+		return jwt.SigningMethodES256, nil
+	case "EdDSA":
+		return jwt.SigningMethodEdDSA, nil
+	}
+	return nil, fmt.Errorf("unsupported key algorithm: %s", algorithm)
+}
+
+func AlgorithmForKey(key crypto.Signer) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return "RS256", nil
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 ECDSA keys are supported")
+		}
+		return "ES256", nil
+	case ed25519.PrivateKey:
+		return "EdDSA", nil
+	}
+	return "", errors.New("unsupported private key type")
+}
+
+func GenerateSigningKey(algorithm string) (crypto.Signer, error) {
+	switch algorithm {
+	case "RS256":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("unsupported key algorithm: %s", algorithm)
+}
+
+func KeyRotationInterval() time.Duration {
+	days := default_key_rotation_days
+	if key_rotation_days != "" {
+		parsed, err := strconv.Atoi(key_rotation_days)
+		if err != nil {
+			log.Printf("SCRATCHCORD_KEY_ROTATION_DAYS is invalid, using %d days", default_key_rotation_days)
+		} else {
+			days = parsed
+		}
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func ConfiguredKeyAlgorithm() string {
+	if key_algorithm == "" {
+		return "RS256"
+	}
+	return key_algorithm
+}
+
+// Loads every key in the key directory
+func (k *KeyRing) Load(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, key_file_prefix+"*.pem"))
+	if err != nil {
+		return err
+	}
+
+	keys := []*SigningKey{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		private, headers, err := ParsePrivateKeyFromPemStr(string(data))
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		algorithm, err := AlgorithmForKey(private)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+
+		// Keys used to be world readable
+		os.Chmod(file, 0600)
+
+		key := &SigningKey{
+			Kid:       headers["Kid"],
+			Algorithm: algorithm,
+			Private:   private,
+			File:      file,
+		}
+		if created, err := strconv.ParseInt(headers["Created"], 10, 64); err == nil {
+			key.Created = time.Unix(created, 0)
+		} else if info, err := os.Stat(file); err == nil {
+			key.Created = info.ModTime()
+		}
+		if key.Kid == "" {
+			key.Kid = legacy_key_id
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+
+	k.mutex.Lock()
+	k.keys = keys
+	k.mutex.Unlock()
+	return nil
+}
+
+// Makes a new key & starts signing with it
+func (k *KeyRing) Rotate(dir string, algorithm string) error {
+	private, err := GenerateSigningKey(algorithm)
+	if err != nil {
+		return err
+	}
+	kidBytes := make([]byte, 8)
+	if _, err := rand.Read(kidBytes); err != nil {
+		return err
+	}
+	key := &SigningKey{
+		Kid:       hex.EncodeToString(kidBytes),
+		Algorithm: algorithm,
+		Created:   time.Now(),
+		Private:   private,
+	}
+	key.File = filepath.Join(dir, key_file_prefix+"-"+key.Kid+".pem")
+
+	pemStr, err := ExportPrivateKeyAsPemStr(private, map[string]string{
+		"Kid":     key.Kid,
+		"Created": strconv.FormatInt(key.Created.Unix(), 10),
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(key.File, []byte(pemStr), 0600); err != nil {
+		return err
+	}
+
+	k.mutex.Lock()
+	k.keys = append(k.keys, key)
+	k.mutex.Unlock()
+	log.Printf("Rotated signing key, now signing with %s (%s)", key.Kid, key.Algorithm)
+	return nil
+}
+
+// Removes keys that can't have any unexpired tokens left
+func (k *KeyRing) Prune() {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	kept := []*SigningKey{}
+	for i, key := range k.keys {
+		// A key stops signing when the next one is made, then its tokens last at most legacy_token_lifetime
+		if i < len(k.keys)-1 && time.Since(k.keys[i+1].Created) > legacy_token_lifetime {
+			if err := os.Remove(key.File); err != nil {
+				log.Printf("failed to remove old signing key %s: %v", key.Kid, err)
+			}
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.keys = kept
+}
+
+func (k *KeyRing) Current() *SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+func (k *KeyRing) Find(kid string) *SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	for _, key := range k.keys {
+		if key.Kid == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+func (k *KeyRing) All() []*SigningKey {
+	k.mutex.RLock()
+	defer k.mutex.RUnlock()
+	return append([]*SigningKey{}, k.keys...)
+}
+
+func (k *KeyRing) Sign(claims jwt.Claims) (string, error) {
+	key := k.Current()
+	if key == nil {
+		return "", errors.New("no signing key")
+	}
+	method, err := SigningMethodForAlgorithm(key.Algorithm)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(method, claims)
+	token.Header["kid"] = key.Kid
+	return token.SignedString(key.Private)
+}
+
+// Finds the key a token was signed with, for jwt.Parse
+func (k *KeyRing) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = legacy_key_id
+	}
+	key := k.Find(kid)
+	if key == nil {
+		return nil, fmt.Errorf("unknown signing key: %s", kid)
+	}
+	// Don't let tokens pick a different algorithm than the key is for
+	if t.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method: %v", t.Method.Alg())
+	}
+	return key.Private.Public(), nil
+}
+
+func setup_signing_keys() {
+	if err := os.MkdirAll(key_path, 0700); err != nil {
+		log.Fatalf("failed to create key directory: %v", err)
+	}
+	os.Chmod(key_path, 0700)
+	if err := SigningKeys.Load(key_path); err != nil {
+		log.Fatalf("failed to load signing keys: %v", err)
+	}
+
+	algorithm := ConfiguredKeyAlgorithm()
+	if _, err := SigningMethodForAlgorithm(algorithm); err != nil {
+		log.Fatal(err)
+	}
+
+	// Make a key if there isn't one, or if the algorithm got changed
+	current := SigningKeys.Current()
+	if current == nil || current.Algorithm != algorithm {
+		if current == nil {
+			log.Printf("Auth private key not found! Generating Authentication Private Key...")
+		}
+		if err := SigningKeys.Rotate(key_path, algorithm); err != nil {
+			log.Fatalf("failed to generate signing key: %v", err)
+		}
+	}
+
+	interval := KeyRotationInterval()
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			if time.Since(SigningKeys.Current().Created) >= interval {
+				if err := SigningKeys.Rotate(key_path, ConfiguredKeyAlgorithm()); err != nil {
+					log.Printf("failed to rotate signing key: %v", err)
+				}
+			}
+			SigningKeys.Prune()
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+// Public keys in JWK format (RFC 7517), so others can check our tokens without asking us
+func PublicKeyToJWK(key *SigningKey) fiber.Map {
+	jwk := fiber.Map{
+		"kid": key.Kid,
+		"alg": key.Algorithm,
+		"use": "sig",
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	switch public := key.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk["kty"] = "RSA"
+		jwk["n"] = b64(public.N.Bytes())
+		jwk["e"] = b64(big.NewInt(int64(public.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		jwk["kty"] = "EC"
+		jwk["crv"] = public.Curve.Params().Name
+		jwk["x"] = b64(public.X.FillBytes(make([]byte, size)))
+		jwk["y"] = b64(public.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		jwk["kty"] = "OKP"
+		jwk["crv"] = "Ed25519"
+		jwk["x"] = b64(public)
+	}
+	return jwk
+}
+
+func jwks(c *fiber.Ctx) error {
+	keys := []fiber.Map{}
+	for _, key := range SigningKeys.All() {
+		keys = append(keys, PublicKeyToJWK(key))
+	}
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(fiber.Map{"keys": keys})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Every token has the account's token generation in it ("gen"). Bumping the generation
+// invalidates every token made before it, tokens from before this existed count as generation 0.
+// Tokens also have the session they belong to ("sid"), so single sessions can be revoked.
+
+var ErrTokenRevoked = errors.New("token revoked")
+
+// Live connections per account, so they can be closed when their tokens are revoked
+var LiveConnections = NewConnectionTracker()
+
+func CreateAccountToken(account Accounts, session Sessions, lifetime time.Duration) (string, error) {
+	// Create the Claims (info encoded inside the token)
+	claims := jwt.MapClaims{
+		"id":  account.ID,
+		"gen": account.TokenGeneration,
+		"sid": session.SessionId,
+		"exp": time.Now().Add(lifetime).Unix(),
+	}
+	return SigningKeys.Sign(claims)
+}
+
+func TokenGeneration(token *jwt.Token) uint {
+	claims := token.Claims.(jwt.MapClaims)
+	if gen, ok := claims["gen"].(float64); ok {
+		return uint(gen)
+	}
+	return 0
+}
+
+// Tokens from before sessions existed don't have one
+func TokenSessionId(token *jwt.Token) string {
+	claims := token.Claims.(jwt.MapClaims)
+	sid, _ := claims["sid"].(string)
+	return sid
+}
+
+// Checks that the token hasn't been revoked since it was made
+func CheckTokenIsCurrent(token *jwt.Token) error {
+	claims := token.Claims.(jwt.MapClaims)
+	accountId, ok := claims["id"].(float64)
+	if !ok {
+		return ErrTokenRevoked
+	}
+
+	account := Accounts{}
+	if err := db.Select("id", "token_generation").First(&account, "id = ?", accountId).Error; err != nil {
+		return ErrAccountDoesNotExist
+	}
+	if TokenGeneration(token) != account.TokenGeneration {
+		return ErrTokenRevoked
+	}
+
+	if sid := TokenSessionId(token); sid != "" {
+		session := Sessions{}
+		if err := db.First(&session, "session_id = ? AND account_id = ?", sid, account.ID).Error; err != nil {
+			return ErrTokenRevoked
+		}
+		session.Touch()
+	}
+	return nil
+}
+
+// Invalidates every token the account has & kicks its live connections
+func RevokeAccountTokens(account *Accounts) error {
+	account.TokenGeneration++
+	if err := db.Model(account).Update("token_generation", account.TokenGeneration).Error; err != nil {
+		return err
+	}
+	db.Where("account_id = ?", account.ID).Delete(&Sessions{})
+	db.Where("account_id = ?", account.ID).Delete(&RefreshTokens{})
+	LiveConnections.CloseAll(account.ID)
+	return nil
+}
+
+type TrackedConnection struct {
+	sessionId string // Empty for connections that logged in with a password (IRC, etc.)
+	close     func()
+}
+
+type ConnectionTracker struct {
+	mutex       sync.Mutex
+	nextId      uint64
+	connections map[uint]map[uint64]TrackedConnection // account id -> connection id -> connection
+}
+
+func NewConnectionTracker() *ConnectionTracker {
+	return &ConnectionTracker{
+		connections: make(map[uint]map[uint64]TrackedConnection),
+	}
+}
+
+// Adds a connection, call the returned function when it's closed
+func (t *ConnectionTracker) Add(accountId uint, sessionId string, close func()) func() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.nextId++
+	id := t.nextId
+	if t.connections[accountId] == nil {
+		t.connections[accountId] = make(map[uint64]TrackedConnection)
+	}
+	t.connections[accountId][id] = TrackedConnection{sessionId: sessionId, close: close}
+
+	return func() {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		delete(t.connections[accountId], id)
+		if len(t.connections[accountId]) == 0 {
+			delete(t.connections, accountId)
+		}
+	}
+}
+
+func (t *ConnectionTracker) CloseAll(accountId uint) {
+	t.closeMatching(accountId, func(TrackedConnection) bool { return true })
+}
+
+func (t *ConnectionTracker) CloseSession(accountId uint, sessionId string) {
+	t.closeMatching(accountId, func(conn TrackedConnection) bool { return conn.sessionId == sessionId })
+}
+
+func (t *ConnectionTracker) closeMatching(accountId uint, matches func(TrackedConnection) bool) {
+	t.mutex.Lock()
+	closers := []func(){}
+	for _, conn := range t.connections[accountId] {
+		if matches(conn) {
+			closers = append(closers, conn.close)
+		}
+	}
+	t.mutex.Unlock()
+
+	// Closing makes the connections remove themselves, so this can't hold the lock
+	for _, close := range closers {
+		close()
+	}
+}
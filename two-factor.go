@@ -0,0 +1,565 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"gorm.io/gorm"
+)
+
+// TOTP two factor authentication (RFC 6238, the kind authenticator apps use).
+// Once it's on, /login gives back a challenge instead of a token, which gets swapped for a token at /login_2fa
+// with a code from the app or one of the recovery codes. Ranks with RequiresTwoFactor make their users set it up.
+
+const (
+	totp_period            = 30 // Seconds
+	totp_digits            = 6
+	totp_skew              = 1 // Steps either side of now that are still accepted, for clocks that are a bit off
+	totp_issuer            = "Scratchcord"
+	recovery_code_count    = 10
+	two_factor_timeout     = 5 * time.Minute
+	two_factor_max_guesses = 5
+)
+
+var ErrTwoFactorRequired = errors.New("two factor authentication required")
+
+type TwoFactorSecrets struct {
+	gorm.Model
+	AccountId     uint `gorm:"uniqueIndex"`
+	Secret        string
+	Enabled       bool   // False until the first code is checked, so a bad scan doesn't lock anyone out
+	RecoveryCodes string `gorm:"type:text"` // Stored as JSON array of hashes
+	LastUsedStep  uint64 // Codes can't be used twice
+	DateEnabled   uint64
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string
+	Code      string
+}
+
+type SetupTwoFactorRequest struct {
+	Password string
+}
+
+type TwoFactorCodeRequest struct {
+	Code string
+}
+
+type DisableTwoFactorRequest struct {
+	Password string
+	Code     string
+}
+
+type ResetTwoFactorRequest struct {
+	UserId uint
+}
+
+// A login that got the password right & is waiting for a code
+type TwoFactorChallenge struct {
+	AccountId     uint
+	ClientVersion string
+	Expires       time.Time
+	Guesses       int
+}
+
+type TwoFactorChallenges struct {
+	mutex      sync.Mutex
+	challenges map[string]*TwoFactorChallenge
+}
+
+var PendingTwoFactorLogins = &TwoFactorChallenges{challenges: make(map[string]*TwoFactorChallenge)}
+
+func (t *TwoFactorChallenges) Start(accountId uint, clientVersion string) (string, error) {
+	challenge, err := RandomURLString(24)
+	if err != nil {
+		return "", err
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// Clean up logins nobody finished
+	for old, pending := range t.challenges {
+		if time.Now().After(pending.Expires) {
+			delete(t.challenges, old)
+		}
+	}
+	t.challenges[challenge] = &TwoFactorChallenge{
+		AccountId:     accountId,
+		ClientVersion: clientVersion,
+		Expires:       time.Now().Add(two_factor_timeout),
+	}
+	return challenge, nil
+}
+
+// Gets a challenge & counts a guess against it, it's gone once it runs out of guesses
+func (t *TwoFactorChallenges) Guess(challenge string) (TwoFactorChallenge, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	pending, ok := t.challenges[challenge]
+	if !ok {
+		return TwoFactorChallenge{}, false
+	}
+	pending.Guesses++
+	if time.Now().After(pending.Expires) || pending.Guesses > two_factor_max_guesses {
+		delete(t.challenges, challenge)
+		return TwoFactorChallenge{}, false
+	}
+	return *pending, true
+}
+
+func (t *TwoFactorChallenges) Finish(challenge string) {
+	t.mutex.Lock()
+	delete(t.challenges, challenge)
+	t.mutex.Unlock()
+}
+
+func GenerateTOTPSecret() (string, error) {
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw), nil
+}
+
+func TOTPCode(secret string, step uint64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	counter := make([]byte, 8)
+	binary.BigEndian.PutUint64(counter, step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter)
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation, from RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totp_digits, value%1000000), nil
+}
+
+// The otpauth:// URI authenticator apps read from a QR code
+func TOTPProvisioningURI(secret string, username string) string {
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", totp_issuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totp_digits))
+	query.Set("period", fmt.Sprint(totp_period))
+	label := url.PathEscape(totp_issuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// Checks a code from the app, returning the step it was for
+func (t *TwoFactorSecrets) CheckCode(code string) (uint64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totp_digits {
+		return 0, false
+	}
+	now := uint64(time.Now().Unix()) / totp_period
+	for step := now - totp_skew; step <= now+totp_skew; step++ {
+		if step <= t.LastUsedStep {
+			continue
+		}
+		expected, err := TOTPCode(t.Secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func GenerateRecoveryCodes() ([]string, []string, error) {
+	codes := []string{}
+	hashes := []string{}
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	for i := 0; i < recovery_code_count; i++ {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(encoding.EncodeToString(raw))
+		code = code[:8] + "-" + code[8:16]
+		codes = append(codes, code)
+		hashes = append(hashes, HashOpaqueToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func (t *TwoFactorSecrets) GetRecoveryCodes() ([]string, error) {
+	var hashes []string
+	err := json.Unmarshal([]byte(t.RecoveryCodes), &hashes)
+	return hashes, err
+}
+
+func (t *TwoFactorSecrets) SetRecoveryCodes(hashes []string) error {
+	jsonHashes, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	t.RecoveryCodes = string(jsonHashes)
+	return nil
+}
+
+// Checks a code from the app or a recovery code, & uses it up so it can't be used again
+func (t *TwoFactorSecrets) Verify(code string) bool {
+	if step, ok := t.CheckCode(code); ok {
+		result := db.Model(&TwoFactorSecrets{}).Where("id = ? AND last_used_step < ?", t.ID, step).Update("last_used_step", step)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return false
+		}
+		t.LastUsedStep = step
+		return true
+	}
+
+	hashes, err := t.GetRecoveryCodes()
+	if err != nil {
+		return false
+	}
+	hash := HashOpaqueToken(strings.ToLower(strings.TrimSpace(code)))
+	i := slices.Index(hashes, hash)
+	if i == -1 {
+		return false
+	}
+	hashes = slices.Delete(hashes, i, i+1)
+	old := t.RecoveryCodes
+	if err := t.SetRecoveryCodes(hashes); err != nil {
+		return false
+	}
+	// Only let one request use the code, even if two come in at once
+	result := db.Model(&TwoFactorSecrets{}).Where("id = ? AND recovery_codes = ?", t.ID, old).Update("recovery_codes", t.RecoveryCodes)
+	return result.Error == nil && result.RowsAffected == 1
+}
+
+func GetTwoFactor(accountId uint) (TwoFactorSecrets, bool) {
+	twoFactor := TwoFactorSecrets{}
+	if err := db.First(&twoFactor, "account_id = ?", accountId).Error; err != nil {
+		return twoFactor, false
+	}
+	return twoFactor, true
+}
+
+func TwoFactorEnabled(accountId uint) bool {
+	twoFactor, ok := GetTwoFactor(accountId)
+	return ok && twoFactor.Enabled
+}
+
+// Makes a new secret for the account, replacing any that wasn't enabled yet
+func StartTwoFactorSetup(account Accounts) (TwoFactorSecrets, error) {
+	twoFactor, _ := GetTwoFactor(account.ID)
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return twoFactor, err
+	}
+	twoFactor.AccountId = account.ID
+	twoFactor.Secret = secret
+	twoFactor.Enabled = false
+	twoFactor.RecoveryCodes = "[]"
+	twoFactor.LastUsedStep = 0
+	err = db.Save(&twoFactor).Error
+	return twoFactor, err
+}
+
+// Turns on two factor once the first code checks out, returning the recovery codes
+func EnableTwoFactor(twoFactor *TwoFactorSecrets) ([]string, error) {
+	codes, hashes, err := GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := twoFactor.SetRecoveryCodes(hashes); err != nil {
+		return nil, err
+	}
+	twoFactor.Enabled = true
+	twoFactor.DateEnabled = uint64(time.Now().Unix())
+	return codes, db.Save(twoFactor).Error
+}
+
+// Starts the second step of a password login. Accounts that need two factor but don't have it
+// get a secret to set up, and finish setting it up with their first code.
+func start_two_factor_login(c *fiber.Ctx, account Accounts, clientVersion string) error {
+	challenge, err := PendingTwoFactorLogins.Start(account.ID, clientVersion)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	twoFactor, ok := GetTwoFactor(account.ID)
+	if ok && twoFactor.Enabled {
+		return c.JSON(fiber.Map{"step": "2fa_required", "challenge": challenge})
+	}
+
+	// Logging in again before finishing keeps the same secret, otherwise whatever they
+	// already scanned would stop working
+	if !ok {
+		twoFactor, err = StartTwoFactorSetup(account)
+		if err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	return c.JSON(fiber.Map{
+		"step":      "2fa_setup_required",
+		"challenge": challenge,
+		"secret":    twoFactor.Secret,
+		"uri":       TOTPProvisioningURI(twoFactor.Secret, account.Username),
+	})
+}
+
+func login_2fa(c *fiber.Ctx) error {
+	r := new(TwoFactorLoginRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	challenge, ok := PendingTwoFactorLogins.Guess(r.Challenge)
+	if !ok {
+		return c.SendString("login expired!")
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", challenge.AccountId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !slices.Contains(ranks, "CanBeLoggedInto") {
+		return c.SendString("account login is restricted!")
+	}
+
+	if LockoutRemaining(account.Username, c.IP()) > 0 {
+		return send_too_many_attempts(c, account.Username)
+	}
+
+	twoFactor, ok := GetTwoFactor(account.ID)
+	if !ok {
+		return c.SendString("login expired!")
+	}
+	var recoveryCodes []string
+	if twoFactor.Enabled {
+		if !twoFactor.Verify(r.Code) {
+			RecordLoginFailure(account.Username, c.IP())
+			return c.SendString("wrong code!")
+		}
+	} else {
+		// Setting it up during login, only a code from the app will do
+		step, ok := twoFactor.CheckCode(r.Code)
+		if !ok {
+			RecordLoginFailure(account.Username, c.IP())
+			return c.SendString("wrong code!")
+		}
+		twoFactor.LastUsedStep = step
+		if recoveryCodes, err = EnableTwoFactor(&twoFactor); err != nil {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+	}
+	PendingTwoFactorLogins.Finish(r.Challenge)
+
+	session, err := StartSession(c, account.ID, challenge.ClientVersion)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	response, err := IssueTokens(account, session, challenge.ClientVersion)
+	if err != nil {
+		log.Printf("token.SignedString: %v", err)
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	RecordLogin(&account)
+	response["avatar"] = account.Avatar
+	response["ranks"] = ranks
+	response["motd"] = motd
+	if recoveryCodes != nil {
+		response["recovery_codes"] = recoveryCodes
+	}
+	return c.JSON(response)
+}
+
+// Gets the account a request is for, for things that need its password. Bots don't have one, so they can't.
+func password_account(c *fiber.Ctx) (Accounts, error) {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	accountId := claims["id"].(float64)
+
+	account := Accounts{}
+	if _, isBot, _ := GetBotToken(user); isBot {
+		return account, ErrLoginRestricted
+	}
+	if err := db.First(&account, "id = ?", accountId).Error; err != nil {
+		return account, ErrAccountDoesNotExist
+	}
+	return account, nil
+}
+
+func setup_2fa(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	r := new(SetupTwoFactorRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if err := CheckPassword(account.PasswordHash, r.Password); err != nil {
+		return c.SendString("wrong password!")
+	}
+	if TwoFactorEnabled(account.ID) {
+		return c.SendString("two factor authentication already enabled!")
+	}
+
+	twoFactor, err := StartTwoFactorSetup(account)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{
+		"secret": twoFactor.Secret,
+		"uri":    TOTPProvisioningURI(twoFactor.Secret, account.Username),
+	})
+}
+
+func enable_2fa(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	r := new(TwoFactorCodeRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	twoFactor, ok := GetTwoFactor(account.ID)
+	if !ok {
+		return c.SendString("two factor authentication not set up!")
+	}
+	if twoFactor.Enabled {
+		return c.SendString("two factor authentication already enabled!")
+	}
+	step, ok := twoFactor.CheckCode(r.Code)
+	if !ok {
+		return c.SendString("wrong code!")
+	}
+	twoFactor.LastUsedStep = step
+	recoveryCodes, err := EnableTwoFactor(&twoFactor)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	// This is the only time the recovery codes are shown
+	return c.JSON(fiber.Map{"recovery_codes": recoveryCodes})
+}
+
+func disable_2fa(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	r := new(DisableTwoFactorRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if err := CheckPassword(account.PasswordHash, r.Password); err != nil {
+		return c.SendString("wrong password!")
+	}
+
+	ranks, err := GetEffectivePermissions(account.Ranks)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if slices.Contains(ranks, "RequiresTwoFactor") {
+		return c.SendString("two factor authentication is required for your rank!")
+	}
+
+	twoFactor, ok := GetTwoFactor(account.ID)
+	if !ok || !twoFactor.Enabled {
+		return c.SendString("two factor authentication not enabled!")
+	}
+	if !twoFactor.Verify(r.Code) {
+		return c.SendString("wrong code!")
+	}
+	db.Unscoped().Delete(&twoFactor)
+	return c.SendString("sucess!")
+}
+
+func regenerate_recovery_codes(c *fiber.Ctx) error {
+	account, err := password_account(c)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	r := new(TwoFactorCodeRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	twoFactor, ok := GetTwoFactor(account.ID)
+	if !ok || !twoFactor.Enabled {
+		return c.SendString("two factor authentication not enabled!")
+	}
+	// Recovery codes can't be used to make more recovery codes
+	step, ok := twoFactor.CheckCode(r.Code)
+	if !ok {
+		return c.SendString("wrong code!")
+	}
+	twoFactor.LastUsedStep = step
+	recoveryCodes, err := EnableTwoFactor(&twoFactor)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.JSON(fiber.Map{"recovery_codes": recoveryCodes})
+}
+
+// For users who lost their authenticator & their recovery codes
+func ResetTwoFactorAdmin(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanResetOtherUsersPasswords"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	r := new(ResetTwoFactorRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	// Only for accounts with weaker ranks, so an admin can't take two factor off an owner
+	claims := c.Locals("user").(*jwt.Token).Claims.(jwt.MapClaims)
+	admin := Accounts{}
+	if err := db.First(&admin, "id = ?", uint(claims["id"].(float64))).Error; err != nil {
+		return c.SendString("user does not exist!")
+	}
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", r.UserId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	adminStrength, err := StrongestRankStrength(admin.Ranks)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	accountStrength, err := StrongestRankStrength(account.Ranks)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if admin.ID != account.ID && accountStrength >= adminStrength {
+		return c.SendString("account's rank is as strong as yours or stronger!")
+	}
+
+	result := db.Unscoped().Where("account_id = ?", r.UserId).Delete(&TwoFactorSecrets{})
+	if result.Error != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if result.RowsAffected == 0 {
+		return c.SendString("two factor authentication not enabled!")
+	}
+	return c.SendString("sucess!")
+}
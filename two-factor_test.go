@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func create_test_account(t *testing.T, username string, ranks string) Accounts {
+	t.Helper()
+	account := Accounts{Username: username, Ranks: ranks}
+	if err := db.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+	return account
+}
+
+func TestTwoFactorSetupKeepsPendingSecret(t *testing.T) {
+	setup_test_ranks(t)
+	if err := db.AutoMigrate(&Accounts{}, &TwoFactorSecrets{}, &RankChanges{}); err != nil {
+		t.Fatal(err)
+	}
+	account := create_test_account(t, "someone", `["Member","RequiresTwoFactor"]`)
+
+	app := fiber.New()
+	app.Post("/login", func(c *fiber.Ctx) error {
+		return start_two_factor_login(c, account, "test")
+	})
+	login := func() map[string]string {
+		response := map[string]string{}
+		if err := json.Unmarshal([]byte(post_test_json(t, app, "/login", nil)), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response["step"] != "2fa_setup_required" {
+			t.Fatalf("wrong step: %v", response)
+		}
+		return response
+	}
+
+	first, second := login(), login()
+	if first["secret"] == "" || first["secret"] != second["secret"] {
+		t.Fatalf("secret changed between logins: %q, %q", first["secret"], second["secret"])
+	}
+}
+
+func TestResetTwoFactorAdminChecksRankStrength(t *testing.T) {
+	setup_test_ranks(t)
+	if err := db.AutoMigrate(&Accounts{}, &TwoFactorSecrets{}, &RankChanges{}, &BotTokens{}); err != nil {
+		t.Fatal(err)
+	}
+	owner := create_test_account(t, "owner", `["Owner"]`)
+	admin := create_test_account(t, "admin", `["Administrator"]`)
+	member := create_test_account(t, "member", `["Member"]`)
+	for _, account := range []Accounts{owner, admin, member} {
+		if err := db.Create(&TwoFactorSecrets{AccountId: account.ID, Secret: "secret", Enabled: true, RecoveryCodes: "[]"}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reset := func(caller Accounts, target Accounts) string {
+		app := fiber.New()
+		app.Post("/reset_2fa", func(c *fiber.Ctx) error {
+			c.Locals("user", &jwt.Token{Valid: true, Claims: jwt.MapClaims{
+				"id":  float64(caller.ID),
+				"exp": float64(time.Now().Add(time.Hour).Unix()),
+			}})
+			return ResetTwoFactorAdmin(c)
+		})
+		return post_test_json(t, app, "/reset_2fa", ResetTwoFactorRequest{UserId: target.ID})
+	}
+
+	if response := reset(admin, owner); response == "sucess!" || !TwoFactorEnabled(owner.ID) {
+		t.Fatal("an administrator reset the owner's two factor")
+	}
+	if response := reset(admin, member); response != "sucess!" || TwoFactorEnabled(member.ID) {
+		t.Fatalf("an administrator couldn't reset a member's two factor: %s", response)
+	}
+	if response := reset(owner, admin); response != "sucess!" || TwoFactorEnabled(admin.ID) {
+		t.Fatalf("the owner couldn't reset an administrator's two factor: %s", response)
+	}
+}
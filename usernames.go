@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"gorm.io/gorm"
+)
+
+// Usernames are unique ignoring case (and unicode lookalikes like full width letters), using their
+// "username key". Names that only look alike are caught by their skeleton, see confusables.go.
+// Renaming keeps the old name in PreviousUsernames, and nobody else can take it for a while so
+// links to the old name keep pointing at the right person.
+
+var reserved_usernames string = os.Getenv("SCRATCHCORD_RESERVED_USERNAMES") // Comma separated
+
+const (
+	username_min_length      = 3
+	username_max_length      = 20
+	username_change_cooldown = 30 * 24 * time.Hour
+	username_hold_duration   = 90 * 24 * time.Hour // How long old names stay with the account that had them
+)
+
+var default_reserved_usernames = []string{
+	"administrator", "admin", "moderator", "mod", "owner", "staff", "support",
+	"system", "server", "scratchcord", "root", "bot", "everyone", "here",
+	"anonymous", "deleted", "null", "undefined",
+}
+
+var (
+	ErrUsernameTooShort  = fmt.Errorf("username must be at least %d characters", username_min_length)
+	ErrUsernameTooLong   = fmt.Errorf("username must be at most %d characters", username_max_length)
+	ErrUsernameCharacter = errors.New("username can only have letters, numbers, underscores, dashes and dots")
+	ErrUsernameReserved  = errors.New("username is reserved")
+	ErrUsernameTaken     = errors.New("username taken")
+)
+
+type PreviousUsernames struct {
+	gorm.Model
+	AccountId        uint `gorm:"index"`
+	Username         string
+	UsernameKey      string `gorm:"index"`
+	UsernameSkeleton string `gorm:"index"` // See confusables.go
+	DateChanged      uint64
+}
+
+type ChangeUsernameRequest struct {
+	Username string
+}
+
+// Keeps the username key & skeleton up to date however the account gets saved
+func (a *Accounts) BeforeSave(tx *gorm.DB) (err error) {
+	if a.Username != "" {
+		a.UsernameKey = UsernameKey(a.Username)
+		a.UsernameSkeleton = UsernameSkeleton(a.Username)
+	}
+	return nil
+}
+
+func NormalizeUsername(username string) string {
+	return strings.TrimSpace(norm.NFC.String(username))
+}
+
+// What usernames are compared by, so "Bob" and "bob" are the same name
+func UsernameKey(username string) string {
+	return cases.Fold().String(norm.NFKC.String(NormalizeUsername(username)))
+}
+
+func ValidateUsername(username string) error {
+	length := len([]rune(username))
+	if length < username_min_length {
+		return ErrUsernameTooShort
+	}
+	if length > username_max_length {
+		return ErrUsernameTooLong
+	}
+	for _, r := range username {
+		if !IsUsernameCharacter(r) {
+			return ErrUsernameCharacter
+		}
+	}
+	return nil
+}
+
+func IsUsernameCharacter(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// Staff sounding names & rank names (or lookalikes of them) can't be registered, so nobody can pretend to be them
+func IsUsernameReserved(username string) bool {
+	skeleton := UsernameSkeleton(username)
+	reserved := slices.Clone(default_reserved_usernames)
+	for _, name := range strings.Split(reserved_usernames, ",") {
+		reserved = append(reserved, name)
+	}
+	var rankNames []string
+	db.Model(&Ranks{}).Pluck("rank_name", &rankNames)
+	reserved = append(reserved, rankNames...)
+
+	for _, name := range reserved {
+		if name = strings.TrimSpace(name); name != "" && UsernameSkeleton(name) == skeleton {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether someone other than accountId has the name, or had it recently
+func IsUsernameTaken(username string, accountId uint) bool {
+	key := UsernameKey(username)
+	var count int64 = 0
+	db.Model(&Accounts{}).Where("username_key = ? AND id != ?", key, accountId).Count(&count)
+	if count > 0 {
+		return true
+	}
+	db.Model(&PreviousUsernames{}).Where("username_key = ? AND account_id != ? AND date_changed > ?", key, accountId, username_held_since()).Count(&count)
+	return count > 0
+}
+
+// Old names changed after this are still held by whoever had them
+func username_held_since() uint64 {
+	return uint64(time.Now().Add(-username_hold_duration).Unix())
+}
+
+// Checks a username someone wants, returning it normalized
+func CheckNewUsername(username string, accountId uint) (string, error) {
+	username = NormalizeUsername(username)
+	if err := ValidateUsername(username); err != nil {
+		return username, err
+	}
+	if IsUsernameReserved(username) {
+		return username, ErrUsernameReserved
+	}
+	if IsUsernameTaken(username, accountId) {
+		return username, ErrUsernameTaken
+	}
+	if IsUsernameConfusable(username, accountId) {
+		return username, ErrUsernameConfusable
+	}
+	if IsUsernameProtected(username, accountId) {
+		return username, ErrUsernameProtected
+	}
+	return username, nil
+}
+
+// Finds an account by name, ignoring case. An exact match wins, for servers that had both "Bob" and "bob" before.
+func FindAccountByUsername(username string) (Accounts, error) {
+	account := Accounts{}
+	if err := db.First(&account, "username = ?", username).Error; err == nil {
+		return account, nil
+	}
+	if err := db.First(&account, "username_key = ?", UsernameKey(username)).Error; err != nil {
+		return account, ErrAccountDoesNotExist
+	}
+	return account, nil
+}
+
+// Finds who had a name most recently, for looking up people that renamed
+func FindPreviousUsername(username string) (PreviousUsernames, bool) {
+	previous := PreviousUsernames{}
+	err := db.Order("date_changed desc").First(&previous, "username_key = ?", UsernameKey(username)).Error
+	return previous, err == nil
+}
+
+// Fills in username keys for accounts from before they existed, then makes them unique.
+// Skeletons are all checked, since they change when the confusables do.
+func setup_username_keys() {
+	accounts := []Accounts{}
+	db.Find(&accounts)
+	for _, account := range accounts {
+		if key := UsernameKey(account.Username); account.UsernameKey != key {
+			db.Model(&account).UpdateColumn("username_key", key)
+		}
+		if skeleton := UsernameSkeleton(account.Username); account.UsernameSkeleton != skeleton {
+			db.Model(&account).UpdateColumn("username_skeleton", skeleton)
+		}
+	}
+	previousUsernames := []PreviousUsernames{}
+	db.Find(&previousUsernames)
+	for _, previous := range previousUsernames {
+		if skeleton := UsernameSkeleton(previous.Username); previous.UsernameSkeleton != skeleton {
+			db.Model(&previous).UpdateColumn("username_skeleton", skeleton)
+		}
+	}
+
+	// Servers from before this can have names that only differ by case, those have to be renamed by hand
+	if err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_accounts_username_key ON accounts(username_key)").Error; err != nil {
+		var duplicates []string
+		db.Model(&Accounts{}).Group("username_key").Having("COUNT(*) > 1").Pluck("username_key", &duplicates)
+		log.Printf("usernames are not unique ignoring case, rename these accounts: %v", duplicates)
+	}
+}
+
+func change_username(c *fiber.Ctx) error {
+	user := c.Locals("user").(*jwt.Token)
+	claims := user.Claims.(jwt.MapClaims)
+	accountId := claims["id"].(float64)
+
+	account := Accounts{}
+	if err := db.First(&account, "id = ?", accountId).Error; err != nil {
+		return c.SendString("account does not exist!")
+	}
+	ranks, err := GetTokenPermissions(user, account)
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	if !slices.Contains(ranks, "CanChangeUsername") {
+		return c.SendString("changing usernames is restricted!")
+	}
+
+	r := new(ChangeUsernameRequest)
+	if err := json.Unmarshal(c.BodyRaw(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	now := time.Now()
+	if account.LastUsernameChange != 0 && now.Before(time.Unix(int64(account.LastUsernameChange), 0).Add(username_change_cooldown)) {
+		return c.SendString("username changed too recently!")
+	}
+	username, err := CheckNewUsername(r.Username, account.ID)
+	if err != nil {
+		return c.SendString(err.Error() + "!")
+	}
+	if username == account.Username {
+		return c.SendString("that's already your username!")
+	}
+
+	oldUsername := account.Username
+	account.Username = username
+	account.LastUsernameChange = uint64(now.Unix())
+	err = db.Transaction(func(tx *gorm.DB) error {
+		// Only changing the case doesn't free anything up, so there's nothing to keep
+		if UsernameKey(oldUsername) != UsernameKey(username) {
+			err := tx.Create(&PreviousUsernames{
+				AccountId:        account.ID,
+				Username:         oldUsername,
+				UsernameKey:      UsernameKey(oldUsername),
+				UsernameSkeleton: UsernameSkeleton(oldUsername),
+				DateChanged:      uint64(now.Unix()),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Model(&account).UpdateColumns(map[string]interface{}{
+			"username":             username,
+			"username_key":         UsernameKey(username),
+			"username_skeleton":    UsernameSkeleton(username),
+			"last_username_change": account.LastUsernameChange,
+		}).Error
+	})
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+	return c.SendString("sucess!")
+}
@@ -0,0 +1,686 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type Webhooks struct {
+	ID         uint   `gorm:"primaryKey"`
+	Name       string // Just so admins can tell them apart
+	URL        string
+	Secret     string // Used for signing the payloads, shown once on creation
+	Format     string // "discord", "slack" or "json"
+	Channels   string `gorm:"type:text"` // Stored as JSON array, empty means every channel
+	EventTypes string `gorm:"type:text"` // Stored as JSON array, empty means every event type
+	Events     string `gorm:"type:text"` // Stored as JSON array, empty means just new messages
+	Enabled    bool
+	Legacy     bool // Set on the SCRATCHCORD_WEBHOOK_URL subscription, global messages still go through its channel filter like they used to
+}
+
+type WebhookDeliveries struct {
+	ID          uint `gorm:"primaryKey"`
+	WebhookId   uint `gorm:"index"`
+	Payload     string
+	Attempts    uint
+	NextAttempt uint64 `gorm:"index"`
+	LastError   string
+	// Status... statuses
+	// 0 - Pending
+	// 1 - Delivered
+	// 2 - Failed (gave up)
+	Status    uint8 `gorm:"index"`
+	Timestamp uint64
+}
+
+type CreateWebhookRequest struct {
+	Name       string
+	URL        string
+	Format     string
+	Channels   []string
+	EventTypes []string
+	Events     []string
+}
+
+type DeleteWebhookRequest struct {
+	WebhookId uint
+}
+
+type WebhookInfoResponse struct {
+	ID         uint
+	Name       string
+	URL        string
+	Format     string
+	Channels   []string
+	EventTypes []string
+	Events     []string
+	Enabled    bool
+}
+
+// A generic payload for webhooks using the "json" format
+type WebhookJsonPayload struct {
+	Event     string
+	EventType string
+	Channel   string
+	MessageId uint
+	Message   string
+	UserId    uint
+	Username  string
+	Avatar    string
+	Timestamp uint64
+}
+
+type SlackWebhookPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username,omitempty"`
+	IconUrl  string `json:"icon_url,omitempty"`
+}
+
+const (
+	webhook_max_attempts  uint = 10
+	webhook_max_backoff        = time.Hour
+	webhook_poll_interval      = time.Second
+	webhook_batch_size         = 20
+	webhook_max_workers        = 8 // Targets being delivered to at once, so one slow target can't hold up the rest
+)
+
+const (
+	webhook_prune_interval     = time.Hour
+	webhook_delivery_retention = 7 * 24 * time.Hour // Delivered & failed deliveries are kept this long, for debugging
+)
+
+var (
+	permitted_webhook_formats = []string{"discord", "slack", "json"}
+	permitted_webhook_events  = []string{"new_message", "message_updated", "message_deleted"}
+	webhook_http_client       = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Gets the event type name of a message type, these are what webhooks filter by.
+// Returns an empty string for messages that should never leave the server.
+func GetMessageEventType(messageType uint8) string {
+	switch messageType {
+	case 1:
+		return "message"
+	case 2:
+		return "nudge"
+	case 4:
+		return "create_game"
+	case 5:
+		return "message_tts"
+	case 6:
+		return "join_game"
+	case 7:
+		return "bridged_message"
+	case 100:
+		return "global_message"
+	case 101:
+		return "global_message_tts"
+	case 102:
+		return "special_message"
+	case 103:
+		return "special_message_tts"
+	case 104:
+		return "kick"
+	case 105:
+		return "kick_all"
+	}
+	return ""
+}
+
+func (w *Webhooks) GetChannels() ([]string, error) {
+	var channels []string
+	err := json.Unmarshal([]byte(w.Channels), &channels)
+	return channels, err
+}
+
+func (w *Webhooks) GetEventTypes() ([]string, error) {
+	var eventTypes []string
+	err := json.Unmarshal([]byte(w.EventTypes), &eventTypes)
+	return eventTypes, err
+}
+
+func (w *Webhooks) GetEvents() ([]string, error) {
+	if w.Events == "" {
+		return []string{}, nil
+	}
+	var events []string
+	err := json.Unmarshal([]byte(w.Events), &events)
+	return events, err
+}
+
+// Checks if a webhook is subscribed to a message
+func (w *Webhooks) Matches(msg BroadcastDBMessage) bool {
+	if !w.Enabled {
+		return false
+	}
+	eventType := GetMessageEventType(msg.data.Type)
+	if eventType == "" {
+		return false
+	}
+
+	eventTypes, err := w.GetEventTypes()
+	if err != nil {
+		return false
+	}
+	if len(eventTypes) != 0 && !slices.Contains(eventTypes, eventType) {
+		return false
+	}
+
+	// Edits & deletes are opt in, otherwise chat webhooks would post every message twice
+	events, err := w.GetEvents()
+	if err != nil {
+		return false
+	}
+	if len(events) == 0 {
+		events = []string{"new_message"}
+	}
+	if !slices.Contains(events, msg.event) {
+		return false
+	}
+
+	// Global messages ignore the channel filter, same as the websocket
+	if !w.Legacy && (msg.data.Type == 100 || msg.data.Type == 101 || msg.data.Type == 105) {
+		return true
+	}
+	channels, err := w.GetChannels()
+	if err != nil {
+		return false
+	}
+	return len(channels) == 0 || slices.Contains(channels, msg.data.Channel)
+}
+
+// Creates the body of a webhook for a message.
+func BuildWebhookPayload(format string, msg BroadcastDBMessage, user Accounts) ([]byte, error) {
+	switch format {
+	case "discord":
+		message, ok := BuildDiscordWebhookMessage(msg, user)
+		if !ok {
+			return nil, nil
+		}
+		return json.Marshal(message)
+	case "slack":
+		username, avatar, contents, ok := DescribeMessageForWebhook(msg, user)
+		if !ok {
+			return nil, nil
+		}
+		return json.Marshal(SlackWebhookPayload{
+			Text:     contents,
+			Username: username,
+			IconUrl:  avatar,
+		})
+	case "json":
+		if msg.data.Type == 7 {
+			user.Username = msg.data.BridgedUsername
+			user.Avatar = msg.data.BridgedAvatar
+		}
+		return json.Marshal(WebhookJsonPayload{
+			Event:     msg.event,
+			EventType: GetMessageEventType(msg.data.Type),
+			Channel:   msg.data.Channel,
+			MessageId: msg.data.ID,
+			Message:   msg.data.Message,
+			UserId:    msg.data.UserId,
+			Username:  user.Username,
+			Avatar:    user.Avatar,
+			Timestamp: msg.data.Timestamp,
+		})
+	}
+	return nil, fmt.Errorf("unknown webhook format: %s", format)
+}
+
+// Signs a payload so the reciever can check that it came from us.
+// The signature is HMAC-SHA256 over "<timestamp>.<body>", hex encoded.
+func SignWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func GenerateWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Queues a message for every webhook that's subscribed to it
+func EnqueueWebhookDeliveries(msg BroadcastDBMessage) {
+	webhooks := []Webhooks{}
+	if err := db.Find(&webhooks, "enabled = ?", true).Error; err != nil {
+		log.Println("failed to fetch webhooks:", err)
+		return
+	}
+
+	var user *Accounts
+	for _, webhook := range webhooks {
+		if !webhook.Matches(msg) {
+			continue
+		}
+		if user == nil {
+			user = &Accounts{}
+			db.First(user, "id = ?", msg.data.UserId)
+		}
+
+		payload, err := BuildWebhookPayload(webhook.Format, msg, *user)
+		if err != nil {
+			log.Printf("failed to build payload for webhook %d: %v", webhook.ID, err)
+			continue
+		}
+		if payload == nil {
+			continue
+		}
+
+		delivery := WebhookDeliveries{
+			WebhookId:   webhook.ID,
+			Payload:     string(payload),
+			NextAttempt: uint64(time.Now().Unix()),
+			Status:      0,
+			Timestamp:   uint64(time.Now().Unix()),
+		}
+		if err := db.Create(&delivery).Error; err != nil {
+			log.Printf("failed to queue delivery for webhook %d: %v", webhook.ID, err)
+		}
+	}
+}
+
+// An error from a webhook target, with how long they want us to wait (if they told us)
+type WebhookDeliveryError struct {
+	StatusCode int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *WebhookDeliveryError) Error() string {
+	return fmt.Sprintf("webhook target responded with %d: %s", e.StatusCode, e.Body)
+}
+
+func SendWebhookDelivery(webhook Webhooks, delivery WebhookDeliveries) error {
+	req, err := http.NewRequest("POST", webhook.URL, bytes.NewBufferString(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Scratchcord-Webhooks")
+	req.Header.Set("X-Scratchcord-Delivery", strconv.FormatUint(uint64(delivery.ID), 10))
+	req.Header.Set("X-Scratchcord-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Scratchcord-Signature", SignWebhookPayload(webhook.Secret, timestamp, []byte(delivery.Payload)))
+
+	res, err := webhook_http_client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+
+	if res.StatusCode >= 200 && res.StatusCode < 300 {
+		return nil
+	}
+
+	deliveryErr := &WebhookDeliveryError{
+		StatusCode: res.StatusCode,
+		Body:       string(body),
+	}
+	if res.StatusCode == fiber.StatusTooManyRequests {
+		deliveryErr.RetryAfter = ParseRetryAfter(res.Header.Get("Retry-After"), body)
+	}
+	return deliveryErr
+}
+
+// Figures out how long a rate limited target wants us to wait.
+// Discord puts a "retry_after" (in seconds) in the body, everyone else uses the header.
+func ParseRetryAfter(header string, body []byte) time.Duration {
+	discordRateLimit := struct {
+		RetryAfter float64 `json:"retry_after"`
+	}{}
+	if err := json.Unmarshal(body, &discordRateLimit); err == nil && discordRateLimit.RetryAfter > 0 {
+		return time.Duration(discordRateLimit.RetryAfter * float64(time.Second))
+	}
+	if seconds, err := strconv.ParseFloat(header, 64); err == nil && seconds > 0 {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// Exponential backoff, 2^attempts seconds capped at an hour.
+func WebhookBackoff(attempts uint) time.Duration {
+	backoff := time.Duration(math.Pow(2, float64(attempts))) * time.Second
+	if backoff > webhook_max_backoff || backoff <= 0 {
+		return webhook_max_backoff
+	}
+	return backoff
+}
+
+func ProcessWebhookDelivery(delivery WebhookDeliveries) {
+	webhook := Webhooks{}
+	if err := db.First(&webhook, "id = ?", delivery.WebhookId).Error; err != nil || !webhook.Enabled {
+		// The webhook is gone, so there's nowhere to send it
+		db.Model(&delivery).Updates(map[string]interface{}{"status": 2, "last_error": "webhook deleted or disabled"})
+		return
+	}
+
+	err := SendWebhookDelivery(webhook, delivery)
+	if err == nil {
+		db.Model(&delivery).Updates(map[string]interface{}{"status": 1, "attempts": delivery.Attempts + 1, "last_error": ""})
+		return
+	}
+
+	delivery.Attempts++
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= webhook_max_attempts {
+		log.Printf("giving up on webhook delivery %d after %d attempts: %v", delivery.ID, delivery.Attempts, err)
+		delivery.Status = 2
+	} else {
+		wait := WebhookBackoff(delivery.Attempts)
+		var deliveryErr *WebhookDeliveryError
+		if errors.As(err, &deliveryErr) && deliveryErr.RetryAfter > 0 {
+			wait = deliveryErr.RetryAfter
+		}
+		delivery.NextAttempt = uint64(time.Now().Add(wait).Unix())
+	}
+	db.Save(&delivery)
+}
+
+func start_webhook_dispatcher() {
+	// Keep the old env variable working, it's just another subscription now.
+	if webhook_url != "" {
+		ensure_legacy_webhook()
+	}
+	migrate_webhook_events()
+
+	// Queue up anything new
+	go func() {
+		eventChannel := BroadcastPublisher.Subscribe()
+		for msg := range eventChannel {
+			EnqueueWebhookDeliveries(msg)
+		}
+	}()
+
+	// Deliver whatever's queued. Since it's stored in the DB, deliveries survive restarts.
+	go run_webhook_deliveries()
+}
+
+// Hands due deliveries to a worker per target, at most webhook_max_workers at once. A target's
+// deliveries still go out in order, but a target that's timing out only holds up itself.
+func run_webhook_deliveries() {
+	var mutex sync.Mutex
+	busy := make(map[uint]bool) // Targets with a worker already
+	workers := make(chan struct{}, webhook_max_workers)
+	var lastPrune time.Time
+
+	for {
+		if time.Since(lastPrune) >= webhook_prune_interval {
+			prune_webhook_deliveries()
+			lastPrune = time.Now()
+		}
+
+		mutex.Lock()
+		busyIds := slices.Collect(maps.Keys(busy))
+		mutex.Unlock()
+
+		deliveries := []WebhookDeliveries{}
+		query := db.Order("next_attempt ASC").Limit(webhook_batch_size).Where("status = ? AND next_attempt <= ?", 0, time.Now().Unix())
+		if len(busyIds) > 0 {
+			query = query.Where("webhook_id NOT IN ?", busyIds)
+		}
+		if err := query.Find(&deliveries).Error; err != nil {
+			log.Println("failed to fetch webhook deliveries:", err)
+		}
+
+		byWebhook := make(map[uint][]WebhookDeliveries)
+		order := []uint{}
+		for _, delivery := range deliveries {
+			if _, ok := byWebhook[delivery.WebhookId]; !ok {
+				order = append(order, delivery.WebhookId)
+			}
+			byWebhook[delivery.WebhookId] = append(byWebhook[delivery.WebhookId], delivery)
+		}
+
+		started := 0
+		for _, webhookId := range order {
+			select {
+			case workers <- struct{}{}:
+			default:
+				continue // Every worker's busy, the rest wait for the next poll
+			}
+			mutex.Lock()
+			busy[webhookId] = true
+			mutex.Unlock()
+			started++
+
+			go func(webhookId uint, deliveries []WebhookDeliveries) {
+				defer func() {
+					mutex.Lock()
+					delete(busy, webhookId)
+					mutex.Unlock()
+					<-workers
+				}()
+				for _, delivery := range deliveries {
+					ProcessWebhookDelivery(delivery)
+				}
+			}(webhookId, byWebhook[webhookId])
+		}
+
+		if started == 0 || len(deliveries) < webhook_batch_size {
+			time.Sleep(webhook_poll_interval)
+		}
+	}
+}
+
+// Deletes delivered & failed deliveries once they're older than webhook_delivery_retention,
+// otherwise every message ever sent would stay in the table.
+func prune_webhook_deliveries() {
+	cutoff := time.Now().Add(-webhook_delivery_retention).Unix()
+	result := db.Where("status IN ? AND timestamp < ?", []int{1, 2}, cutoff).Delete(&WebhookDeliveries{})
+	if result.Error != nil {
+		log.Println("failed to prune webhook deliveries:", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("pruned %d old webhook deliveries", result.RowsAffected)
+	}
+}
+
+// Edits & deletes used to be subscribed to by putting them in EventTypes, moves them to Events.
+func migrate_webhook_events() {
+	webhooks := []Webhooks{}
+	if err := db.Find(&webhooks).Error; err != nil {
+		log.Println("failed to fetch webhooks:", err)
+		return
+	}
+	for _, webhook := range webhooks {
+		eventTypes, err := webhook.GetEventTypes()
+		if err != nil {
+			continue
+		}
+		events := []string{}
+		for _, event := range permitted_webhook_events {
+			if slices.Contains(eventTypes, event) {
+				events = append(events, event)
+			}
+		}
+		if len(events) == 0 {
+			continue
+		}
+		// They got new messages as well before
+		if !slices.Contains(events, "new_message") {
+			events = append([]string{"new_message"}, events...)
+		}
+		eventTypes = slices.DeleteFunc(eventTypes, func(eventType string) bool {
+			return slices.Contains(permitted_webhook_events, eventType)
+		})
+
+		eventTypesJSON, _ := json.Marshal(eventTypes)
+		eventsJSON, _ := json.Marshal(events)
+		log.Printf("moving webhook %d's edit & delete subscriptions out of its event types, events are now %v", webhook.ID, events)
+		if err := db.Model(&webhook).Updates(map[string]interface{}{"event_types": string(eventTypesJSON), "events": string(eventsJSON)}).Error; err != nil {
+			log.Printf("failed to migrate webhook %d: %v", webhook.ID, err)
+		}
+	}
+}
+
+// Makes sure SCRATCHCORD_WEBHOOK_URL has a subscription, which is what it used to do.
+func ensure_legacy_webhook() {
+	var count int64 = 0
+	db.Model(&Webhooks{}).Where("url = ?", webhook_url).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	secret, err := GenerateWebhookSecret()
+	if err != nil {
+		log.Fatalf("GenerateWebhookSecret: %v", err)
+	}
+	webhook := Webhooks{
+		Name:       "SCRATCHCORD_WEBHOOK_URL",
+		URL:        webhook_url,
+		Secret:     secret,
+		Format:     "discord",
+		Channels:   `["general"]`,
+		EventTypes: `[]`,
+		Events:     `[]`,
+		Enabled:    true,
+		Legacy:     true,
+	}
+	db.Create(&webhook)
+}
+
+func CreateWebhookAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageWebhooks"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	var r CreateWebhookRequest
+	if err := json.Unmarshal(c.Body(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	if r.URL == "" {
+		return c.SendString("webhook url is required!")
+	}
+	if r.Format == "" {
+		r.Format = "json"
+	}
+	if !slices.Contains(permitted_webhook_formats, r.Format) {
+		return c.SendString("webhook format not supported!")
+	}
+	if r.Channels == nil {
+		r.Channels = []string{}
+	}
+	if r.EventTypes == nil {
+		r.EventTypes = []string{}
+	}
+	if r.Events == nil {
+		r.Events = []string{}
+	}
+	for _, event := range r.Events {
+		if !slices.Contains(permitted_webhook_events, event) {
+			return c.SendString("webhook event not supported: " + event + "!")
+		}
+	}
+
+	channelsJSON, err := json.Marshal(r.Channels)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	eventTypesJSON, err := json.Marshal(r.EventTypes)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	eventsJSON, err := json.Marshal(r.Events)
+	if err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+	secret, err := GenerateWebhookSecret()
+	if err != nil {
+		return c.SendStatus(fiber.StatusInternalServerError)
+	}
+
+	webhook := Webhooks{
+		Name:       r.Name,
+		URL:        r.URL,
+		Secret:     secret,
+		Format:     r.Format,
+		Channels:   string(channelsJSON),
+		EventTypes: string(eventTypesJSON),
+		Events:     string(eventsJSON),
+		Enabled:    true,
+	}
+	if err := db.Create(&webhook).Error; err != nil {
+		c.SendStatus(fiber.StatusInternalServerError)
+		return c.SendString("failed to create webhook: " + err.Error())
+	}
+
+	// This is the only time the secret is shown
+	return c.JSON(fiber.Map{"id": webhook.ID, "secret": secret})
+}
+
+func DeleteWebhookAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageWebhooks"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	var r DeleteWebhookRequest
+	if err := json.Unmarshal(c.Body(), &r); err != nil {
+		return c.SendStatus(fiber.StatusBadRequest)
+	}
+
+	result := db.Delete(&Webhooks{}, "id = ?", r.WebhookId)
+	if result.Error != nil {
+		return c.SendString("failed to delete webhook" + result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return c.SendString("webhook doesn't exist!")
+	}
+	db.Where("webhook_id = ? AND status = ?", r.WebhookId, 0).Delete(&WebhookDeliveries{})
+	return c.SendString("sucess!")
+}
+
+func ListWebhooksAPI(c *fiber.Ctx) error {
+	if err := CheckIfTokenHasRank(c, "CanManageWebhooks"); err != nil {
+		return c.SendStatus(fiber.StatusUnauthorized)
+	}
+
+	webhooks := []Webhooks{}
+	db.Find(&webhooks)
+
+	response := make([]WebhookInfoResponse, 0, len(webhooks))
+	for _, webhook := range webhooks {
+		channels, _ := webhook.GetChannels()
+		eventTypes, _ := webhook.GetEventTypes()
+		events, _ := webhook.GetEvents()
+		response = append(response, WebhookInfoResponse{
+			ID:         webhook.ID,
+			Name:       webhook.Name,
+			URL:        webhook.URL,
+			Format:     webhook.Format,
+			Channels:   channels,
+			EventTypes: eventTypes,
+			Events:     events,
+			Enabled:    webhook.Enabled,
+		})
+	}
+	return c.JSON(response)
+}
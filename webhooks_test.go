@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWebhookMatchesEventsSeparately(t *testing.T) {
+	message := BroadcastDBMessage{event: "new_message", data: Messages{Type: 1, Channel: "general"}}
+	edit := BroadcastDBMessage{event: "message_updated", data: Messages{Type: 1, Channel: "general"}}
+	nudge := BroadcastDBMessage{event: "new_message", data: Messages{Type: 2, Channel: "general"}}
+
+	tests := []struct {
+		name    string
+		webhook Webhooks
+		matches []bool // message, edit, nudge
+	}{
+		{"everything", Webhooks{EventTypes: `[]`, Events: `[]`}, []bool{true, false, true}},
+		{"edits", Webhooks{EventTypes: `[]`, Events: `["new_message","message_updated"]`}, []bool{true, true, true}},
+		{"only edits", Webhooks{EventTypes: `[]`, Events: `["message_updated"]`}, []bool{false, true, false}},
+		{"edited messages", Webhooks{EventTypes: `["message"]`, Events: `["new_message","message_updated"]`}, []bool{true, true, false}},
+		{"nudges", Webhooks{EventTypes: `["nudge"]`, Events: `[]`}, []bool{false, false, true}},
+	}
+	for _, test := range tests {
+		test.webhook.Enabled = true
+		test.webhook.Channels = `[]`
+		for i, msg := range []BroadcastDBMessage{message, edit, nudge} {
+			if test.webhook.Matches(msg) != test.matches[i] {
+				t.Errorf("%s: expected %v for %s of type %d", test.name, test.matches[i], msg.event, msg.data.Type)
+			}
+		}
+	}
+}
+
+func TestLegacyWebhookKeepsChannelFilterForGlobalMessages(t *testing.T) {
+	global := BroadcastDBMessage{event: "new_message", data: Messages{Type: 100, Channel: "other"}}
+
+	webhook := Webhooks{Channels: `["general"]`, EventTypes: `[]`, Events: `[]`, Enabled: true}
+	if !webhook.Matches(global) {
+		t.Error("global message didn't skip the channel filter")
+	}
+	webhook.Legacy = true
+	if webhook.Matches(global) {
+		t.Error("legacy webhook got a global message from another channel")
+	}
+	global.data.Channel = "general"
+	if !webhook.Matches(global) {
+		t.Error("legacy webhook didn't get a global message from its channel")
+	}
+}
+
+func TestPruneWebhookDeliveries(t *testing.T) {
+	setup_test_db(t, &WebhookDeliveries{})
+
+	old := uint64(time.Now().Add(-webhook_delivery_retention - time.Hour).Unix())
+	recent := uint64(time.Now().Unix())
+	deliveries := []WebhookDeliveries{
+		{Status: 0, Timestamp: old},    // Still pending, kept
+		{Status: 1, Timestamp: old},    // Delivered, pruned
+		{Status: 2, Timestamp: old},    // Failed, pruned
+		{Status: 1, Timestamp: recent}, // Delivered recently, kept
+	}
+	if err := db.Create(&deliveries).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	prune_webhook_deliveries()
+
+	left := []WebhookDeliveries{}
+	db.Order("id").Find(&left)
+	if len(left) != 2 || left[0].ID != deliveries[0].ID || left[1].ID != deliveries[3].ID {
+		t.Fatalf("wrong deliveries left: %+v", left)
+	}
+}
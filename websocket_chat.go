@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"slices"
+	"strconv"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
@@ -21,12 +22,22 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 		c.Close()
 		return
 	}
-	token, tokenerr := jwt.Parse(c.Query("token"), func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", c.Query("token"))
+	var token *jwt.Token
+	var tokenerr error
+	connectionId := ""
+	if IsBotToken(c.Query("token")) {
+		// Bots use their API token instead of a JWT
+		botToken, botAccount, err := AuthenticateBotToken(c.Query("token"))
+		if err != nil || !botToken.CanUseChannel(channel) {
+			fmt.Println("bot token invalid!")
+			c.Close()
+			return
 		}
-		return privateKey.Public(), nil
-	})
+		token = BotTokenAsJWT(botToken, botAccount)
+		connectionId = BotConnectionId(botToken.ID)
+	} else {
+		token, tokenerr = jwt.Parse(c.Query("token"), SigningKeys.Keyfunc)
+	}
 
 	if tokenerr != nil {
 		fmt.Println("error on decoding token: " + tokenerr.Error())
@@ -39,6 +50,9 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 		c.Close()
 		return
 	}
+	if connectionId == "" {
+		connectionId = TokenSessionId(token)
+	}
 
 	claims := token.Claims.(jwt.MapClaims)
 	user_id := claims["id"].(float64)
@@ -48,13 +62,26 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 		c.Close()
 		return
 	}
-	ranks, rankerr := GetEffectivePermissions(account.Ranks)
+	if _, isBot, _ := GetBotToken(token); !isBot {
+		if err := CheckTokenIsCurrent(token); err != nil {
+			fmt.Println("token revoked!")
+			c.Close()
+			return
+		}
+	}
+	ranks, rankerr := GetTokenPermissions(token, account)
 	if rankerr != nil {
 		c.Close()
 		return
 	}
+	// Get kicked off when the token is revoked
+	removeConnection := LiveConnections.Add(account.ID, connectionId, func() { disconnect_websocket(c, "token revoked") })
+	defer removeConnection()
 	//username := account.Username
 
+	ChannelPresence.Join(channel, account.ID)
+	defer ChannelPresence.Leave(channel, account.ID)
+
 	// websocket.Conn bindings https://pkg.go.dev/github.com/fasthttp/websocket?tab=doc#pkg-index
 	var (
 		// mt  int
@@ -80,6 +107,60 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 				continue
 			}
 			responce_json := []byte{}
+
+			// The account's messages in this channel were deleted or moved to the deleted user, all at once
+			if recv_msg.event == "account_deleted" {
+				if !slices.Contains(ranks, "CanReadMessages") {
+					continue
+				}
+				responce_json, err = json.Marshal(RecievedAccountDeletedResponse{
+					Cmd:       "recv_account_deleted",
+					UserId:    recv_msg.data.UserId,
+					NewUserId: recv_msg.newUserId,
+				})
+				if err != nil {
+					c.Close()
+					return
+				}
+				if err := c.WriteMessage(websocket.TextMessage, responce_json); err != nil {
+					log.Println("write error:", err)
+					return
+				}
+				continue
+			}
+
+			// Edits and deletes don't need the whole message resent
+			if recv_msg.event == "message_updated" || recv_msg.event == "message_deleted" {
+				if !slices.Contains(ranks, "CanReadMessages") {
+					continue
+				}
+				if recv_msg.event == "message_updated" {
+					responce := RecievedMessageResponse{
+						Cmd:       "recv_edit",
+						UserId:    recv_msg.data.UserId,
+						MessageId: recv_msg.data.ID,
+						Message:   recv_msg.data.Message,
+					}
+					responce_json, err = json.Marshal(responce)
+				} else {
+					responce := RecievedMessageResponseNoBody{
+						Cmd:       "recv_delete",
+						UserId:    recv_msg.data.UserId,
+						MessageId: recv_msg.data.ID,
+					}
+					responce_json, err = json.Marshal(responce)
+				}
+				if err != nil {
+					c.Close()
+					return
+				}
+				if err := c.WriteMessage(websocket.TextMessage, responce_json); err != nil {
+					log.Println("write error:", err)
+					return
+				}
+				continue
+			}
+
 			switch recv_msg.data.Type {
 			case 1: // Normal Message
 				if !slices.Contains(ranks, "CanReadMessages") {
@@ -144,6 +225,18 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 					Message:   recv_msg.data.Message,
 				}
 				responce_json, err = json.Marshal(responce)
+			case 7: // Bridged Message
+				if !slices.Contains(ranks, "CanReadMessages") {
+					break
+				}
+				responce := RecievedBridgedMessageResponse{
+					Cmd:       "recv_bridged_msg",
+					MessageId: recv_msg.data.ID,
+					Message:   recv_msg.data.Message,
+					Username:  recv_msg.data.BridgedUsername,
+					Avatar:    recv_msg.data.BridgedAvatar,
+				}
+				responce_json, err = json.Marshal(responce)
 			case 100, 102:
 				if !slices.Contains(ranks, "CanReadSpecialMessages") {
 					break
@@ -237,6 +330,35 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 				Timestamp: uint64(time.Now().Unix()),
 			}
 			db.Create(&db_msg)
+		case "edit_msg":
+			if !slices.Contains(ranks, "CanSendMessage") {
+				break
+			}
+			r := EditMessageRequest{}
+			if err := json.Unmarshal(msg, &r); err != nil {
+				c.Close()
+				return
+			}
+			db_msg := Messages{}
+			if err := db.First(&db_msg, "id = ? AND user_id = ? AND channel = ? AND type IN ?", r.MessageId, uint(user_id), channel, []uint8{1, 5}).Error; err != nil {
+				break
+			}
+			db_msg.Message = r.Message
+			db.Save(&db_msg)
+		case "delete_msg":
+			if !slices.Contains(ranks, "CanSendMessage") {
+				break
+			}
+			r := DeleteMessageRequest{}
+			if err := json.Unmarshal(msg, &r); err != nil {
+				c.Close()
+				return
+			}
+			db_msg := Messages{}
+			if err := db.First(&db_msg, "id = ? AND user_id = ? AND channel = ?", r.MessageId, uint(user_id), channel).Error; err != nil {
+				break
+			}
+			db.Delete(&db_msg)
 		case "nudge":
 			if !slices.Contains(ranks, "CanSendNudge") {
 				break
@@ -291,7 +413,7 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 				return
 			}
 			db_msg := Messages{
-				Message:   string(r.CreateGameMessageId),
+				Message:   strconv.FormatUint(uint64(r.CreateGameMessageId), 10),
 				UserId:    uint(user_id),
 				Type:      6,
 				Channel:   channel,
@@ -311,3 +433,10 @@ func global_channel_websocket_handler(c *websocket.Conn) {
 		// }
 	}
 }
+
+// Disconnects a websocket from outside its handler. Close() doesn't work for this, since fiber
+// only really closes the connection once the handler returns, so this makes the handler's read fail.
+func disconnect_websocket(c *websocket.Conn, reason string) {
+	c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason), time.Now().Add(time.Second))
+	c.SetReadDeadline(time.Now())
+}